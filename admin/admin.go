@@ -0,0 +1,205 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admin HTTP admin API of a running node, every endpoint answers GET
+// requests with JSON and is meant to be bound to localhost
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/p2sub/p2sub/node"
+	"github.com/p2sub/p2sub/wss"
+	"go.uber.org/zap"
+)
+
+// DefaultListen default address of admin server, it's only reachable from localhost
+const DefaultListen = "127.0.0.1:4400"
+
+// SessionSource source of WebSocket sessions e.g: *wss.WebsocketServer
+type SessionSource interface {
+	Sessions() []wss.SessionInfo
+}
+
+// ConfigSource source of effective configuration e.g: *config.Config
+type ConfigSource interface {
+	All() map[string]interface{}
+}
+
+// Status identity of the node
+type Status struct {
+	ID     peer.ID  `json:"id"`
+	Addrs  []string `json:"addrs"`
+	Peers  int      `json:"peers"`
+	Topics int      `json:"topics"`
+}
+
+// PeerInfo connected peer
+type PeerInfo struct {
+	ID    peer.ID  `json:"id"`
+	Addrs []string `json:"addrs"`
+	// Latency moving average of ping round trip time in milliseconds, it's 0
+	// until the peer was pinged
+	Latency float64 `json:"latency"`
+}
+
+// TopicInfo joined topic
+type TopicInfo struct {
+	Name      string    `json:"name"`
+	Peers     []peer.ID `json:"peers"`
+	MeshPeers []peer.ID `json:"meshPeers"`
+}
+
+// Server admin API server
+type Server struct {
+	node     *node.Node
+	sessions SessionSource
+	config   ConfigSource
+	log      *zap.SugaredLogger
+	mux      *http.ServeMux
+}
+
+// New create admin API, sessions and config could be nil if they are not
+// available, their endpoints return empty results
+func New(p2subNode *node.Node, sessions SessionSource, config ConfigSource, log *zap.SugaredLogger) *Server {
+	s := &Server{
+		node:     p2subNode,
+		sessions: sessions,
+		config:   config,
+		log:      log,
+		mux:      http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/status", s.get(s.status))
+	s.mux.HandleFunc("/peers", s.get(s.peers))
+	s.mux.HandleFunc("/topics", s.get(s.topics))
+	s.mux.HandleFunc("/sessions", s.get(s.sessionList))
+	s.mux.HandleFunc("/config", s.get(s.effectiveConfig))
+	s.mux.HandleFunc("/discovery", s.get(s.discovery))
+	return s
+}
+
+// Handle serve another endpoint on admin API e.g: metrics
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// ServeHTTP implement http.Handler
+func (s *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	s.mux.ServeHTTP(res, req)
+}
+
+// get wrap a snapshot function into a JSON GET endpoint
+func (s *Server) get(snapshot func() interface{}) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			res.Header().Set("Allow", http.MethodGet)
+			http.Error(res, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(res, snapshot(), s.log)
+	}
+}
+
+func (s *Server) status() interface{} {
+	return Status{
+		ID:     s.node.ID(),
+		Addrs:  addrStrings(s.node),
+		Peers:  len(s.node.Peers()),
+		Topics: len(s.node.Topics()),
+	}
+}
+
+func (s *Server) peers() interface{} {
+	peers := make([]PeerInfo, 0)
+	peerHost := s.node.Host()
+	if peerHost == nil {
+		return peers
+	}
+	for _, peerID := range s.node.Peers() {
+		info := PeerInfo{
+			ID:      peerID,
+			Addrs:   make([]string, 0),
+			Latency: float64(peerHost.Peerstore().LatencyEWMA(peerID)) / float64(time.Millisecond),
+		}
+		for _, conn := range peerHost.Network().ConnsToPeer(peerID) {
+			info.Addrs = append(info.Addrs, conn.RemoteMultiaddr().String())
+		}
+		peers = append(peers, info)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ID < peers[j].ID
+	})
+	return peers
+}
+
+func (s *Server) topics() interface{} {
+	topics := make([]TopicInfo, 0)
+	pubSub := s.node.PubSub()
+	for _, name := range s.node.Topics() {
+		info := TopicInfo{Name: name, Peers: []peer.ID{}, MeshPeers: s.node.MeshPeers(name)}
+		if pubSub != nil {
+			info.Peers = append(info.Peers, pubSub.ListPeers(name)...)
+		}
+		topics = append(topics, info)
+	}
+	return topics
+}
+
+func (s *Server) sessionList() interface{} {
+	if s.sessions == nil {
+		return []wss.SessionInfo{}
+	}
+	sessions := s.sessions.Sessions()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+func (s *Server) effectiveConfig() interface{} {
+	if s.config == nil {
+		return map[string]interface{}{}
+	}
+	return s.config.All()
+}
+
+func (s *Server) discovery() interface{} {
+	if manager := s.node.Discovery(); manager != nil {
+		return manager.State()
+	}
+	return node.DiscoveryState{Peers: []node.PeerState{}}
+}
+
+// addrStrings listen addresses of node as strings
+func addrStrings(p2subNode *node.Node) []string {
+	addrs := make([]string, 0)
+	for _, addr := range p2subNode.Addrs() {
+		addrs = append(addrs, addr.String())
+	}
+	return addrs
+}
+
+// writeJSON write a JSON response
+func writeJSON(res http.ResponseWriter, value interface{}, log *zap.SugaredLogger) {
+	res.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(res)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		log.Warnf("Unable to write response: %v", err)
+	}
+}
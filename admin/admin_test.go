@@ -0,0 +1,143 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/p2sub/p2sub/admin"
+	"github.com/p2sub/p2sub/harness"
+	"github.com/p2sub/p2sub/wss"
+	"go.uber.org/zap"
+)
+
+// fakeSessions fixed WebSocket sessions
+type fakeSessions []wss.SessionInfo
+
+func (f fakeSessions) Sessions() []wss.SessionInfo {
+	return append([]wss.SessionInfo{}, f...)
+}
+
+// fakeConfig fixed configuration
+type fakeConfig map[string]interface{}
+
+func (f fakeConfig) All() map[string]interface{} {
+	return f
+}
+
+// get call an endpoint and decode its JSON response
+func get(t *testing.T, server *admin.Server, path string, value interface{}) {
+	t.Helper()
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d", path, res.Code)
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), value); err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h, err := harness.New(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Connect(harness.FullMesh); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.SubscribeAll("news"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AwaitMesh(ctx, "news", 1); err != nil {
+		t.Fatal(err)
+	}
+	sessions := fakeSessions{{ID: 2}, {ID: 1}}
+	server := admin.New(h.Node(0), sessions, fakeConfig{"node::bind_port": 4433}, zap.NewNop().Sugar())
+
+	var status admin.Status
+	get(t, server, "/status", &status)
+	if status.ID != h.Node(0).ID() || status.Peers != 1 || status.Topics != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	var peers []admin.PeerInfo
+	get(t, server, "/peers", &peers)
+	if len(peers) != 1 || peers[0].ID != h.Node(1).ID() || len(peers[0].Addrs) == 0 {
+		t.Fatalf("unexpected peers %+v", peers)
+	}
+
+	var topics []admin.TopicInfo
+	get(t, server, "/topics", &topics)
+	if len(topics) != 1 || topics[0].Name != "news" || len(topics[0].Peers) != 1 || len(topics[0].MeshPeers) != 1 {
+		t.Fatalf("unexpected topics %+v", topics)
+	}
+
+	var sessionList []wss.SessionInfo
+	get(t, server, "/sessions", &sessionList)
+	if len(sessionList) != 2 || sessionList[0].ID != 1 {
+		t.Fatalf("sessions are not sorted: %+v", sessionList)
+	}
+
+	var cfg map[string]interface{}
+	get(t, server, "/config", &cfg)
+	if cfg["node::bind_port"] != float64(4433) {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	var discovery map[string]interface{}
+	get(t, server, "/discovery", &discovery)
+	if _, ok := discovery["peers"]; !ok {
+		t.Fatalf("unexpected discovery state %+v", discovery)
+	}
+}
+
+func TestAdminWithoutSources(t *testing.T) {
+	h, err := harness.New(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	server := admin.New(h.Node(0), nil, nil, zap.NewNop().Sugar())
+	var sessions []wss.SessionInfo
+	get(t, server, "/sessions", &sessions)
+	var cfg map[string]interface{}
+	get(t, server, "/config", &cfg)
+	if sessions == nil || len(sessions) != 0 || cfg == nil || len(cfg) != 0 {
+		t.Fatalf("missing sources must give empty results: %v %v", sessions, cfg)
+	}
+}
+
+func TestAdminReadOnly(t *testing.T) {
+	h, err := harness.New(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	server := admin.New(h.Node(0), nil, nil, zap.NewNop().Sugar())
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/status", nil))
+	if res.Code != http.StatusMethodNotAllowed || res.Header().Get("Allow") != http.MethodGet {
+		t.Fatalf("POST was answered with %d", res.Code)
+	}
+}
@@ -95,6 +95,28 @@ func (c *Config) GetString(key string) string {
 	return ""
 }
 
+// GetStrings get slice of string values from given key
+func (c *Config) GetStrings(key string) []string {
+	v, err := c.get(key)
+	if err == nil {
+		if rv, ok := v.([]string); ok {
+			return rv
+		}
+	}
+	return nil
+}
+
+// All get a copy of all key/value pairs
+func (c *Config) All() map[string]interface{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	all := make(map[string]interface{}, len(c.cfgStorage))
+	for key, value := range c.cfgStorage {
+		all[key] = value
+	}
+	return all
+}
+
 func (c *Config) get(key string) (interface{}, error) {
 	if v, ok := c.cfgStorage[key]; ok {
 		return v, nil
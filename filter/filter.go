@@ -0,0 +1,237 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package filter filter expressions of messages, e.g:
+//
+//	symbol == "BTC" && price > 100
+//	order.items.0.sku != "X" || !(@topic == "orders/eu")
+//
+// Names are dotted paths of fields in JSON payload, array elements are
+// addressed by index. Names starting with @ are headers of message e.g: @topic,
+// @from, @key or @seq, numeric headers are numbers. Operators are ||, &&, !, ==, !=, <, <=, > and >=, literals are
+// numbers, strings in double quotes, true, false and null. Missing fields are
+// null, ordering comparisons are only true between two numbers or two strings
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxLength maximum length of an expression
+const MaxLength = 1024
+
+// Filter compiled filter expression
+type Filter struct {
+	expr string
+	root expression
+}
+
+// Parse compile a filter expression
+func Parse(expr string) (*Filter, error) {
+	if len(expr) > MaxLength {
+		return nil, fmt.Errorf("filter is longer than %d characters", MaxLength)
+	}
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEnd {
+		return nil, fmt.Errorf("unexpected %s at %d", describe(tok), tok.pos)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// String get expression of filter
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Match evaluate filter against a payload and headers of a message, fields
+// of payloads which are not JSON objects are all missing. A nil filter
+// matches everything
+func (f *Filter) Match(payload []byte, headers map[string]interface{}) bool {
+	if f == nil {
+		return true
+	}
+	s := &scope{headers: headers}
+	if err := json.Unmarshal(payload, &s.payload); err != nil {
+		s.payload = nil
+	}
+	return truthy(f.root.eval(s))
+}
+
+// scope values an expression is evaluated with
+type scope struct {
+	payload interface{}
+	headers map[string]interface{}
+}
+
+// expression node of expression tree
+type expression interface {
+	eval(s *scope) interface{}
+}
+
+// literal constant value
+type literal struct {
+	value interface{}
+}
+
+func (l *literal) eval(s *scope) interface{} {
+	return l.value
+}
+
+// field value of a payload field
+type field struct {
+	path []string
+}
+
+func (f *field) eval(s *scope) interface{} {
+	value := s.payload
+	for _, key := range f.path {
+		switch current := value.(type) {
+		case map[string]interface{}:
+			value = current[key]
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(current) {
+				return nil
+			}
+			value = current[index]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+// header value of a message header, missing headers are null
+type header struct {
+	name string
+}
+
+func (h *header) eval(s *scope) interface{} {
+	if value, ok := s.headers[h.name]; ok {
+		return value
+	}
+	return nil
+}
+
+// not negation of an expression
+type not struct {
+	operand expression
+}
+
+func (n *not) eval(s *scope) interface{} {
+	return !truthy(n.operand.eval(s))
+}
+
+// logical && and || with short circuit
+type logical struct {
+	op          string
+	left, right expression
+}
+
+func (l *logical) eval(s *scope) interface{} {
+	left := truthy(l.left.eval(s))
+	if l.op == "&&" {
+		return left && truthy(l.right.eval(s))
+	}
+	return left || truthy(l.right.eval(s))
+}
+
+// comparison comparison of two operands
+type comparison struct {
+	op          string
+	left, right expression
+}
+
+func (c *comparison) eval(s *scope) interface{} {
+	left, right := c.left.eval(s), c.right.eval(s)
+	switch c.op {
+	case "==":
+		return equal(left, right)
+	case "!=":
+		return !equal(left, right)
+	}
+	var order int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return false
+		}
+		order = compareFloats(l, r)
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return false
+		}
+		order = strings.Compare(l, r)
+	default:
+		return false
+	}
+	switch c.op {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+// compareFloats order of two numbers
+func compareFloats(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+// equal check if two values are equal, objects and arrays are never equal
+func equal(left, right interface{}) bool {
+	switch left.(type) {
+	case nil, float64, string, bool:
+		return left == right
+	}
+	return false
+}
+
+// truthy false, null, 0 and "" are false, other values are true
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	return true
+}
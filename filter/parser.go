@@ -0,0 +1,267 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Kinds of tokens
+const (
+	tokenEnd = iota
+	tokenName
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenOpen
+	tokenClose
+)
+
+// token lexical token of an expression, pos is its offset in expression
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+// operators operators ordered so longer ones are matched first
+var operators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!"}
+
+// tokenize split an expression into tokens
+func tokenize(expr string) ([]token, error) {
+	tokens := make([]token, 0)
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenOpen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenClose, text: ")", pos: i})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(expr) && expr[end] != '"' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: expr[i : end+1], pos: i})
+			i = end + 1
+		case c == '-' || isDigit(c):
+			// Signs only start a number or its exponent, e.g: -1.5e-3
+			end := i + 1
+			for end < len(expr) {
+				next := expr[end]
+				sign := (next == '+' || next == '-') && (expr[end-1] == 'e' || expr[end-1] == 'E')
+				if !isDigit(next) && next != '.' && next != 'e' && next != 'E' && !sign {
+					break
+				}
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: expr[i:end], pos: i})
+			i = end
+		case c == '@' || isNameChar(c):
+			end := i + 1
+			for end < len(expr) && (isNameChar(expr[end]) || isDigit(expr[end]) || expr[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenName, text: expr[i:end], pos: i})
+			i = end
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(expr[i:], op) {
+					tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEnd, text: "end of filter", pos: len(expr)}), nil
+}
+
+// isDigit check if a character is a decimal digit
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isNameChar check if a character could start a name
+func isNameChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// parser recursive descent parser of tokens:
+//
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | comparison
+//	comparison = operand [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) operand ]
+//	operand    = literal | name | "(" or ")"
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// peek get current token
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// next consume current token
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEnd {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) parseOr() (expression, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().text == "||" && p.peek().kind == tokenOperator {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logical{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (expression, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().text == "&&" && p.peek().kind == tokenOperator {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &logical{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (expression, error) {
+	if p.peek().text == "!" && p.peek().kind == tokenOperator {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &not{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (expression, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	switch tok.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+		if tok.kind != tokenOperator {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &comparison{op: tok.text, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) parseOperand() (expression, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenOpen:
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenClose {
+			return nil, fmt.Errorf("expected ) at %d", closing.pos)
+		}
+		return inner, nil
+	case tokenString:
+		var value string
+		if err := json.Unmarshal([]byte(tok.text), &value); err != nil {
+			return nil, fmt.Errorf("invalid string at %d", tok.pos)
+		}
+		return &literal{value: value}, nil
+	case tokenNumber:
+		value, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", tok.text, tok.pos)
+		}
+		return &literal{value: value}, nil
+	case tokenName:
+		switch tok.text {
+		case "true":
+			return &literal{value: true}, nil
+		case "false":
+			return &literal{value: false}, nil
+		case "null":
+			return &literal{value: nil}, nil
+		}
+		if strings.HasPrefix(tok.text, "@") {
+			if len(tok.text) == 1 || strings.Contains(tok.text, ".") {
+				return nil, fmt.Errorf("invalid header %q at %d", tok.text, tok.pos)
+			}
+			return &header{name: tok.text[1:]}, nil
+		}
+		path := strings.Split(tok.text, ".")
+		for _, key := range path {
+			if key == "" {
+				return nil, fmt.Errorf("invalid name %q at %d", tok.text, tok.pos)
+			}
+		}
+		return &field{path: path}, nil
+	}
+	return nil, fmt.Errorf("unexpected %s at %d", describe(tok), tok.pos)
+}
+
+// describe describe a token in errors
+func describe(tok token) string {
+	if tok.kind == tokenEnd {
+		return tok.text
+	}
+	return strconv.Quote(tok.text)
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"testing"
+)
+
+func TestTokenizeNumbers(t *testing.T) {
+	cases := map[string][]string{
+		"-1":        {"-1"},
+		"1.5e-3":    {"1.5e-3"},
+		"-2E+10":    {"-2E+10"},
+		"a>1-2":     {"a", ">", "1", "-2"},
+		"a >= -0.5": {"a", ">=", "-0.5"},
+	}
+	for expr, expected := range cases {
+		tokens, err := tokenize(expr)
+		if err != nil {
+			t.Fatalf("tokenize %q: %v", expr, err)
+		}
+		texts := make([]string, 0, len(tokens))
+		for _, tok := range tokens[:len(tokens)-1] {
+			texts = append(texts, tok.text)
+		}
+		if len(texts) != len(expected) {
+			t.Fatalf("tokenize %q: got %q, expected %q", expr, texts, expected)
+		}
+		for i := range texts {
+			if texts[i] != expected[i] {
+				t.Fatalf("tokenize %q: got %q, expected %q", expr, texts, expected)
+			}
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"a >",
+		"a>1-2",
+		"a>1+2",
+		"(a == 1",
+		"a == 1)",
+		`a == "open`,
+		"a.. == 1",
+		"@ == 1",
+		"@a.b == 1",
+		"a == 1 &&",
+		"a # 1",
+		"-",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Fatalf("invalid filter %q was parsed", expr)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	payload := []byte(`{"symbol": "BTC", "price": 120.5, "qty": -3, "open": true, "order": {"items": [{"sku": "X"}, {"sku": "Y"}]}}`)
+	headers := map[string]interface{}{"topic": "orders/eu", "from": "peer", "seq": float64(7)}
+	cases := map[string]bool{
+		`symbol == "BTC" && price > 100`:   true,
+		`symbol == "BTC" && price > 200`:   false,
+		`price >= 120.5 && price <= 1.2e2`: false,
+		`qty < -2`:                         true,
+		`qty > -2.5E+0`:                    false,
+		`order.items.1.sku == "Y"`:         true,
+		`order.items.2.sku == null`:        true,
+		`missing == null`:                  true,
+		`missing > 1`:                      false,
+		`symbol > 1`:                       false,
+		`open && !(price < 100)`:           true,
+		`!open || symbol != "BTC"`:         false,
+		`@topic == "orders/eu"`:            true,
+		`@seq > 5 && @seq < 8`:             true,
+		`@key == null`:                     true,
+		`@seq == "7"`:                      false,
+	}
+	for expr, expected := range cases {
+		f, err := Parse(expr)
+		if err != nil {
+			t.Fatalf("parse %q: %v", expr, err)
+		}
+		if f.Match(payload, headers) != expected {
+			t.Fatalf("filter %q: expected %v", expr, expected)
+		}
+	}
+}
+
+func TestMatchNonJSON(t *testing.T) {
+	f, err := Parse(`a == null && @topic == "t"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Match([]byte("not json"), map[string]interface{}{"topic": "t"}) {
+		t.Fatal("fields of a payload which is not JSON must be missing")
+	}
+	var none *Filter
+	if !none.Match(nil, nil) {
+		t.Fatal("nil filter must match everything")
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/p2sub/p2sub/node"
+)
+
+// Defaults of acknowledged delivery
+const (
+	// DefaultAckWindow number of messages a client could leave unacknowledged
+	DefaultAckWindow = 64
+	// DefaultAckTimeout messages which were not acknowledged in time are redelivered
+	DefaultAckTimeout = 10 * time.Second
+)
+
+// ErrAckDisabled client acknowledged a message without asking for acknowledged delivery
+var ErrAckDisabled = errors.New("acknowledged delivery is not enabled")
+
+// delivery message sent to client and waiting for acknowledgement
+type delivery struct {
+	frame  Frame
+	sentAt time.Time
+}
+
+// SetDelivery set ack window, ack timeout and session grace of acknowledged
+// delivery, zero values keep defaults. It must be set before Run
+func (g *Gateway) SetDelivery(window int, timeout time.Duration, grace time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if window > 0 {
+		g.ackWindow = window
+	}
+	if timeout > 0 {
+		g.ackTimeout = timeout
+	}
+	if grace > 0 {
+		g.sessionGrace = grace
+	}
+}
+
+// setAck enable or disable acknowledged delivery of a channel, it returns
+// session token. Unacknowledged messages are given up when it's disabled
+func (g *Gateway) setAck(channelID uint64, ack bool) (string, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	s, err := g.sessionOf(channelID)
+	if err != nil {
+		return "", err
+	}
+	if s.ack && !ack {
+		s.inflight = make(map[uint64]*delivery)
+	}
+	s.ack = ack
+	g.fill(s)
+	return s.token, nil
+}
+
+// flush replay messages of a resumed channel, unacknowledged messages are
+// redelivered in order before buffered ones
+func (g *Gateway) flush(channelID uint64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	s, ok := g.sessions[channelID]
+	if !ok {
+		return
+	}
+	ids := make([]uint64, 0, len(s.inflight))
+	for id := range s.inflight {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	now := time.Now()
+	for _, id := range ids {
+		if g.expired(s.inflight[id].frame, now) {
+			delete(s.inflight, id)
+			continue
+		}
+		g.transmit(s, s.inflight[id], now)
+	}
+	g.fill(s)
+}
+
+// acknowledge remove an acknowledged message from in-flight messages of a
+// channel, next messages of backlog are sent
+func (g *Gateway) acknowledge(channelID uint64, id uint64) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	s, ok := g.sessions[channelID]
+	if !ok || !s.ack {
+		return ErrAckDisabled
+	}
+	if _, ok := s.inflight[id]; !ok {
+		return fmt.Errorf("unknown delivery %d", id)
+	}
+	delete(s.inflight, id)
+	g.fill(s)
+	return nil
+}
+
+// dispatch send a message frame to client of a session, it's buffered while
+// client is away or over its ack window
+func (g *Gateway) dispatch(s *session, frame Frame) error {
+	g.mutex.Lock()
+	if s.channelID != 0 && !s.ack && len(s.backlog) == 0 {
+		channelID := s.channelID
+		g.mutex.Unlock()
+		return g.send(channelID, frame)
+	}
+	defer g.mutex.Unlock()
+	if s.closed {
+		return ErrUnknownSession
+	}
+	if len(s.backlog) >= g.sessionBuffer {
+		return ErrBufferFull
+	}
+	if s.ack {
+		s.next++
+		frame.Delivery = s.next
+	}
+	s.backlog = append(s.backlog, frame)
+	g.fill(s)
+	return nil
+}
+
+// dispatchChannel send a message frame to a channel through its session
+func (g *Gateway) dispatchChannel(channelID uint64, frame Frame) error {
+	g.mutex.Lock()
+	s, ok := g.sessions[channelID]
+	g.mutex.Unlock()
+	if !ok {
+		return g.send(channelID, frame)
+	}
+	return g.dispatch(s, frame)
+}
+
+// fill send messages of backlog while client is connected and its ack
+// window has room, expired messages are dropped. g.mutex must be held
+func (g *Gateway) fill(s *session) {
+	now := time.Now()
+	for s.channelID != 0 && len(s.backlog) > 0 {
+		if s.ack && len(s.inflight) >= g.ackWindow {
+			return
+		}
+		d := &delivery{frame: s.backlog[0]}
+		s.backlog = s.backlog[1:]
+		if g.expired(d.frame, now) {
+			continue
+		}
+		if s.ack {
+			s.inflight[d.frame.Delivery] = d
+		}
+		g.transmit(s, d, now)
+	}
+}
+
+// transmit send a message to client, an acknowledged message which could
+// not be queued is redelivered after ack timeout like a lost one
+func (g *Gateway) transmit(s *session, d *delivery, now time.Time) {
+	d.sentAt = now
+	if err := g.send(s.channelID, d.frame); err != nil {
+		g.log.Debugf("Unable to deliver message to channel %d: %v", s.channelID, err)
+	}
+}
+
+// redeliver resend messages of a session which were not acknowledged in
+// time, expired messages are given up. g.mutex must be held
+func (g *Gateway) redeliver(s *session, now time.Time) {
+	expired := false
+	for id, d := range s.inflight {
+		if g.expired(d.frame, now) {
+			delete(s.inflight, id)
+			expired = true
+		} else if now.Sub(d.sentAt) >= g.ackTimeout {
+			g.transmit(s, d, now)
+		}
+	}
+	if expired {
+		g.fill(s)
+	}
+}
+
+// expired check if a message frame expired
+func (g *Gateway) expired(frame Frame, now time.Time) bool {
+	header := node.Header{Expires: frame.Expires}
+	return header.Expired(now, g.skew)
+}
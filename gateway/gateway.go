@@ -0,0 +1,582 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gateway bridge clients and topics of a p2sub node, WebSocket clients
+// of wss talk to the gateway with JSON frames, other clients use REST endpoints
+package gateway
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/p2sub/p2sub/filter"
+	"github.com/p2sub/p2sub/node"
+	"github.com/p2sub/p2sub/wss"
+	"go.uber.org/zap"
+)
+
+// Operations of frames
+const (
+	// Client to gateway
+	OpSubscribe   = "subscribe"
+	OpUnsubscribe = "unsubscribe"
+	OpPublish     = "publish"
+	OpRequest     = "request"
+	OpSend        = "send"
+	OpIdentify    = "identify"
+	OpAck         = "ack"
+	OpResume      = "resume"
+	// Both ways, gateway issues session token on connect and replies it to
+	// clients which set acknowledged delivery
+	OpSession = "session"
+	// Gateway to client
+	OpMessage  = "message"
+	OpReply    = "reply"
+	OpDirect   = "direct"
+	OpIdentity = "identity"
+	OpOK       = "ok"
+	OpError    = "error"
+)
+
+// Frame JSON frame exchanged with clients, Ref is echoed in reply so clients
+// could match replies with their requests
+type Frame struct {
+	Op    string          `json:"op"`
+	Ref   string          `json:"ref,omitempty"`
+	Topic string          `json:"topic,omitempty"`
+	From  string          `json:"from,omitempty"`
+	To    string          `json:"to,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+	// Encoding encoding of data, "base64" for binary payloads which are
+	// neither JSON nor UTF-8 text
+	Encoding string `json:"encoding,omitempty"`
+	// Filter expression of subscribe, only matching messages are forwarded
+	Filter string `json:"filter,omitempty"`
+	// Delivery ID of a message which must be acknowledged
+	Delivery uint64 `json:"delivery,omitempty"`
+	// Ack acknowledged delivery is asked by session frame
+	Ack   bool   `json:"ack,omitempty"`
+	Token string `json:"token,omitempty"`
+	// Key application key of a published message, retries with the same
+	// key are delivered once on topics with key dedup
+	Key string `json:"key,omitempty"`
+	// TTL time to live of a published message e.g: "30s"
+	TTL string `json:"ttl,omitempty"`
+	// Expires expiry of a message in unix milliseconds, expired messages
+	// are dropped from session buffers
+	Expires int64 `json:"expires,omitempty"`
+	// Missed number of messages of the same publisher skipped before this
+	// one on an ordered topic
+	Missed uint64 `json:"missed,omitempty"`
+}
+
+// EncodingBase64 encoding of binary payloads in frames
+const EncodingBase64 = "base64"
+
+// DefaultRequestLimit number of requests and direct sends a client could
+// have in flight, next ones are rejected until one of them completed
+const DefaultRequestLimit = 16
+
+// Errors of requests and direct messages
+var (
+	// ErrTooManyRequests client has too many requests or direct sends in flight
+	ErrTooManyRequests = errors.New("too many requests in flight")
+)
+
+// subscription subscription of a topic or of a topic pattern
+type subscription interface {
+	Next(ctx context.Context) (*node.Message, error)
+	Cancel()
+}
+
+// Gateway bridge between a websocket server and a node
+type Gateway struct {
+	node   *node.Node
+	server *wss.WebsocketServer
+	log    *zap.SugaredLogger
+	// sessions sessions of connected channels, tokens all sessions by token
+	// including sessions of disconnected clients
+	sessions        map[uint64]*session
+	tokens          map[string]*session
+	ackWindow       int
+	ackTimeout      time.Duration
+	sessionGrace    time.Duration
+	sessionBuffer   int
+	sessionLifetime time.Duration
+	// pending requests and direct sends in flight of each channel
+	pending      map[uint64]int
+	requestLimit int
+	// skew tolerated clock difference of publishers of expiring messages
+	skew  time.Duration
+	mutex sync.Mutex
+}
+
+// New create a gateway, it does nothing until Run was called
+func New(p2subNode *node.Node, server *wss.WebsocketServer, log *zap.SugaredLogger) *Gateway {
+	return &Gateway{
+		node:            p2subNode,
+		server:          server,
+		log:             log,
+		sessions:        make(map[uint64]*session),
+		tokens:          make(map[string]*session),
+		ackWindow:       DefaultAckWindow,
+		ackTimeout:      DefaultAckTimeout,
+		sessionGrace:    DefaultSessionGrace,
+		sessionBuffer:   DefaultSessionBuffer,
+		sessionLifetime: DefaultSessionLifetime,
+		pending:         make(map[uint64]int),
+		requestLimit:    DefaultRequestLimit,
+		skew:            p2subNode.Config().ClockSkew,
+	}
+}
+
+// Run handle frames of clients until ctx is done, all subscriptions of
+// clients are canceled before it returns
+func (g *Gateway) Run(ctx context.Context) {
+	g.node.HandleRecipients(g.deliver)
+	defer g.node.HandleRecipients(nil)
+	defer g.closeAll()
+	g.mutex.Lock()
+	interval := g.ackTimeout / 2
+	g.mutex.Unlock()
+	if interval > time.Second {
+		interval = time.Second
+	}
+	sweeper := time.NewTicker(interval)
+	defer sweeper.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-sweeper.C:
+			g.sweep(now)
+		case channelID := <-g.server.Connected():
+			g.connect(channelID)
+		case channelID := <-g.server.Disconnected():
+			g.detach(channelID)
+		case received := <-g.server.Receiving():
+			g.handle(ctx, received)
+		}
+	}
+}
+
+// handle execute a frame of client, frames over rate limit of client are
+// rejected without being executed
+func (g *Gateway) handle(ctx context.Context, received wss.ChannelIO) {
+	channelID := received.ID
+	var frame Frame
+	if err := json.Unmarshal(received.Data, &frame); err != nil {
+		g.reply(channelID, Frame{Op: OpError, Error: fmt.Sprintf("invalid frame: %v", err)})
+		return
+	}
+	var err error
+	switch {
+	case received.Throttled:
+		err = &node.RateLimitError{Scope: node.ScopeChannel, Key: strconv.FormatUint(channelID, 10)}
+	case frame.Op == OpRequest || frame.Op == OpSend:
+		if !g.acquireRequest(channelID) {
+			g.reply(channelID, Frame{Op: OpError, Ref: frame.Ref, Topic: frame.Topic, To: frame.To, Error: ErrTooManyRequests.Error()})
+			return
+		}
+		// Waiting for reply must not block frames of other clients
+		go func() {
+			defer g.releaseRequest(channelID)
+			if frame.Op == OpRequest {
+				g.request(ctx, channelID, frame)
+				return
+			}
+			if err := g.sendDirect(ctx, channelID, frame); err != nil {
+				g.reply(channelID, Frame{Op: OpError, Ref: frame.Ref, To: frame.To, Error: err.Error()})
+				return
+			}
+			g.reply(channelID, Frame{Op: OpOK, Ref: frame.Ref, To: frame.To})
+		}()
+		return
+	case frame.Op == OpIdentify:
+		g.reply(channelID, Frame{Op: OpIdentity, Ref: frame.Ref, From: g.address(channelID)})
+		return
+	case frame.Op == OpSession || frame.Op == OpResume:
+		token, err := g.session(channelID, frame)
+		if err != nil {
+			g.reply(channelID, Frame{Op: OpError, Ref: frame.Ref, Error: err.Error()})
+			return
+		}
+		g.reply(channelID, Frame{Op: OpSession, Ref: frame.Ref, Token: token})
+		if frame.Op == OpResume {
+			g.flush(channelID)
+		}
+		return
+	case frame.Op == OpAck:
+		// Acknowledgements are not replied unless they are invalid
+		if err := g.acknowledge(channelID, frame.Delivery); err != nil {
+			g.reply(channelID, Frame{Op: OpError, Ref: frame.Ref, Delivery: frame.Delivery, Error: err.Error()})
+		}
+		return
+	default:
+		err = g.execute(ctx, channelID, frame)
+	}
+	if err != nil {
+		g.reply(channelID, Frame{Op: OpError, Ref: frame.Ref, Topic: frame.Topic, Error: err.Error()})
+		return
+	}
+	g.reply(channelID, Frame{Op: OpOK, Ref: frame.Ref, Topic: frame.Topic})
+}
+
+// session set acknowledged delivery of a channel or resume a session of a
+// previous connection, it returns session token
+func (g *Gateway) session(channelID uint64, frame Frame) (string, error) {
+	if frame.Op == OpResume {
+		if err := g.resume(channelID, frame.Token); err != nil {
+			return "", err
+		}
+		return frame.Token, nil
+	}
+	return g.setAck(channelID, frame.Ack)
+}
+
+// execute execute operation of a frame
+func (g *Gateway) execute(ctx context.Context, channelID uint64, frame Frame) error {
+	var err error
+	switch frame.Op {
+	case OpSubscribe:
+		err = g.subscribe(ctx, channelID, frame.Topic, frame.Filter)
+	case OpUnsubscribe:
+		err = g.unsubscribe(channelID, frame.Topic)
+	case OpPublish:
+		err = g.publish(ctx, frame)
+	default:
+		err = fmt.Errorf("unknown operation %q", frame.Op)
+	}
+	return err
+}
+
+// subscribe subscribe a channel to a topic or to topics matching a pattern
+// and forward their messages which match filter expression
+func (g *Gateway) subscribe(ctx context.Context, channelID uint64, topic string, expr string) error {
+	if topic == "" {
+		return fmt.Errorf("topic is required")
+	}
+	messageFilter, err := parseFilter(expr)
+	if err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	s, err := g.sessionOf(channelID)
+	subscribed := err == nil && s.subs[topic] != nil
+	g.mutex.Unlock()
+	if err != nil || subscribed {
+		return err
+	}
+	// Joining topics goes through gossipsub event loop, other clients must
+	// not wait for it
+	sub, err := subscribe(g.node, topic)
+	if err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	// Session could have been closed or subscribed to topic meanwhile
+	if s.closed || s.subs[topic] != nil {
+		closed := s.closed
+		g.mutex.Unlock()
+		sub.Cancel()
+		if closed {
+			return ErrUnknownSession
+		}
+		return nil
+	}
+	s.subs[topic] = sub
+	g.mutex.Unlock()
+	go g.forward(ctx, s, sub, messageFilter)
+	return nil
+}
+
+// subscribe subscribe to a topic, or to topics matching it if it's a pattern
+func subscribe(p2subNode *node.Node, topic string) (subscription, error) {
+	if node.IsPattern(topic) {
+		return p2subNode.SubscribePattern(topic)
+	}
+	return p2subNode.Subscribe(topic)
+}
+
+// parseFilter parse filter expression of a subscription, empty expression
+// means no filter
+func parseFilter(expr string) (*filter.Filter, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	messageFilter, err := filter.Parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter: %v", err)
+	}
+	return messageFilter, nil
+}
+
+// forward send messages of a subscription matching filter to client of a
+// session until it was canceled, other messages are dropped before they are
+// queued
+func (g *Gateway) forward(ctx context.Context, s *session, sub subscription, messageFilter *filter.Filter) {
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		if !messageFilter.Match(msg.Data, msg.Headers()) {
+			continue
+		}
+		if err := g.dispatch(s, messageFrame(msg)); err != nil {
+			g.log.Debugf("Drop message of session %s: %v", s.token, err)
+		}
+	}
+}
+
+// messageFrame frame of a delivered message
+func messageFrame(msg *node.Message) Frame {
+	data, encoding := encodeData(msg.Data)
+	return Frame{
+		Op:       OpMessage,
+		Topic:    msg.Topic,
+		From:     msg.From.Pretty(),
+		Data:     data,
+		Encoding: encoding,
+		Missed:   msg.Missed,
+		Expires:  msg.Header.Expires,
+	}
+}
+
+// unsubscribe cancel subscription of a channel
+func (g *Gateway) unsubscribe(channelID uint64, topic string) error {
+	g.mutex.Lock()
+	var sub subscription
+	var ok bool
+	if s, attached := g.sessions[channelID]; attached {
+		sub, ok = s.subs[topic]
+		delete(s.subs, topic)
+	}
+	g.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("not subscribed to topic %s", topic)
+	}
+	sub.Cancel()
+	return nil
+}
+
+// publish publish data of a frame to a topic
+func (g *Gateway) publish(ctx context.Context, frame Frame) error {
+	if frame.Topic == "" {
+		return fmt.Errorf("topic is required")
+	}
+	payload, err := decodeData(frame.Data, frame.Encoding)
+	if err != nil {
+		return err
+	}
+	opts := []node.PublishOption{node.WithKey(frame.Key)}
+	if frame.TTL != "" {
+		ttl, err := time.ParseDuration(frame.TTL)
+		if err != nil {
+			return fmt.Errorf("invalid ttl: %v", err)
+		}
+		opts = append(opts, node.WithTTL(ttl))
+	}
+	return g.node.Publish(ctx, frame.Topic, payload, opts...)
+}
+
+// request send a request to responders of a topic, the first reply is sent
+// to channel as a reply frame
+func (g *Gateway) request(ctx context.Context, channelID uint64, frame Frame) {
+	reply, err := g.sendRequest(ctx, frame)
+	if err != nil {
+		g.reply(channelID, Frame{Op: OpError, Ref: frame.Ref, Topic: frame.Topic, Error: err.Error()})
+		return
+	}
+	data, encoding := encodeData(reply.Data)
+	g.reply(channelID, Frame{
+		Op:       OpReply,
+		Ref:      frame.Ref,
+		Topic:    frame.Topic,
+		From:     reply.From.Pretty(),
+		Data:     data,
+		Encoding: encoding,
+	})
+}
+
+// SetRequestLimit set number of requests and direct sends a client could
+// have in flight, zero keeps default. It must be set before Run
+func (g *Gateway) SetRequestLimit(limit int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if limit > 0 {
+		g.requestLimit = limit
+	}
+}
+
+// acquireRequest count a request of a channel in flight, it returns false
+// if channel is at request limit
+func (g *Gateway) acquireRequest(channelID uint64) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.pending[channelID] >= g.requestLimit {
+		return false
+	}
+	g.pending[channelID]++
+	return true
+}
+
+// releaseRequest count a completed request of a channel
+func (g *Gateway) releaseRequest(channelID uint64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.pending[channelID]--; g.pending[channelID] <= 0 {
+		delete(g.pending, channelID)
+	}
+}
+
+// sendRequest send data of a frame as a request
+func (g *Gateway) sendRequest(ctx context.Context, frame Frame) (*node.Reply, error) {
+	if frame.Topic == "" {
+		return nil, fmt.Errorf("topic is required")
+	}
+	payload, err := decodeData(frame.Data, frame.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	return g.node.Request(ctx, frame.Topic, payload)
+}
+
+// sendDirect send data of a frame directly to a peer or to a client of a
+// peer, the address is "<peer ID>" or "<peer ID>/<client ID>". Envelopes
+// addressed to a peer only are handled by direct handler of its node
+func (g *Gateway) sendDirect(ctx context.Context, channelID uint64, frame Frame) error {
+	to, recipient, err := parseAddress(frame.To)
+	if err != nil {
+		return err
+	}
+	payload, err := decodeData(frame.Data, frame.Encoding)
+	if err != nil {
+		return err
+	}
+	env := &node.Envelope{Sender: strconv.FormatUint(channelID, 10), To: recipient, Data: payload}
+	return g.node.Send(ctx, to, env)
+}
+
+// deliver deliver a direct envelope to its recipient client, envelopes
+// addressed to the node itself never reach clients
+func (g *Gateway) deliver(ctx context.Context, env *node.Envelope) error {
+	data, encoding := encodeData(env.Data)
+	frame := Frame{Op: OpDirect, From: address(env.From, env.Sender), Data: data, Encoding: encoding}
+	channelID, err := strconv.ParseUint(env.To, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid client %q", env.To)
+	}
+	if err := g.dispatchChannel(channelID, frame); err != nil {
+		return fmt.Errorf("client %s: %v", env.To, err)
+	}
+	return nil
+}
+
+// address address of a channel of this gateway
+func (g *Gateway) address(channelID uint64) string {
+	return address(g.node.ID(), strconv.FormatUint(channelID, 10))
+}
+
+// address address of a peer or of a client of a peer
+func address(peerID peer.ID, client string) string {
+	if client == "" {
+		return peerID.Pretty()
+	}
+	return peerID.Pretty() + "/" + client
+}
+
+// parseAddress parse address of a peer or of a client of a peer
+func parseAddress(addr string) (peer.ID, string, error) {
+	parts := strings.SplitN(addr, "/", 2)
+	peerID, err := peer.Decode(parts[0])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+	if len(parts) == 2 {
+		return peerID, parts[1], nil
+	}
+	return peerID, "", nil
+}
+
+// reply send a frame to a channel, frames are dropped if client is too slow
+func (g *Gateway) reply(channelID uint64, frame Frame) {
+	if err := g.send(channelID, frame); err != nil {
+		g.log.Debugf("Drop frame of channel %d: %v", channelID, err)
+	}
+}
+
+// send encode a frame and queue it to a channel
+func (g *Gateway) send(channelID uint64, frame Frame) error {
+	raw, err := json.Marshal(frame)
+	if err != nil {
+		g.log.Warnf("Unable to encode frame: %v", err)
+		return err
+	}
+	return g.server.Send(channelID, raw)
+}
+
+// encodeData JSON payloads are embedded as they are, UTF-8 text is sent as
+// string and other payloads as base64 string, it returns encoding of data
+func encodeData(data []byte) (json.RawMessage, string) {
+	if json.Valid(data) {
+		return data, ""
+	}
+	if !utf8.Valid(data) {
+		encoded, _ := json.Marshal(base64.StdEncoding.EncodeToString(data))
+		return encoded, EncodingBase64
+	}
+	encoded, _ := json.Marshal(string(data))
+	return encoded, ""
+}
+
+// decodeData JSON strings are published as plain text, or as binary when
+// encoding is base64, other JSON values are published as they are
+func decodeData(data json.RawMessage, encoding string) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("data is required")
+	}
+	var text string
+	switch encoding {
+	case "":
+	case EncodingBase64:
+		if err := json.Unmarshal(data, &text); err != nil {
+			return nil, fmt.Errorf("base64 data must be a string")
+		}
+		payload, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 data: %v", err)
+		}
+		return payload, nil
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+	if data[0] == '"' {
+		if err := json.Unmarshal(data, &text); err != nil {
+			return nil, err
+		}
+		return []byte(text), nil
+	}
+	return data, nil
+}
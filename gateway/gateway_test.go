@@ -0,0 +1,365 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/p2sub/p2sub/gateway"
+	"github.com/p2sub/p2sub/harness"
+	"github.com/p2sub/p2sub/node"
+	"github.com/p2sub/p2sub/ratelimit"
+	"github.com/p2sub/p2sub/wss"
+	"go.uber.org/zap"
+)
+
+// startGateway serve a gateway of a node on a test HTTP server, it returns
+// URL of its WebSocket endpoint
+func startGateway(t *testing.T, p2subNode *node.Node, setup ...func(*gateway.Gateway, *wss.WebsocketServer)) string {
+	t.Helper()
+	server := wss.New()
+	g := gateway.New(p2subNode, server, zap.NewNop().Sugar())
+	for _, apply := range setup {
+		apply(g, server)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go g.Run(ctx)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", server.UpgradeConnection)
+	httpServer := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		httpServer.Close()
+		shutdown, stop := context.WithTimeout(context.Background(), time.Second)
+		defer stop()
+		server.Shutdown(shutdown)
+		cancel()
+	})
+	return "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/ws"
+}
+
+// client WebSocket client of a gateway
+type client struct {
+	t     *testing.T
+	conn  *websocket.Conn
+	token string
+}
+
+// dial connect a client, it returns once the client received its session
+func dial(t *testing.T, url string) *client {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{t: t, conn: conn}
+	t.Cleanup(func() { conn.Close() })
+	c.token = c.await(func(f gateway.Frame) bool { return f.Op == gateway.OpSession }).Token
+	return c
+}
+
+// send send a frame to gateway
+func (c *client) send(frame gateway.Frame) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(frame); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// call send a frame and wait for its ok or error reply
+func (c *client) call(frame gateway.Frame) gateway.Frame {
+	c.t.Helper()
+	c.send(frame)
+	return c.await(func(f gateway.Frame) bool {
+		return f.Ref == frame.Ref && (f.Op == gateway.OpOK || f.Op == gateway.OpError)
+	})
+}
+
+// mustCall send a frame which must succeed
+func (c *client) mustCall(frame gateway.Frame) {
+	c.t.Helper()
+	if reply := c.call(frame); reply.Op != gateway.OpOK {
+		c.t.Fatalf("%s failed: %s", frame.Op, reply.Error)
+	}
+}
+
+// await read frames until one matches, other frames are skipped
+func (c *client) await(match func(gateway.Frame) bool) gateway.Frame {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var frame gateway.Frame
+		if err := c.conn.ReadJSON(&frame); err != nil {
+			c.t.Fatal(err)
+		}
+		if match(frame) {
+			return frame
+		}
+	}
+}
+
+// awaitMessage wait for a message frame of a topic
+func (c *client) awaitMessage(topic string) gateway.Frame {
+	c.t.Helper()
+	return c.await(func(f gateway.Frame) bool {
+		return f.Op == gateway.OpMessage && f.Topic == topic
+	})
+}
+
+// startNodes start linked nodes with a gateway each
+func startNodes(t *testing.T, size int, opts ...node.Option) (*harness.Harness, []string) {
+	t.Helper()
+	h, err := harness.New(context.Background(), size, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	if err := h.Connect(harness.FullMesh); err != nil {
+		t.Fatal(err)
+	}
+	urls := make([]string, 0, size)
+	for _, p2subNode := range h.Nodes() {
+		urls = append(urls, startGateway(t, p2subNode))
+	}
+	return h, urls
+}
+
+// awaitMesh wait until every node has a mesh peer on topic
+func awaitMesh(t *testing.T, h *harness.Harness, topic string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := h.AwaitMesh(ctx, topic, h.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	h, urls := startNodes(t, 2)
+	publisher, subscriber := dial(t, urls[0]), dial(t, urls[1])
+	publisher.mustCall(gateway.Frame{Op: gateway.OpSubscribe, Ref: "1", Topic: "news"})
+	subscriber.mustCall(gateway.Frame{Op: gateway.OpSubscribe, Ref: "1", Topic: "news"})
+	awaitMesh(t, h, "news")
+
+	publisher.mustCall(gateway.Frame{Op: gateway.OpPublish, Ref: "2", Topic: "news", Data: json.RawMessage(`{"a":1}`)})
+	for _, c := range []*client{subscriber, publisher} {
+		msg := c.awaitMessage("news")
+		if string(msg.Data) != `{"a":1}` || msg.From != h.Node(0).ID().Pretty() {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+	}
+
+	// Plain text is published as a JSON string
+	publisher.mustCall(gateway.Frame{Op: gateway.OpPublish, Ref: "3", Topic: "news", Data: json.RawMessage(`"hello"`)})
+	if msg := subscriber.awaitMessage("news"); string(msg.Data) != `"hello"` {
+		t.Fatalf("unexpected message data %s", msg.Data)
+	}
+
+	// Binary payloads are exchanged as base64
+	binary := json.RawMessage(`"/wCA"`)
+	publisher.mustCall(gateway.Frame{Op: gateway.OpPublish, Ref: "4", Topic: "news", Data: binary, Encoding: gateway.EncodingBase64})
+	if msg := subscriber.awaitMessage("news"); string(msg.Data) != string(binary) || msg.Encoding != gateway.EncodingBase64 {
+		t.Fatalf("unexpected binary message %s of encoding %q", msg.Data, msg.Encoding)
+	}
+
+	// Unsubscribed clients don't receive messages anymore
+	subscriber.mustCall(gateway.Frame{Op: gateway.OpUnsubscribe, Ref: "5", Topic: "news"})
+	if reply := subscriber.call(gateway.Frame{Op: gateway.OpUnsubscribe, Ref: "6", Topic: "news"}); reply.Op != gateway.OpError {
+		t.Fatal("unsubscribed twice")
+	}
+}
+
+func TestDuplicateSubscribe(t *testing.T) {
+	_, urls := startNodes(t, 1)
+	c := dial(t, urls[0])
+	// A topic subscribed several times is forwarded once
+	for i := 0; i < 5; i++ {
+		c.send(gateway.Frame{Op: gateway.OpSubscribe, Ref: strconv.Itoa(i), Topic: "news"})
+	}
+	for oks := 0; oks < 5; {
+		if reply := c.await(func(f gateway.Frame) bool { return f.Op == gateway.OpOK || f.Op == gateway.OpError }); reply.Op != gateway.OpOK {
+			t.Fatalf("subscribe failed: %s", reply.Error)
+		}
+		oks++
+	}
+	c.mustCall(gateway.Frame{Op: gateway.OpPublish, Ref: "5", Topic: "news", Data: json.RawMessage(`1`)})
+	c.awaitMessage("news")
+	c.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	var frame gateway.Frame
+	if err := c.conn.ReadJSON(&frame); err == nil {
+		t.Fatalf("message was delivered more than once: %+v", frame)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	h, err := harness.New(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Connect(harness.FullMesh); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	if _, err := h.Node(1).Respond("prices", func(ctx context.Context, req *node.Request) ([]byte, error) {
+		if string(req.Data) == "slow" {
+			<-release
+		}
+		if string(req.Data) == "xyz" {
+			return nil, errors.New("unknown symbol")
+		}
+		return bytes.ToUpper(req.Data), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.Node(0).PubSub().ListPeers(node.RequestTopicPrefix+"prices")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("responder was not seen by requesting node")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	url := startGateway(t, h.Node(0), func(g *gateway.Gateway, _ *wss.WebsocketServer) {
+		g.SetRequestLimit(1)
+	})
+	c := dial(t, url)
+
+	// Plain text request gets plain text reply of the responder
+	c.send(gateway.Frame{Op: gateway.OpRequest, Ref: "1", Topic: "prices", Data: json.RawMessage(`"btc"`)})
+	reply := c.await(func(f gateway.Frame) bool { return f.Ref == "1" })
+	if reply.Op != gateway.OpReply || string(reply.Data) != `"BTC"` || reply.From != h.Node(1).ID().Pretty() {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	if reply := c.call(gateway.Frame{Op: gateway.OpRequest, Ref: "2", Topic: "prices", Data: json.RawMessage(`"xyz"`)}); reply.Op != gateway.OpError || !strings.Contains(reply.Error, "unknown symbol") {
+		t.Fatalf("failed request was replied with %+v", reply)
+	}
+
+	// Requests over limit of the client are rejected while one is in flight
+	c.send(gateway.Frame{Op: gateway.OpRequest, Ref: "3", Topic: "prices", Data: json.RawMessage(`"slow"`)})
+	if reply := c.call(gateway.Frame{Op: gateway.OpRequest, Ref: "4", Topic: "prices", Data: json.RawMessage(`"eth"`)}); reply.Op != gateway.OpError || reply.Error != gateway.ErrTooManyRequests.Error() {
+		t.Fatalf("request over limit was replied with %+v", reply)
+	}
+}
+
+// identify get address of a client
+func (c *client) identify() string {
+	c.t.Helper()
+	c.send(gateway.Frame{Op: gateway.OpIdentify, Ref: "identify"})
+	return c.await(func(f gateway.Frame) bool { return f.Op == gateway.OpIdentity }).From
+}
+
+func TestSendDirect(t *testing.T) {
+	h, urls := startNodes(t, 2)
+	sender, remote, local := dial(t, urls[0]), dial(t, urls[1]), dial(t, urls[0])
+	senderAddr := sender.identify()
+
+	// Clients of remote and of the same node are addressed alike
+	for i, recipient := range []*client{remote, local} {
+		ref := strconv.Itoa(i)
+		sender.mustCall(gateway.Frame{Op: gateway.OpSend, Ref: ref, To: recipient.identify(), Data: json.RawMessage(`"psst"`)})
+		msg := recipient.await(func(f gateway.Frame) bool { return f.Op == gateway.OpDirect })
+		if msg.From != senderAddr || string(msg.Data) != `"psst"` {
+			t.Fatalf("unexpected direct message %+v", msg)
+		}
+	}
+
+	// Envelopes addressed to a peer only are handled by the node, not by its clients
+	received := make(chan *node.Envelope, 1)
+	h.Node(1).HandleDirect(func(ctx context.Context, env *node.Envelope) error {
+		received <- env
+		return nil
+	})
+	sender.mustCall(gateway.Frame{Op: gateway.OpSend, Ref: "2", To: h.Node(1).ID().Pretty(), Data: json.RawMessage(`{"a":1}`)})
+	select {
+	case env := <-received:
+		if env.From != h.Node(0).ID() || h.Node(0).ID().Pretty()+"/"+env.Sender != senderAddr || string(env.Data) != `{"a":1}` {
+			t.Fatalf("unexpected envelope %+v", env)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("envelope was not handled by the node")
+	}
+
+	if reply := sender.call(gateway.Frame{Op: gateway.OpSend, Ref: "3", To: h.Node(1).ID().Pretty() + "/999", Data: json.RawMessage(`1`)}); reply.Op != gateway.OpError {
+		t.Fatalf("envelope to unknown client was replied with %+v", reply)
+	}
+	if reply := sender.call(gateway.Frame{Op: gateway.OpSend, Ref: "4", To: "nobody", Data: json.RawMessage(`1`)}); reply.Op != gateway.OpError {
+		t.Fatalf("envelope to invalid address was replied with %+v", reply)
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	h, urls := startNodes(t, 1)
+	c := dial(t, urls[0])
+	c.send(gateway.Frame{Op: gateway.OpIdentify, Ref: "1"})
+	identity := c.await(func(f gateway.Frame) bool { return f.Op == gateway.OpIdentity })
+	if !strings.HasPrefix(identity.From, h.Node(0).ID().Pretty()+"/") || identity.Ref != "1" {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	h, err := harness.New(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	url := startGateway(t, h.Node(0), func(_ *gateway.Gateway, server *wss.WebsocketServer) {
+		server.SetRateLimit(ratelimit.New(0.001, 2))
+	})
+	c := dial(t, url)
+	c.mustCall(gateway.Frame{Op: gateway.OpPublish, Ref: "1", Topic: "news", Data: json.RawMessage(`1`)})
+	c.mustCall(gateway.Frame{Op: gateway.OpPublish, Ref: "2", Topic: "news", Data: json.RawMessage(`2`)})
+	// Frames over rate limit of the client are answered with an error
+	reply := c.call(gateway.Frame{Op: gateway.OpPublish, Ref: "3", Topic: "news", Data: json.RawMessage(`3`)})
+	if reply.Op != gateway.OpError || !strings.Contains(reply.Error, "rate limit of channel") {
+		t.Fatalf("frame over rate limit was replied with %+v", reply)
+	}
+	// Other clients have their own limit
+	dial(t, url).mustCall(gateway.Frame{Op: gateway.OpPublish, Ref: "1", Topic: "news", Data: json.RawMessage(`1`)})
+}
+
+func TestInvalidFrames(t *testing.T) {
+	_, urls := startNodes(t, 1)
+	c := dial(t, urls[0])
+	if err := c.conn.WriteMessage(websocket.TextMessage, []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	if reply := c.await(func(gateway.Frame) bool { return true }); reply.Op != gateway.OpError {
+		t.Fatalf("invalid frame was replied with %+v", reply)
+	}
+	for _, frame := range []gateway.Frame{
+		{Op: "dance", Ref: "1"},
+		{Op: gateway.OpSubscribe, Ref: "2"},
+		{Op: gateway.OpPublish, Ref: "3", Topic: "news"},
+		{Op: gateway.OpPublish, Ref: "4", Data: json.RawMessage(`1`)},
+		{Op: gateway.OpUnsubscribe, Ref: "5", Topic: "news"},
+		{Op: gateway.OpPublish, Ref: "6", Topic: "news", Data: json.RawMessage(`"!"`), Encoding: gateway.EncodingBase64},
+		{Op: gateway.OpPublish, Ref: "7", Topic: "news", Data: json.RawMessage(`1`), Encoding: "hex"},
+	} {
+		if reply := c.call(frame); reply.Op != gateway.OpError || reply.Error == "" {
+			t.Fatalf("frame %+v was replied with %+v", frame, reply)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/p2sub/p2sub/node"
+	"go.uber.org/zap"
+)
+
+// TopicsPath prefix of REST endpoints
+const TopicsPath = "/topics/"
+
+// eventsSuffix suffix of Server-Sent-Events stream of a topic
+const eventsSuffix = "/events"
+
+// KeyHeader header of application key of a published message, retries with
+// the same key are delivered once on topics with key dedup
+const KeyHeader = "Idempotency-Key"
+
+// TTLHeader header of time to live of a published message e.g: "30s"
+const TTLHeader = "Message-TTL"
+
+// heartbeatInterval interval of SSE comments which keep idle streams alive through proxies
+const heartbeatInterval = 15 * time.Second
+
+// REST REST endpoints of topics for clients which can't hold a WebSocket open:
+//
+//	POST /topics/{name}         publish request body to topic
+//	GET  /topics/{name}/events  subscribe to topic as a Server-Sent-Events stream
+//
+// Name of events stream may be a pattern, e.g: /topics/orders/*/created/events,
+// only messages matching filter query parameter are streamed if it's given
+type REST struct {
+	// ctx streams are closed when it's done, they would block server shutdown otherwise
+	ctx  context.Context
+	node *node.Node
+	log  *zap.SugaredLogger
+}
+
+// NewREST create REST endpoints, event streams are closed when ctx is done
+func NewREST(ctx context.Context, p2subNode *node.Node, log *zap.SugaredLogger) *REST {
+	return &REST{ctx: ctx, node: p2subNode, log: log}
+}
+
+// ServeHTTP implement http.Handler
+func (r *REST) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, TopicsPath)
+	switch {
+	case req.Method == http.MethodPost && !strings.HasSuffix(name, eventsSuffix):
+		r.publish(res, req, name)
+	case req.Method == http.MethodGet && strings.HasSuffix(name, eventsSuffix):
+		r.events(res, req, strings.TrimSuffix(name, eventsSuffix))
+	default:
+		http.Error(res, "not found", http.StatusNotFound)
+	}
+}
+
+// publish publish request body to a topic
+func (r *REST) publish(res http.ResponseWriter, req *http.Request, topic string) {
+	if topic == "" {
+		http.Error(res, "topic is required", http.StatusBadRequest)
+		return
+	}
+	if node.IsPattern(topic) {
+		http.Error(res, node.ErrWildcardTopic.Error(), http.StatusBadRequest)
+		return
+	}
+	// Large messages are published in fragments
+	maxSize := int64(r.node.TopicParams(topic).MaxMessageSize)
+	data, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, maxSize))
+	if err != nil {
+		http.Error(res, fmt.Sprintf("unable to read message: %v", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+	opts := []node.PublishOption{node.WithKey(req.Header.Get(KeyHeader))}
+	if value := req.Header.Get(TTLHeader); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			http.Error(res, fmt.Sprintf("invalid %s: %v", TTLHeader, err), http.StatusBadRequest)
+			return
+		}
+		opts = append(opts, node.WithTTL(ttl))
+	}
+	if err := r.node.Publish(req.Context(), topic, data, opts...); err != nil {
+		status := http.StatusServiceUnavailable
+		if _, ok := err.(*node.RateLimitError); ok {
+			status = http.StatusTooManyRequests
+		} else if err == node.ErrMessageTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		} else if err == node.ErrKeyTooLong || errors.Is(err, node.ErrInvalidTTL) {
+			status = http.StatusBadRequest
+		}
+		http.Error(res, err.Error(), status)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// events stream messages of a topic until client disconnected
+func (r *REST) events(res http.ResponseWriter, req *http.Request, topic string) {
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		http.Error(res, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	if topic == "" {
+		http.Error(res, "topic is required", http.StatusBadRequest)
+		return
+	}
+	if node.IsPattern(topic) {
+		if err := node.ValidatePattern(topic); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	messageFilter, err := parseFilter(req.URL.Query().Get("filter"))
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub, err := subscribe(r.node, topic)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer sub.Cancel()
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	messages := make(chan *node.Message)
+	go func() {
+		defer close(messages)
+		for {
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				return
+			}
+			if !messageFilter.Match(msg.Data, msg.Headers()) {
+				continue
+			}
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			// Frames are single line JSON, so each one fits in a data field
+			frame, err := json.Marshal(messageFrame(msg))
+			if err != nil {
+				r.log.Warnf("Unable to encode frame: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", OpMessage, frame); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
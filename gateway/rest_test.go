@@ -0,0 +1,154 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/p2sub/p2sub/gateway"
+	"github.com/p2sub/p2sub/harness"
+	"github.com/p2sub/p2sub/node"
+	"go.uber.org/zap"
+)
+
+// startREST serve REST endpoints of a node on a test HTTP server
+func startREST(t *testing.T, p2subNode *node.Node) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	mux := http.NewServeMux()
+	mux.Handle(gateway.TopicsPath, gateway.NewREST(ctx, p2subNode, zap.NewNop().Sugar()))
+	server := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+	})
+	return server.URL
+}
+
+// post publish a body through REST endpoint, it returns response status
+func post(t *testing.T, url string, body string, headers map[string]string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestRESTPublishEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h, err := harness.New(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Connect(harness.FullMesh); err != nil {
+		t.Fatal(err)
+	}
+	publisherURL, subscriberURL := startREST(t, h.Node(0)), startREST(t, h.Node(1))
+	if _, err := h.Node(0).Subscribe("news"); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, subscriberURL+"/topics/news/events?filter="+`symbol=="BTC"`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("events stream was answered with %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	if err := h.AwaitMesh(ctx, "news", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only messages matching filter are streamed
+	for _, body := range []string{`{"symbol":"ETH"}`, `{"symbol":"BTC"}`} {
+		if status := post(t, publisherURL+"/topics/news", body, nil); status != http.StatusNoContent {
+			t.Fatalf("publish was answered with %d", status)
+		}
+	}
+	lines := bufio.NewScanner(res.Body)
+	for lines.Scan() {
+		line := lines.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var frame gateway.Frame
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &frame); err != nil {
+			t.Fatal(err)
+		}
+		if frame.Op != gateway.OpMessage || frame.Topic != "news" || string(frame.Data) != `{"symbol":"BTC"}` {
+			t.Fatalf("unexpected event %+v", frame)
+		}
+		return
+	}
+	t.Fatalf("events stream ended: %v", lines.Err())
+}
+
+func TestRESTErrors(t *testing.T) {
+	h, err := harness.New(context.Background(), 1, node.ConfigureTopic("small", node.TopicParams{MaxMessageSize: 16}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	url := startREST(t, h.Node(0))
+	cases := []struct {
+		path    string
+		body    string
+		headers map[string]string
+		status  int
+	}{
+		{"/topics/", "data", nil, http.StatusBadRequest},
+		{"/topics/orders/*", "data", nil, http.StatusBadRequest},
+		{"/topics/small", strings.Repeat("x", 17), nil, http.StatusRequestEntityTooLarge},
+		{"/topics/news", "data", map[string]string{gateway.TTLHeader: "soon"}, http.StatusBadRequest},
+		{"/topics/news/events", "data", nil, http.StatusNotFound},
+		{"/topics/small", "data", nil, http.StatusNoContent},
+	}
+	for _, c := range cases {
+		if status := post(t, url+c.path, c.body, c.headers); status != c.status {
+			t.Fatalf("POST %s was answered with %d, expected %d", c.path, status, c.status)
+		}
+	}
+	res, err := http.Get(url + "/topics/news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET of a topic was answered with %d", res.StatusCode)
+	}
+}
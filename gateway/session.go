@@ -0,0 +1,255 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/p2sub/p2sub/wss"
+)
+
+// Defaults of sessions
+const (
+	// DefaultSessionGrace time a disconnected client has to resume its session
+	DefaultSessionGrace = time.Minute
+	// DefaultSessionBuffer number of messages buffered for a session while
+	// its client is away or over its ack window
+	DefaultSessionBuffer = wss.DefaultQueueSize
+	// DefaultSessionLifetime sessions older than it are not resumed
+	DefaultSessionLifetime = time.Hour
+)
+
+// Errors of sessions
+var (
+	ErrUnknownSession = errors.New("unknown or expired session")
+	ErrSessionInUse   = errors.New("session is used by another client")
+	ErrBufferFull     = errors.New("session buffer is full")
+)
+
+// session state of a client which outlives its connection, subscriptions
+// keep buffering messages while client is away. A client resumes its session
+// with its token after a reconnect
+type session struct {
+	token string
+	// channelID channel of client, it's 0 while client is disconnected
+	channelID  uint64
+	createdAt  time.Time
+	detachedAt time.Time
+	subs       map[string]subscription
+	// ack messages carry a delivery ID and wait in inflight until client
+	// acknowledged them
+	ack      bool
+	next     uint64
+	inflight map[uint64]*delivery
+	// backlog messages waiting for client to resume or for room in ack window
+	backlog []Frame
+	closed  bool
+}
+
+// SetSessionLimits set number of buffered messages and lifetime of sessions,
+// zero values keep defaults. It must be set before Run
+func (g *Gateway) SetSessionLimits(buffer int, lifetime time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if buffer > 0 {
+		g.sessionBuffer = buffer
+	}
+	if lifetime > 0 {
+		g.sessionLifetime = lifetime
+	}
+}
+
+// Stats messages held by sessions of a gateway
+type Stats struct {
+	// Sessions sessions including those of disconnected clients
+	Sessions int
+	// Buffered messages waiting for clients to resume or for room in their ack window
+	Buffered int
+	// Inflight messages sent to clients which were not acknowledged yet
+	Inflight int
+}
+
+// Stats get number of sessions and of messages they hold
+func (g *Gateway) Stats() Stats {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	stats := Stats{Sessions: len(g.tokens)}
+	for _, s := range g.tokens {
+		stats.Buffered += len(s.backlog)
+		stats.Inflight += len(s.inflight)
+	}
+	return stats
+}
+
+// connect issue session token to a newly connected client
+func (g *Gateway) connect(channelID uint64) {
+	g.mutex.Lock()
+	s, err := g.sessionOf(channelID)
+	g.mutex.Unlock()
+	if err != nil {
+		g.log.Warnf("Unable to open session of channel %d: %v", channelID, err)
+		return
+	}
+	g.reply(channelID, Frame{Op: OpSession, Token: s.token})
+}
+
+// sessionOf get session of a channel, it's opened if channel has none.
+// g.mutex must be held
+func (g *Gateway) sessionOf(channelID uint64) (*session, error) {
+	if s, ok := g.sessions[channelID]; ok {
+		return s, nil
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		token:     token,
+		channelID: channelID,
+		createdAt: time.Now(),
+		subs:      make(map[string]subscription),
+		inflight:  make(map[uint64]*delivery),
+	}
+	g.sessions[channelID] = s
+	g.tokens[token] = s
+	return s, nil
+}
+
+// resume attach session of a token to a channel, session opened by the
+// channel itself is closed. Buffered messages are replayed by flush
+func (g *Gateway) resume(channelID uint64, token string) error {
+	g.mutex.Lock()
+	s, ok := g.tokens[token]
+	if !ok || time.Since(s.createdAt) > g.sessionLifetime {
+		g.mutex.Unlock()
+		return ErrUnknownSession
+	}
+	if s.channelID == channelID {
+		g.mutex.Unlock()
+		return nil
+	}
+	if s.channelID != 0 {
+		g.mutex.Unlock()
+		return ErrSessionInUse
+	}
+	var dropped map[string]subscription
+	if previous, ok := g.sessions[channelID]; ok {
+		dropped = g.drop(previous)
+	}
+	s.channelID = channelID
+	g.sessions[channelID] = s
+	g.mutex.Unlock()
+	for _, sub := range dropped {
+		sub.Cancel()
+	}
+	return nil
+}
+
+// detach keep session of a disconnected channel, its subscriptions keep
+// buffering messages until session grace is over
+func (g *Gateway) detach(channelID uint64) {
+	g.mutex.Lock()
+	s, ok := g.sessions[channelID]
+	if !ok {
+		g.mutex.Unlock()
+		return
+	}
+	delete(g.sessions, channelID)
+	s.channelID = 0
+	s.detachedAt = time.Now()
+	var dropped map[string]subscription
+	if time.Since(s.createdAt) > g.sessionLifetime {
+		dropped = g.drop(s)
+	}
+	g.mutex.Unlock()
+	for _, sub := range dropped {
+		sub.Cancel()
+	}
+}
+
+// sweep detach sessions of channels which are gone, forget sessions which
+// were not resumed in time and redeliver unacknowledged messages. Sessions
+// of channels closed before their frames were handled are caught here
+func (g *Gateway) sweep(now time.Time) {
+	live := make(map[uint64]struct{})
+	for _, info := range g.server.Sessions() {
+		live[info.ID] = struct{}{}
+	}
+	g.mutex.Lock()
+	for channelID, s := range g.sessions {
+		if _, ok := live[channelID]; !ok {
+			delete(g.sessions, channelID)
+			s.channelID = 0
+			s.detachedAt = now
+		}
+	}
+	dropped := make([]subscription, 0)
+	for _, s := range g.tokens {
+		if s.channelID != 0 {
+			g.redeliver(s, now)
+			continue
+		}
+		if now.Sub(s.detachedAt) > g.sessionGrace || now.Sub(s.createdAt) > g.sessionLifetime {
+			for _, sub := range g.drop(s) {
+				dropped = append(dropped, sub)
+			}
+		}
+	}
+	g.mutex.Unlock()
+	for _, sub := range dropped {
+		sub.Cancel()
+	}
+}
+
+// drop forget a session, it returns its subscriptions which have to be
+// canceled once g.mutex was released. g.mutex must be held
+func (g *Gateway) drop(s *session) map[string]subscription {
+	s.closed = true
+	delete(g.tokens, s.token)
+	if s.channelID != 0 {
+		delete(g.sessions, s.channelID)
+	}
+	subs := s.subs
+	s.subs = make(map[string]subscription)
+	s.backlog = nil
+	return subs
+}
+
+// closeAll cancel subscriptions of all sessions
+func (g *Gateway) closeAll() {
+	g.mutex.Lock()
+	dropped := make([]subscription, 0)
+	for _, s := range g.tokens {
+		for _, sub := range g.drop(s) {
+			dropped = append(dropped, sub)
+		}
+	}
+	g.mutex.Unlock()
+	for _, sub := range dropped {
+		sub.Cancel()
+	}
+}
+
+// newToken random session token
+func newToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
@@ -3,7 +3,9 @@ module github.com/p2sub/p2sub
 go 1.14
 
 require (
+	github.com/gogo/protobuf v1.3.1
 	github.com/gorilla/websocket v1.4.2
+	github.com/klauspost/compress v1.11.4
 	github.com/libp2p/go-libp2p v0.11.0
 	github.com/libp2p/go-libp2p-core v0.6.1
 	github.com/libp2p/go-libp2p-discovery v0.5.0
@@ -11,6 +13,9 @@ require (
 	github.com/libp2p/go-libp2p-peerstore v0.2.6
 	github.com/libp2p/go-libp2p-pubsub v0.3.5-0.20200821075113-efd56962bced
 	github.com/libp2p/go-libp2p-pubsub-tracer v0.0.0-20200824125059-9ca4f1934686
+	github.com/libp2p/go-libp2p-swarm v0.2.8
 	github.com/multiformats/go-multiaddr v0.3.1
+	github.com/prometheus/client_golang v1.7.1
 	go.uber.org/zap v1.15.0
+	golang.org/x/crypto v0.0.0-20200423211502-4bdfaf469ed5
 )
@@ -0,0 +1,374 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package harness in-memory multi-node harness, it runs p2sub nodes on a
+// libp2p mocknet so integration tests don't need real ports or processes
+package harness
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/p2sub/p2sub/keypair"
+	"github.com/p2sub/p2sub/node"
+	"go.uber.org/zap"
+)
+
+// pollInterval interval of polling in await helpers
+const pollInterval = 10 * time.Millisecond
+
+// unlinkTimeout maximum time to wait for pubsub to notice a disconnect
+const unlinkTimeout = 5 * time.Second
+
+// Topology edges between nodes of a harness, nodes are identified by index
+type Topology func(size int) [][2]int
+
+// FullMesh every node is linked to every other node
+func FullMesh(size int) [][2]int {
+	edges := make([][2]int, 0)
+	for i := 0; i < size; i++ {
+		for j := i + 1; j < size; j++ {
+			edges = append(edges, [2]int{i, j})
+		}
+	}
+	return edges
+}
+
+// Line node i is linked to node i+1
+func Line(size int) [][2]int {
+	edges := make([][2]int, 0)
+	for i := 0; i+1 < size; i++ {
+		edges = append(edges, [2]int{i, i + 1})
+	}
+	return edges
+}
+
+// Ring line which last node is linked to the first one
+func Ring(size int) [][2]int {
+	edges := Line(size)
+	if size > 2 {
+		edges = append(edges, [2]int{size - 1, 0})
+	}
+	return edges
+}
+
+// Star every node is linked to node 0
+func Star(size int) [][2]int {
+	edges := make([][2]int, 0)
+	for i := 1; i < size; i++ {
+		edges = append(edges, [2]int{0, i})
+	}
+	return edges
+}
+
+// Harness group of nodes running on the same mocknet
+type Harness struct {
+	Mocknet mocknet.Mocknet
+	nodes   []*node.Node
+	hosts   []host.Host
+	streams []*streamTracker
+}
+
+// New start size nodes on a new mocknet, nodes are not linked until Connect
+// was called. Given options are applied to every node, discovery is disabled
+// by default so topologies are deterministic
+func New(ctx context.Context, size int, opts ...node.Option) (*Harness, error) {
+	h := &Harness{Mocknet: mocknet.New(ctx)}
+	for i := 0; i < size; i++ {
+		// Mocknet generated peers have bogus keys, their messages would fail
+		// signature verification of gossipsub
+		nodeKey, err := keypair.New()
+		if err != nil {
+			h.Close()
+			return nil, err
+		}
+		addr, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", 10000+i))
+		if err != nil {
+			h.Close()
+			return nil, err
+		}
+		peerHost, err := h.Mocknet.AddPeer(nodeKey.GetPrivateKey(), addr)
+		if err != nil {
+			h.Close()
+			return nil, err
+		}
+		h.hosts = append(h.hosts, peerHost)
+		tracker := newStreamTracker()
+		peerHost.Network().Notify(tracker)
+		h.streams = append(h.streams, tracker)
+		nodeOptions := append([]node.Option{
+			node.Host(peerHost),
+			node.Domain(""),
+			node.NoPublicBootstrap(),
+			node.Logger(zap.NewNop().Sugar()),
+		}, opts...)
+		p2subNode, err := node.New(nodeOptions...)
+		if err != nil {
+			h.Close()
+			return nil, err
+		}
+		if err := p2subNode.Start(ctx); err != nil {
+			p2subNode.Close()
+			h.Close()
+			return nil, err
+		}
+		h.nodes = append(h.nodes, p2subNode)
+	}
+	return h, nil
+}
+
+// Size get number of nodes
+func (h *Harness) Size() int {
+	return len(h.nodes)
+}
+
+// Node get node at given index
+func (h *Harness) Node(i int) *node.Node {
+	return h.nodes[i]
+}
+
+// Nodes get all nodes
+func (h *Harness) Nodes() []*node.Node {
+	return h.nodes
+}
+
+// Connect link and connect nodes in given topology
+func (h *Harness) Connect(topology Topology) error {
+	for _, edge := range topology(h.Size()) {
+		if err := h.Link(edge[0], edge[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Link link and connect two nodes
+func (h *Harness) Link(i, j int) error {
+	a, b := h.hosts[i].ID(), h.hosts[j].ID()
+	if len(h.Mocknet.LinksBetweenPeers(a, b)) == 0 {
+		if _, err := h.Mocknet.LinkPeers(a, b); err != nil {
+			return err
+		}
+	}
+	if h.hosts[i].Network().Connectedness(b) == network.Connected {
+		return nil
+	}
+	_, err := h.Mocknet.ConnectPeers(a, b)
+	return err
+}
+
+// Unlink disconnect two nodes and remove the link between them, they are not
+// able to reconnect until they were linked again. It returns once pubsub of
+// both nodes dropped the other peer, otherwise queued messages could still
+// cross the removed link
+func (h *Harness) Unlink(i, j int) error {
+	a, b := h.hosts[i].ID(), h.hosts[j].ID()
+	if len(h.Mocknet.LinksBetweenPeers(a, b)) == 0 {
+		return nil
+	}
+	if err := h.Mocknet.UnlinkPeers(a, b); err != nil {
+		return err
+	}
+	if h.hosts[i].Network().Connectedness(b) == network.Connected {
+		if err := h.Mocknet.DisconnectPeers(a, b); err != nil {
+			return err
+		}
+	}
+	deadline := time.Now().Add(unlinkTimeout)
+	for hasPeer(h.nodes[i], b) || hasPeer(h.nodes[j], a) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("nodes %d and %d are still peers after unlink", i, j)
+		}
+		h.streams[i].reset(b)
+		h.streams[j].reset(a)
+		time.Sleep(pollInterval)
+	}
+	return nil
+}
+
+// hasPeer check if pubsub of a node still has a given peer
+func hasPeer(p2subNode *node.Node, id peer.ID) bool {
+	for _, p := range p2subNode.PubSub().ListPeers("") {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Partition split nodes into isolated groups, nodes which are not listed in
+// any group are isolated from every other node
+func (h *Harness) Partition(groups ...[]int) error {
+	group := make(map[int]int)
+	for g, members := range groups {
+		for _, i := range members {
+			group[i] = g + 1
+		}
+	}
+	for i := 0; i < h.Size(); i++ {
+		for j := i + 1; j < h.Size(); j++ {
+			if group[i] == 0 || group[i] != group[j] {
+				if err := h.Unlink(i, j); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Heal reconnect nodes in given topology after a partition
+func (h *Harness) Heal(topology Topology) error {
+	return h.Connect(topology)
+}
+
+// SubscribeAll subscribe all nodes to a topic, subscriptions are in node order
+func (h *Harness) SubscribeAll(topic string) ([]*node.Subscription, error) {
+	subs := make([]*node.Subscription, 0, h.Size())
+	for _, p2subNode := range h.nodes {
+		sub, err := p2subNode.Subscribe(topic)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// Publish publish data to a topic from node at given index
+func (h *Harness) Publish(ctx context.Context, i int, topic string, data []byte) error {
+	return h.nodes[i].Publish(ctx, topic, data)
+}
+
+// AwaitMesh wait until every node subscribed to topic sees at least minPeers
+// other subscribers and grafted at least minPeers of them into its mesh,
+// messages published before that could be lost since relays only forward
+// them to mesh peers
+func (h *Harness) AwaitMesh(ctx context.Context, topic string, minPeers int) error {
+	for {
+		ready := true
+		for _, p2subNode := range h.nodes {
+			if len(p2subNode.PubSub().ListPeers(topic)) < minPeers || len(p2subNode.MeshPeers(topic)) < minPeers {
+				ready = false
+				break
+			}
+		}
+		if ready {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("mesh of topic %s is not ready: %v", topic, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// AwaitDelivery wait until every given subscription received a message
+// carrying data, other messages are skipped
+func (h *Harness) AwaitDelivery(ctx context.Context, subs []*node.Subscription, data []byte) error {
+	missing := make([]string, 0)
+	for i, err := range awaitAll(ctx, subs, data) {
+		if err != nil {
+			missing = append(missing, fmt.Sprintf("subscription %d", i))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("message was not delivered to %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// AwaitNoDelivery make sure none of given subscriptions receives a message
+// carrying data before ctx is done, it's useful to verify partitions
+func (h *Harness) AwaitNoDelivery(ctx context.Context, subs []*node.Subscription, data []byte) error {
+	delivered := make([]string, 0)
+	for i, err := range awaitAll(ctx, subs, data) {
+		if err == nil {
+			delivered = append(delivered, fmt.Sprintf("subscription %d", i))
+		}
+	}
+	if len(delivered) > 0 {
+		return fmt.Errorf("message was delivered to %s", strings.Join(delivered, ", "))
+	}
+	return nil
+}
+
+// awaitAll wait for a message carrying data on all subscriptions concurrently,
+// it returns result of each subscription in the same order
+func awaitAll(ctx context.Context, subs []*node.Subscription, data []byte) []error {
+	results := make([]error, len(subs))
+	var wg sync.WaitGroup
+	for i, sub := range subs {
+		wg.Add(1)
+		go func(i int, sub *node.Subscription) {
+			defer wg.Done()
+			_, results[i] = Await(ctx, sub, func(msg *node.Message) bool {
+				return bytes.Equal(msg.Data, data)
+			})
+		}(i, sub)
+	}
+	wg.Wait()
+	return results
+}
+
+// Await wait for the first message of subscription matching given predicate
+func Await(ctx context.Context, sub *node.Subscription, match func(msg *node.Message) bool) (*node.Message, error) {
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if match(msg) {
+			return msg, nil
+		}
+	}
+}
+
+// PeerIDs get peer IDs of all nodes in node order
+func (h *Harness) PeerIDs() []peer.ID {
+	ids := make([]peer.ID, 0, len(h.hosts))
+	for _, peerHost := range h.hosts {
+		ids = append(ids, peerHost.ID())
+	}
+	return ids
+}
+
+// Close close all nodes and their hosts
+func (h *Harness) Close() error {
+	errs := make([]string, 0)
+	for _, p2subNode := range h.nodes {
+		if err := p2subNode.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, peerHost := range h.hosts {
+		if err := peerHost.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to close harness: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/p2sub/p2sub/harness"
+)
+
+// start start nodes linked in a topology, they are closed with the test
+func start(t *testing.T, ctx context.Context, size int, topology harness.Topology) *harness.Harness {
+	t.Helper()
+	h, err := harness.New(ctx, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	if err := h.Connect(topology); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestDelivery(t *testing.T) {
+	topologies := map[string]harness.Topology{
+		"full mesh": harness.FullMesh,
+		"line":      harness.Line,
+		"ring":      harness.Ring,
+		"star":      harness.Star,
+	}
+	for name, topology := range topologies {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			h := start(t, ctx, 5, topology)
+			subs, err := h.SubscribeAll("news")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := h.AwaitMesh(ctx, "news", 1); err != nil {
+				t.Fatal(err)
+			}
+			// Last node of a line is the farthest from every other node
+			for _, publisher := range []int{0, h.Size() - 1} {
+				data := []byte(name + " from node " + string(rune('0'+publisher)))
+				if err := h.Publish(ctx, publisher, "news", data); err != nil {
+					t.Fatal(err)
+				}
+				if err := h.AwaitDelivery(ctx, subs, data); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPartitionHeal(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	h := start(t, ctx, 4, harness.FullMesh)
+	subs, err := h.SubscribeAll("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AwaitMesh(ctx, "news", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Partition([]int{0, 1}, []int{2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []int{1, 1, 1, 1} {
+		if peers := len(h.Node(i).Peers()); peers != expected {
+			t.Fatalf("node %d has %d peers in its partition, expected %d", i, peers, expected)
+		}
+	}
+	// Nodes which are not linked don't reconnect on their own
+	if _, err := h.Mocknet.ConnectPeers(h.Node(0).ID(), h.Node(2).ID()); err == nil {
+		t.Fatal("node connected across partition")
+	}
+	data := []byte("during partition")
+	if err := h.Publish(ctx, 0, "news", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AwaitDelivery(ctx, subs[:2], data); err != nil {
+		t.Fatal(err)
+	}
+	quiet, stop := context.WithTimeout(ctx, time.Second)
+	defer stop()
+	if err := h.AwaitNoDelivery(quiet, subs[2:], data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Heal(harness.FullMesh); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AwaitMesh(ctx, "news", 3); err != nil {
+		t.Fatal(err)
+	}
+	data = []byte("after heal")
+	if err := h.Publish(ctx, 3, "news", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AwaitDelivery(ctx, subs, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionIsolated(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	h := start(t, ctx, 3, harness.FullMesh)
+	subs, err := h.SubscribeAll("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AwaitMesh(ctx, "news", 2); err != nil {
+		t.Fatal(err)
+	}
+	// Nodes missing from every group are isolated
+	if err := h.Partition([]int{0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if peers := len(h.Node(2).Peers()); peers != 0 {
+		t.Fatalf("isolated node has %d peers", peers)
+	}
+	data := []byte("without node 2")
+	if err := h.Publish(ctx, 1, "news", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AwaitDelivery(ctx, subs[:2], data); err != nil {
+		t.Fatal(err)
+	}
+	quiet, stop := context.WithTimeout(ctx, time.Second)
+	defer stop()
+	if err := h.AwaitNoDelivery(quiet, subs[2:], data); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// streamTracker keep track of open streams of a host. Mocknet resets streams
+// of a closed connection before it is removed, a stream opened in between,
+// e.g. by pubsub which respawns its writer, would stay open forever
+type streamTracker struct {
+	sync.Mutex
+	streams map[network.Stream]struct{}
+}
+
+func newStreamTracker() *streamTracker {
+	return &streamTracker{streams: make(map[network.Stream]struct{})}
+}
+
+// reset reset every tracked stream to a peer
+func (t *streamTracker) reset(id peer.ID) {
+	t.Lock()
+	streams := make([]network.Stream, 0)
+	for s := range t.streams {
+		if s.Conn().RemotePeer() == id {
+			streams = append(streams, s)
+		}
+	}
+	t.Unlock()
+	for _, s := range streams {
+		s.Reset()
+	}
+}
+
+// OpenedStream implement network.Notifiee
+func (t *streamTracker) OpenedStream(_ network.Network, s network.Stream) {
+	t.Lock()
+	defer t.Unlock()
+	t.streams[s] = struct{}{}
+}
+
+// ClosedStream implement network.Notifiee
+func (t *streamTracker) ClosedStream(_ network.Network, s network.Stream) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.streams, s)
+}
+
+// Listen implement network.Notifiee
+func (t *streamTracker) Listen(network.Network, multiaddr.Multiaddr) {}
+
+// ListenClose implement network.Notifiee
+func (t *streamTracker) ListenClose(network.Network, multiaddr.Multiaddr) {}
+
+// Connected implement network.Notifiee
+func (t *streamTracker) Connected(network.Network, network.Conn) {}
+
+// Disconnected implement network.Notifiee
+func (t *streamTracker) Disconnected(network.Network, network.Conn) {}
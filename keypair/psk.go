@@ -0,0 +1,63 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keypair
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+
+	"github.com/libp2p/go-libp2p-core/pnet"
+)
+
+// PSKLength length of pre-shared key in bytes
+const PSKLength = 32
+
+// pskHeader header of libp2p V1 pre-shared key in base16 encoding
+const pskHeader = "/key/swarm/psk/1.0.0/\n/base16/\n"
+
+// NewPSK generate new random pre-shared key for private network
+func NewPSK() (pnet.PSK, error) {
+	psk := make([]byte, PSKLength)
+	_, err := rand.Read(psk)
+	if err == nil {
+		return psk, nil
+	}
+	return nil, err
+}
+
+// SavePSKToFile save pre-shared key to file in libp2p V1 format
+func SavePSKToFile(psk pnet.PSK, fileName string) (bool, error) {
+	fid, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err == nil {
+		defer fid.Close()
+		writtenBytes, err := fid.WriteString(pskHeader + hex.EncodeToString(psk) + "\n")
+		if err == nil {
+			return writtenBytes > 0, nil
+		}
+		return false, err
+	}
+	return false, err
+}
+
+// LoadPSKFromFile load pre-shared key from file in libp2p V1 format
+func LoadPSKFromFile(fileName string) (pnet.PSK, error) {
+	fid, err := os.Open(fileName)
+	if err == nil {
+		defer fid.Close()
+		return pnet.DecodeV1PSK(fid)
+	}
+	return nil, err
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keypair
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"math/big"
+
+	p2pCrypto "github.com/libp2p/go-libp2p-core/crypto"
+	pb "github.com/libp2p/go-libp2p-core/crypto/pb"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Errors of sealing
+var (
+	ErrUnsupportedKey = errors.New("only Ed25519 keys are able to seal and open data")
+	ErrInvalidSealed  = errors.New("sealed data is invalid")
+)
+
+// sealedHeaderSize size of ephemeral public key and nonce before ciphertext
+const sealedHeaderSize = curve25519.PointSize + 12
+
+// curveP prime of curve25519, 2^255 - 19
+var curveP = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// Seal encrypt data to an Ed25519 public key, only owner of its private key
+// is able to open it. An ephemeral X25519 key agrees a one-time AES-GCM key
+// with the public key converted to X25519
+func Seal(pubKey p2pCrypto.PubKey, data []byte) ([]byte, error) {
+	recipient, err := montgomeryPublic(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, err
+	}
+	ephemeralPublic, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral, recipient)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := sealingCipher(shared, ephemeralPublic, recipient)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, sealedHeaderSize, sealedHeaderSize+len(data)+aead.Overhead())
+	copy(sealed, ephemeralPublic)
+	nonce := sealed[curve25519.PointSize:sealedHeaderSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(sealed, nonce, data, nil), nil
+}
+
+// Open decrypt data which was sealed to public key of an Ed25519 private key
+func Open(privKey p2pCrypto.PrivKey, sealed []byte) ([]byte, error) {
+	if privKey.Type() != pb.KeyType_Ed25519 {
+		return nil, ErrUnsupportedKey
+	}
+	if len(sealed) < sealedHeaderSize {
+		return nil, ErrInvalidSealed
+	}
+	raw, err := privKey.Raw()
+	if err != nil {
+		return nil, err
+	}
+	// X25519 scalar of an Ed25519 key is the first half of hashed seed
+	digest := sha512.Sum512(raw[:32])
+	scalar := digest[:curve25519.ScalarSize]
+	recipient, err := montgomeryPublic(privKey.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPublic := sealed[:curve25519.PointSize]
+	shared, err := curve25519.X25519(scalar, ephemeralPublic)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := sealingCipher(shared, ephemeralPublic, recipient)
+	if err != nil {
+		return nil, err
+	}
+	data, err := aead.Open(nil, sealed[curve25519.PointSize:sealedHeaderSize], sealed[sealedHeaderSize:], nil)
+	if err != nil {
+		return nil, ErrInvalidSealed
+	}
+	return data, nil
+}
+
+// Seal encrypt data to public key of this key pair
+func (k *KeyPair) Seal(data []byte) ([]byte, error) {
+	return Seal(k.pubKey, data)
+}
+
+// Open decrypt data sealed to this key pair
+func (k *KeyPair) Open(sealed []byte) ([]byte, error) {
+	if !k.isAbleToSign() {
+		return nil, errors.New("private key is required to open data")
+	}
+	return Open(k.privKey, sealed)
+}
+
+// sealingCipher AES-GCM cipher of a shared secret, both public keys are
+// bound to the key
+func sealingCipher(shared []byte, ephemeralPublic []byte, recipient []byte) (cipher.AEAD, error) {
+	hash := sha256.New()
+	hash.Write(shared)
+	hash.Write(ephemeralPublic)
+	hash.Write(recipient)
+	block, err := aes.NewCipher(hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// montgomeryPublic convert an Ed25519 public key to X25519,
+// u = (1 + y) / (1 - y) mod p
+func montgomeryPublic(pubKey p2pCrypto.PubKey) ([]byte, error) {
+	if pubKey.Type() != pb.KeyType_Ed25519 {
+		return nil, ErrUnsupportedKey
+	}
+	raw, err := pubKey.Raw()
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 32 {
+		return nil, ErrUnsupportedKey
+	}
+	// y is little-endian, its top bit is sign of x
+	encoded := make([]byte, 32)
+	for i := range raw {
+		encoded[31-i] = raw[i]
+	}
+	encoded[0] &= 0x7f
+	y := new(big.Int).SetBytes(encoded)
+	if y.Cmp(curveP) >= 0 {
+		return nil, ErrUnsupportedKey
+	}
+	numerator := new(big.Int).Add(big.NewInt(1), y)
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, curveP)
+	if denominator.Sign() == 0 {
+		return nil, ErrUnsupportedKey
+	}
+	u := numerator.Mul(numerator, denominator.ModInverse(denominator, curveP))
+	u.Mod(u, curveP)
+	// Big-endian bytes of u are reversed into a little-endian point
+	point := make([]byte, curve25519.PointSize)
+	digits := u.Bytes()
+	for i, b := range digits {
+		point[len(digits)-1-i] = b
+	}
+	return point, nil
+}
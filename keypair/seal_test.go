@@ -0,0 +1,114 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keypair
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"testing"
+
+	p2pCrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"golang.org/x/crypto/curve25519"
+)
+
+func TestMontgomeryPublic(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		privKey, pubKey, err := p2pCrypto.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		point, err := montgomeryPublic(pubKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// X25519 public key of the scalar derived from Ed25519 seed must be
+		// the converted Ed25519 public key
+		raw, err := privKey.Raw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := sha512.Sum512(raw[:32])
+		expected, err := curve25519.X25519(digest[:curve25519.ScalarSize], curve25519.Basepoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(point, expected) {
+			t.Fatalf("converted public key %x, expected %x", point, expected)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	privKey, pubKey, err := p2pCrypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{{}, []byte("group key"), bytes.Repeat([]byte{7}, 4096)} {
+		sealed, err := Seal(pubKey, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened, err := Open(privKey, sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(opened, data) {
+			t.Fatalf("opened %q, expected %q", opened, data)
+		}
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	privKey, pubKey, err := p2pCrypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := Seal(pubKey, []byte("group key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flipping any bit of ephemeral key, nonce or ciphertext breaks it
+	for _, i := range []int{0, curve25519.PointSize, sealedHeaderSize, len(sealed) - 1} {
+		tampered := append([]byte(nil), sealed...)
+		tampered[i] ^= 1
+		if _, err := Open(privKey, tampered); err == nil {
+			t.Fatalf("sealed data tampered at %d was opened", i)
+		}
+	}
+	if _, err := Open(privKey, sealed[:sealedHeaderSize-1]); err != ErrInvalidSealed {
+		t.Fatalf("truncated sealed data: %v", err)
+	}
+	otherKey, _, err := p2pCrypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(otherKey, sealed); err == nil {
+		t.Fatal("sealed data was opened by another key")
+	}
+}
+
+func TestSealUnsupportedKey(t *testing.T) {
+	privKey, pubKey, err := p2pCrypto.GenerateSecp256k1Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Seal(pubKey, []byte("data")); err != ErrUnsupportedKey {
+		t.Fatalf("seal to secp256k1 key: %v", err)
+	}
+	if _, err := Open(privKey, make([]byte, 64)); err != ErrUnsupportedKey {
+		t.Fatalf("open with secp256k1 key: %v", err)
+	}
+}
@@ -47,6 +47,11 @@ func GetSugarLogger() *zap.SugaredLogger {
 	return sugar
 }
 
+//Sync flush buffered logs, it should be called before process exits
+func Sync() error {
+	return GetLogger().Sync()
+}
+
 //HexDump for debug purpose
 func HexDump(title string, data []byte) {
 	sugar := GetSugarLogger()
@@ -0,0 +1,350 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics Prometheus metrics of a p2sub node, it collects gossipsub
+// trace events, node observations and queues, peer connections, gateway
+// sessions and WebSocket traffic
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/p2sub/p2sub/gateway"
+	"github.com/p2sub/p2sub/node"
+	"github.com/p2sub/p2sub/wss"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefix of all metrics
+const Namespace = "p2sub"
+
+// OtherTopics topic label of topics which the node neither joined nor
+// configured, it keeps remote peers from creating any number of labels
+const OtherTopics = "(other)"
+
+// Metrics collectors of a node, it's a gossipsub event tracer and a node
+// observer so it could be given to node.EventTracer and node.Observe
+type Metrics struct {
+	registry           *prometheus.Registry
+	published          *prometheus.CounterVec
+	delivered          *prometheus.CounterVec
+	rejected           *prometheus.CounterVec
+	duplicates         *prometheus.CounterVec
+	droppedRPC         prometheus.Counter
+	validationDuration *prometheus.HistogramVec
+	peerEvents         *prometheus.CounterVec
+	discoveryDuration  *prometheus.HistogramVec
+	discoveredPeers    *prometheus.CounterVec
+	throttled          *prometheus.CounterVec
+	// topics topics which are labeled by their name
+	topics map[string]bool
+	mutex  sync.RWMutex
+}
+
+var _ pubsub.EventTracer = (*Metrics)(nil)
+var _ node.Observer = (*Metrics)(nil)
+
+// New create collectors and register them in a new registry, Go runtime and
+// process metrics are included
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		topics:   make(map[string]bool),
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "messages_published_total",
+			Help:      "Messages published by this node.",
+		}, []string{"topic"}),
+		delivered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "messages_delivered_total",
+			Help:      "Messages delivered to subscribers of this node.",
+		}, []string{"topic"}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "messages_rejected_total",
+			Help:      "Messages rejected by gossipsub or validators.",
+		}, []string{"topic", "reason"}),
+		duplicates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "messages_duplicate_total",
+			Help:      "Messages which were received more than once.",
+		}, []string{"topic"}),
+		droppedRPC: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "rpc_dropped_total",
+			Help:      "Outbound gossipsub RPCs dropped because queue of peer was full.",
+		}),
+		validationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "validation_duration_seconds",
+			Help:      "Time spent by validators of the node.",
+			Buckets:   prometheus.ExponentialBuckets(0.000001, 4, 12),
+		}, []string{"topic", "result"}),
+		peerEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "peer_events_total",
+			Help:      "Peer connects and disconnects.",
+		}, []string{"event"}),
+		discoveryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "dht_lookup_duration_seconds",
+			Help:      "Duration of DHT rendezvous operations.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		}, []string{"operation", "result"}),
+		discoveredPeers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "dht_lookup_peers_total",
+			Help:      "Peers returned by DHT rendezvous lookups.",
+		}, []string{"operation"}),
+		throttled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "messages_throttled_total",
+			Help:      "Messages which exceeded a peer or topic rate limit.",
+		}, []string{"topic", "scope"}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.published,
+		m.delivered,
+		m.rejected,
+		m.duplicates,
+		m.droppedRPC,
+		m.validationDuration,
+		m.peerEvents,
+		m.discoveryDuration,
+		m.discoveredPeers,
+		m.throttled,
+	)
+	return m
+}
+
+// Trace count gossipsub trace events
+func (m *Metrics) Trace(evt *pb.TraceEvent) {
+	switch evt.GetType() {
+	case pb.TraceEvent_PUBLISH_MESSAGE:
+		for _, topic := range evt.GetPublishMessage().GetTopics() {
+			m.published.WithLabelValues(m.topic(topic)).Inc()
+		}
+	case pb.TraceEvent_DELIVER_MESSAGE:
+		for _, topic := range evt.GetDeliverMessage().GetTopics() {
+			m.delivered.WithLabelValues(m.topic(topic)).Inc()
+		}
+	case pb.TraceEvent_REJECT_MESSAGE:
+		reject := evt.GetRejectMessage()
+		for _, topic := range reject.GetTopics() {
+			m.rejected.WithLabelValues(m.topic(topic), reject.GetReason()).Inc()
+		}
+	case pb.TraceEvent_DUPLICATE_MESSAGE:
+		for _, topic := range evt.GetDuplicateMessage().GetTopics() {
+			m.duplicates.WithLabelValues(m.topic(topic)).Inc()
+		}
+	case pb.TraceEvent_DROP_RPC:
+		m.droppedRPC.Inc()
+	}
+}
+
+// Validated observe duration of validators
+func (m *Metrics) Validated(topic string, elapsed time.Duration, result pubsub.ValidationResult) {
+	m.validationDuration.WithLabelValues(m.topic(topic), validationResult(result)).Observe(elapsed.Seconds())
+}
+
+// Discovered observe a DHT rendezvous operation
+func (m *Metrics) Discovered(operation string, elapsed time.Duration, found int, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.discoveryDuration.WithLabelValues(operation, result).Observe(elapsed.Seconds())
+	m.discoveredPeers.WithLabelValues(operation).Add(float64(found))
+}
+
+// Throttled count a message which exceeded a rate limit
+func (m *Metrics) Throttled(scope string, topic string) {
+	m.throttled.WithLabelValues(m.topic(topic), scope).Inc()
+}
+
+// Known label metrics of a topic by its name
+func (m *Metrics) Known(topic string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.topics[topic] = true
+}
+
+// topic label of a topic, unknown topics share one label
+func (m *Metrics) topic(topic string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.topics[topic] {
+		return topic
+	}
+	return OtherTopics
+}
+
+// WatchNetwork count peer connects and disconnects of a started node and
+// expose number of connected peers
+func (m *Metrics) WatchNetwork(net network.Network) {
+	net.Notify(&network.NotifyBundle{
+		ConnectedF: func(net network.Network, conn network.Conn) {
+			// Only the first connection to a peer is a connect
+			if len(net.ConnsToPeer(conn.RemotePeer())) == 1 {
+				m.peerEvents.WithLabelValues("connect").Inc()
+			}
+		},
+		DisconnectedF: func(net network.Network, conn network.Conn) {
+			if net.Connectedness(conn.RemotePeer()) != network.Connected {
+				m.peerEvents.WithLabelValues("disconnect").Inc()
+			}
+		},
+	})
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "peers",
+		Help:      "Connected peers.",
+	}, func() float64 {
+		return float64(len(net.Peers()))
+	}))
+}
+
+// WatchNode expose messages held in queues of a node
+func (m *Metrics) WatchNode(p2subNode *node.Node) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "reordering_messages",
+			Help:      "Messages of ordered topics held back until earlier ones arrive.",
+		}, func() float64 {
+			return float64(p2subNode.QueueStats().Reordering)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "reassembling_messages",
+			Help:      "Chunked messages waiting for their missing fragments.",
+		}, func() float64 {
+			return float64(p2subNode.QueueStats().Reassembling)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "fragment_bytes",
+			Help:      "Bytes of received fragments kept for reassembly.",
+		}, func() float64 {
+			return float64(p2subNode.QueueStats().FragmentBytes)
+		}),
+	)
+}
+
+// WatchGateway expose sessions of a gateway and messages they hold
+func (m *Metrics) WatchGateway(wsGateway *gateway.Gateway) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "gateway_sessions",
+			Help:      "Gateway sessions including those of disconnected clients.",
+		}, func() float64 {
+			return float64(wsGateway.Stats().Sessions)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "gateway_buffered_messages",
+			Help:      "Messages buffered by gateway sessions until clients resume or acknowledge.",
+		}, func() float64 {
+			return float64(wsGateway.Stats().Buffered)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "gateway_inflight_messages",
+			Help:      "Messages sent to gateway clients which were not acknowledged yet.",
+		}, func() float64 {
+			return float64(wsGateway.Stats().Inflight)
+		}),
+	)
+}
+
+// WatchWebsocket expose sessions, queue depth and traffic of a websocket server
+func (m *Metrics) WatchWebsocket(server *wss.WebsocketServer) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "websocket_sessions",
+			Help:      "Connected WebSocket clients.",
+		}, func() float64 {
+			return float64(server.Stats().Sessions)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "websocket_queued_frames",
+			Help:      "Outbound frames waiting in queues of all WebSocket clients.",
+		}, func() float64 {
+			return float64(server.Stats().Queued)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "websocket_received_frames_total",
+			Help:      "Frames received from WebSocket clients.",
+		}, func() float64 {
+			return float64(server.Stats().Received)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "websocket_sent_frames_total",
+			Help:      "Frames sent to WebSocket clients.",
+		}, func() float64 {
+			return float64(server.Stats().Sent)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "websocket_dropped_frames_total",
+			Help:      "Outbound frames dropped because queue of client was full.",
+		}, func() float64 {
+			return float64(server.Stats().Dropped)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "websocket_throttled_frames_total",
+			Help:      "Frames which exceeded rate limit of their WebSocket client.",
+		}, func() float64 {
+			return float64(server.Stats().Throttled)
+		}),
+	)
+}
+
+// Registry get registry of collectors, it could be used to register more collectors
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Handler HTTP handler serving metrics in Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// validationResult label of a validation result
+func validationResult(result pubsub.ValidationResult) string {
+	switch result {
+	case pubsub.ValidationAccept:
+		return "accept"
+	case pubsub.ValidationReject:
+		return "reject"
+	case pubsub.ValidationIgnore:
+		return "ignore"
+	}
+	return "unknown"
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/p2sub/p2sub/harness"
+	"github.com/p2sub/p2sub/metrics"
+	"github.com/p2sub/p2sub/node"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// delivered trace event of a message delivered on topics
+func delivered(topics ...string) *pb.TraceEvent {
+	return &pb.TraceEvent{
+		Type:           pb.TraceEvent_DELIVER_MESSAGE.Enum(),
+		DeliverMessage: &pb.TraceEvent_DeliverMessage{Topics: topics},
+	}
+}
+
+// expectMetrics compare gathered metrics with their text format
+func expectMetrics(t *testing.T, m *metrics.Metrics, expected string, names ...string) {
+	t.Helper()
+	if err := testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected), names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTopicLabels(t *testing.T) {
+	m := metrics.New()
+	m.Known("orders")
+	m.Trace(delivered("orders"))
+	// Topics of remote messages don't create labels
+	for i := 0; i < 10; i++ {
+		m.Trace(delivered("orders", strings.Repeat("x", i)))
+	}
+	m.Throttled(node.ScopePeer, "unknown")
+	m.Validated("orders", time.Millisecond, pubsub.ValidationAccept)
+	expectMetrics(t, m, `
+# HELP p2sub_messages_delivered_total Messages delivered to subscribers of this node.
+# TYPE p2sub_messages_delivered_total counter
+p2sub_messages_delivered_total{topic="(other)"} 10
+p2sub_messages_delivered_total{topic="orders"} 11
+# HELP p2sub_messages_throttled_total Messages which exceeded a peer or topic rate limit.
+# TYPE p2sub_messages_throttled_total counter
+p2sub_messages_throttled_total{scope="peer",topic="(other)"} 1
+`, "p2sub_messages_delivered_total", "p2sub_messages_throttled_total")
+	count, err := testutil.GatherAndCount(m.Registry(), "p2sub_validation_duration_seconds")
+	if err != nil || count != 1 {
+		t.Fatalf("%d validation series, expected 1: %v", count, err)
+	}
+}
+
+func TestNodeTopics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	m := metrics.New()
+	h, err := harness.New(ctx, 1,
+		node.EventTracer(m),
+		node.Observe(m),
+		node.ConfigureTopic("configured", node.TopicParams{}),
+		node.ConfigureTopic("configured/#", node.TopicParams{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	p2subNode := h.Node(0)
+	sub, err := p2subNode.Subscribe("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Cancel()
+	if err := p2subNode.Publish(ctx, "orders", []byte("order")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sub.Next(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Joined topics and topics configured by name are labeled, patterns aren't
+	m.Throttled(node.ScopeTopic, "configured")
+	m.Throttled(node.ScopeTopic, "configured/#")
+	expectMetrics(t, m, `
+# HELP p2sub_messages_published_total Messages published by this node.
+# TYPE p2sub_messages_published_total counter
+p2sub_messages_published_total{topic="orders"} 1
+# HELP p2sub_messages_throttled_total Messages which exceeded a peer or topic rate limit.
+# TYPE p2sub_messages_throttled_total counter
+p2sub_messages_throttled_total{scope="topic",topic="(other)"} 1
+p2sub_messages_throttled_total{scope="topic",topic="configured"} 1
+`, "p2sub_messages_published_total", "p2sub_messages_throttled_total")
+}
+
+func TestQueueGauges(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h, err := harness.New(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	m := metrics.New()
+	m.WatchNode(h.Node(0))
+	expectMetrics(t, m, `
+# HELP p2sub_fragment_bytes Bytes of received fragments kept for reassembly.
+# TYPE p2sub_fragment_bytes gauge
+p2sub_fragment_bytes 0
+# HELP p2sub_reassembling_messages Chunked messages waiting for their missing fragments.
+# TYPE p2sub_reassembling_messages gauge
+p2sub_reassembling_messages 0
+# HELP p2sub_reordering_messages Messages of ordered topics held back until earlier ones arrive.
+# TYPE p2sub_reordering_messages gauge
+p2sub_reordering_messages 0
+`, "p2sub_fragment_bytes", "p2sub_reassembling_messages", "p2sub_reordering_messages")
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	swarm "github.com/libp2p/go-libp2p-swarm"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Backoff between two connection attempts to a bootstrap peer
+const (
+	bootstrapMinBackoff = time.Second
+	bootstrapMaxBackoff = 30 * time.Second
+)
+
+// ParsePeers parse multiaddrs to address info of peers
+func ParsePeers(peerList []string) ([]peer.AddrInfo, error) {
+	addrs := make([]multiaddr.Multiaddr, 0, len(peerList))
+	for _, rawAddr := range peerList {
+		mAddr, err := multiaddr.NewMultiaddr(rawAddr)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, mAddr)
+	}
+	// Addresses of the same peer are merged into one address info
+	return peer.AddrInfosFromP2pAddrs(addrs...)
+}
+
+// bootstrapPeers get bootstrap peers of the node, public bootstrap nodes are
+// only used for public network without custom bootstrap peers
+func (n *Node) bootstrapPeers() ([]peer.AddrInfo, error) {
+	if len(n.cfg.BootstrapPeers) > 0 || n.cfg.PSK != nil || n.cfg.NoPublicBootstrap {
+		return n.cfg.BootstrapPeers, nil
+	}
+	return peer.AddrInfosFromP2pAddrs(dht.DefaultBootstrapPeers...)
+}
+
+// connectWithBackoff try to connect to a peer, it retries with exponential
+// backoff until connection established, retries exhausted or context canceled
+func (n *Node) connectWithBackoff(ctx context.Context, peerInfo peer.AddrInfo, retries uint) error {
+	backoff := bootstrapMinBackoff
+	for attempt := uint(0); ; attempt++ {
+		err := n.host.Connect(ctx, peerInfo)
+		if err == nil || attempt >= retries {
+			return err
+		}
+		n.log.Debugf("Unable to connect to %s, retry in %v: %v", peerInfo.ID.Pretty(), backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > bootstrapMaxBackoff {
+			backoff = bootstrapMaxBackoff
+		}
+		clearDialBackoff(n.host, peerInfo.ID)
+	}
+}
+
+// clearDialBackoff we have our own backoff, swarm's dial backoff would reject the retry
+func clearDialBackoff(host host.Host, peerID peer.ID) {
+	if sw, ok := host.Network().(*swarm.Swarm); ok {
+		sw.Backoff().Clear(peerID)
+	}
+}
+
+// connectBootstrapPeers connect to all bootstrap peers in parallel
+func (n *Node) connectBootstrapPeers(ctx context.Context, bootstrapPeers []peer.AddrInfo) {
+	var wg sync.WaitGroup
+	for _, peerInfo := range bootstrapPeers {
+		wg.Add(1)
+		go func(peerInfo peer.AddrInfo) {
+			defer wg.Done()
+			if err := n.connectWithBackoff(ctx, peerInfo, n.cfg.BootstrapRetries); err != nil {
+				n.log.Warn(err)
+			} else {
+				n.log.Infof("Connection established with bootstrap node: %v", peerInfo)
+			}
+		}(peerInfo)
+	}
+	wg.Wait()
+}
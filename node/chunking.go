@@ -0,0 +1,295 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// Defaults of chunking, chunking is disabled unless a topic has a chunk size
+const (
+	// DefaultMaxMessageSize largest payload of a chunked message
+	DefaultMaxMessageSize = 16 << 20
+	// DefaultReassemblyMemory bytes of fragments a node keeps for reassembly
+	DefaultReassemblyMemory = 64 << 20
+	// DefaultReassemblyTimeout time fragments are kept and a message waits
+	// for its missing fragments
+	DefaultReassemblyTimeout = 30 * time.Second
+)
+
+// MaxChunkSize largest fragment, fragments must fit in a gossipsub message
+const MaxChunkSize = pubsub.DefaultMaxMessageSize / 2
+
+// maxPendingManifests chunked messages of a publisher which a subscription
+// holds back while their fragments are missing, later ones are dropped
+const maxPendingManifests = 16
+
+// Errors of chunking
+var (
+	ErrMessageTooLarge = errors.New("message is too large")
+	ErrIncomplete      = errors.New("fragments of message are missing")
+)
+
+// errFragment message is a fragment of a chunked message, it's delivered
+// with its manifest
+var errFragment = errors.New("message is a fragment")
+
+// Manifest manifest of a chunked message, its fragments are published as
+// separate messages and identified by their hash
+type Manifest struct {
+	// ID hash of whole payload
+	ID   string `json:"id"`
+	Size int    `json:"size"`
+	// Fragments hashes of fragments in order
+	Fragments []string `json:"fragments"`
+}
+
+// hashOf hex encoded sha256 of data
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// split split a payload into fragments of chunk size and their manifest
+func split(data []byte, chunkSize int) ([][]byte, *Manifest) {
+	manifest := &Manifest{ID: hashOf(data), Size: len(data), Fragments: make([]string, 0)}
+	fragments := make([][]byte, 0, len(data)/chunkSize+1)
+	for start := 0; start < len(data); start += chunkSize {
+		end := start + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		fragments = append(fragments, data[start:end])
+		manifest.Fragments = append(manifest.Fragments, hashOf(data[start:end]))
+	}
+	return fragments, manifest
+}
+
+// publishFragments publish fragments of a payload larger than chunk size
+// of its topic, header gets their manifest. Fragments expire with their message
+func (n *Node) publishFragments(ctx context.Context, handle *pubsub.Topic, header *Header, data []byte, chunkSize int) error {
+	fragments, manifest := split(data, chunkSize)
+	for i, fragment := range fragments {
+		raw, err := encodeHeader(&Header{Fragment: manifest.Fragments[i], Expires: header.Expires}, fragment)
+		if err != nil {
+			return err
+		}
+		if err := handle.Publish(ctx, raw); err != nil {
+			return err
+		}
+	}
+	header.Manifest = manifest
+	return nil
+}
+
+// validateChunk validate a fragment or a manifest, fragments are kept for
+// reassembly once they were accepted by every validator. Topics without
+// chunk size refuse both
+func (n *Node) validateChunk(topic string, msg *pubsub.Message) pubsub.ValidationResult {
+	header, payload, err := decodeHeader(msg.GetData())
+	if err != nil {
+		return pubsub.ValidationReject
+	}
+	if header.Fragment == "" && header.Manifest == nil {
+		return pubsub.ValidationAccept
+	}
+	params := n.cfg.topicParams(topic)
+	if err := checkChunk(header, payload, params); err != nil {
+		n.cfg.Logger.Debugf("Reject chunked message of %s from %s: %v", topic, msg.GetFrom(), err)
+		return pubsub.ValidationReject
+	}
+	return pubsub.ValidationAccept
+}
+
+// checkChunk check a fragment or a manifest against parameters of its topic.
+// Fragments are at most MaxChunkSize and at least one byte, so the number of
+// fragments of a manifest must fit its size
+func checkChunk(header *Header, payload []byte, params TopicParams) error {
+	if params.ChunkSize == 0 {
+		return errors.New("chunking is disabled")
+	}
+	if header.Fragment != "" {
+		if header.Manifest != nil || len(payload) == 0 || len(payload) > MaxChunkSize {
+			return errors.New("invalid fragment")
+		}
+		if hashOf(payload) != header.Fragment {
+			return errors.New("hash of fragment mismatch")
+		}
+		return nil
+	}
+	manifest := header.Manifest
+	if len(payload) != 0 {
+		return errors.New("manifest has a payload")
+	}
+	if manifest.Size <= 0 || manifest.Size > params.MaxMessageSize {
+		return fmt.Errorf("invalid size %d", manifest.Size)
+	}
+	count := len(manifest.Fragments)
+	if count == 0 || count > manifest.Size || count < (manifest.Size+MaxChunkSize-1)/MaxChunkSize {
+		return fmt.Errorf("%d fragments don't fit size %d", count, manifest.Size)
+	}
+	for _, hash := range manifest.Fragments {
+		if len(hash) != sha256.Size*2 {
+			return fmt.Errorf("invalid fragment hash %q", hash)
+		}
+	}
+	return nil
+}
+
+// keepFragment keep an accepted fragment for reassembly
+func (n *Node) keepFragment(topic string, msg *pubsub.Message) {
+	header, payload, err := decodeHeader(msg.GetData())
+	if err != nil || header.Fragment == "" {
+		return
+	}
+	if !n.fragments.add(header.Fragment, payload, time.Now()) {
+		n.cfg.Logger.Debugf("Drop fragment of %s from %s: reassembly memory is full", topic, msg.GetFrom())
+	}
+}
+
+// fragment fragment kept for reassembly
+type fragment struct {
+	data       []byte
+	receivedAt time.Time
+}
+
+// fragmentPool fragments of chunked messages by hash, it's shared by all
+// subscriptions of a node. Fragments are dropped after reassembly timeout,
+// the pool is pruned when fragments are added and periodically by run
+type fragmentPool struct {
+	fragments map[string]*fragment
+	size      int
+	limit     int
+	timeout   time.Duration
+	// changed closed when a fragment was added
+	changed chan struct{}
+	mutex   sync.Mutex
+}
+
+// newFragmentPool create an empty pool holding at most limit bytes
+func newFragmentPool(limit int, timeout time.Duration) *fragmentPool {
+	return &fragmentPool{
+		fragments: make(map[string]*fragment),
+		limit:     limit,
+		timeout:   timeout,
+		changed:   make(chan struct{}),
+	}
+}
+
+// add keep a fragment, it returns false if pool is full
+func (p *fragmentPool) add(hash string, data []byte, now time.Time) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.prune(now)
+	if _, ok := p.fragments[hash]; ok {
+		p.fragments[hash].receivedAt = now
+		return true
+	}
+	if p.size+len(data) > p.limit {
+		return false
+	}
+	p.fragments[hash] = &fragment{data: data, receivedAt: now}
+	p.size += len(data)
+	close(p.changed)
+	p.changed = make(chan struct{})
+	return true
+}
+
+// run prune the pool until ctx is done, so fragments of messages which
+// were never completed don't stay once fragments stop coming
+func (p *fragmentPool) run(ctx context.Context) {
+	ticker := time.NewTicker(p.timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.mutex.Lock()
+			p.prune(now)
+			p.mutex.Unlock()
+		}
+	}
+}
+
+// bytes get size of kept fragments
+func (p *fragmentPool) bytes() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.size
+}
+
+// changes get a channel which is closed when the next fragment was added
+func (p *fragmentPool) changes() <-chan struct{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.changed
+}
+
+// prune drop fragments older than timeout. p.mutex must be held
+func (p *fragmentPool) prune(now time.Time) {
+	for hash, f := range p.fragments {
+		if now.Sub(f.receivedAt) > p.timeout {
+			delete(p.fragments, hash)
+			p.size -= len(f.data)
+		}
+	}
+}
+
+// assemble join fragments of a manifest, it returns ErrIncomplete at once
+// if fragments are missing
+func (p *fragmentPool) assemble(manifest *Manifest) ([]byte, error) {
+	p.mutex.Lock()
+	data, complete := p.join(manifest)
+	p.mutex.Unlock()
+	if !complete {
+		return nil, ErrIncomplete
+	}
+	if len(data) != manifest.Size || hashOf(data) != manifest.ID {
+		return nil, fmt.Errorf("fragments don't match manifest %s", manifest.ID)
+	}
+	return data, nil
+}
+
+// join concatenate fragments of a manifest if all of them were received.
+// p.mutex must be held
+func (p *fragmentPool) join(manifest *Manifest) ([]byte, bool) {
+	size := 0
+	for _, hash := range manifest.Fragments {
+		f, ok := p.fragments[hash]
+		if !ok {
+			return nil, false
+		}
+		size += len(f.data)
+	}
+	if size != manifest.Size {
+		return nil, true
+	}
+	var buffer bytes.Buffer
+	buffer.Grow(size)
+	for _, hash := range manifest.Fragments {
+		buffer.Write(p.fragments[hash].data)
+	}
+	return buffer.Bytes(), true
+}
@@ -0,0 +1,239 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+func TestSplit(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	for _, chunkSize := range []int{1, 7, 100, 999, 1000, 4096} {
+		fragments, manifest := split(data, chunkSize)
+		if manifest.Size != len(data) || manifest.ID != hashOf(data) || len(manifest.Fragments) != len(fragments) {
+			t.Fatalf("chunk size %d: invalid manifest %+v", chunkSize, manifest)
+		}
+		if expected := (len(data) + chunkSize - 1) / chunkSize; len(fragments) != expected {
+			t.Fatalf("chunk size %d: %d fragments, expected %d", chunkSize, len(fragments), expected)
+		}
+		for i, fragment := range fragments {
+			if len(fragment) > chunkSize || hashOf(fragment) != manifest.Fragments[i] {
+				t.Fatalf("chunk size %d: invalid fragment %d", chunkSize, i)
+			}
+		}
+		if !bytes.Equal(bytes.Join(fragments, nil), data) {
+			t.Fatalf("chunk size %d: fragments don't join to payload", chunkSize)
+		}
+	}
+}
+
+func TestFragmentPoolAssemble(t *testing.T) {
+	pool := newFragmentPool(1<<20, time.Minute)
+	// Fragments of a repeating payload would share their hash
+	data := make([]byte, 8000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	fragments, manifest := split(data, 1000)
+	now := time.Now()
+	for i, fragment := range fragments {
+		if _, err := pool.assemble(manifest); err != ErrIncomplete {
+			t.Fatalf("assembled with %d of %d fragments: %v", i, len(fragments), err)
+		}
+		changed := pool.changes()
+		if !pool.add(manifest.Fragments[i], fragment, now) {
+			t.Fatal("fragment was not kept")
+		}
+		select {
+		case <-changed:
+		default:
+			t.Fatal("added fragment was not signaled")
+		}
+	}
+	assembled, err := pool.assemble(manifest)
+	if err != nil || !bytes.Equal(assembled, data) {
+		t.Fatalf("payload was not assembled: %v", err)
+	}
+	// Fragments are kept for other subscriptions
+	if _, err := pool.assemble(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fragments which don't join to the payload of manifest are refused
+	forged := *manifest
+	forged.Size--
+	if _, err := pool.assemble(&forged); err == nil || err == ErrIncomplete {
+		t.Fatalf("payload of forged size was assembled: %v", err)
+	}
+	forged = *manifest
+	forged.ID = hashOf([]byte("other"))
+	if _, err := pool.assemble(&forged); err == nil || err == ErrIncomplete {
+		t.Fatalf("payload of forged ID was assembled: %v", err)
+	}
+}
+
+func TestFragmentPoolLimits(t *testing.T) {
+	pool := newFragmentPool(100, time.Minute)
+	now := time.Now()
+	first, second := bytes.Repeat([]byte{1}, 60), bytes.Repeat([]byte{2}, 60)
+	if !pool.add(hashOf(first), first, now) {
+		t.Fatal("fragment was not kept")
+	}
+	if pool.add(hashOf(second), second, now) {
+		t.Fatal("fragment beyond reassembly memory was kept")
+	}
+	// Fragments older than timeout are pruned, which frees memory
+	if !pool.add(hashOf(second), second, now.Add(2*time.Minute)) {
+		t.Fatal("memory of timed out fragment was not freed")
+	}
+	if _, ok := pool.fragments[hashOf(first)]; ok || pool.size != len(second) {
+		t.Fatalf("timed out fragment was kept, pool holds %d bytes", pool.size)
+	}
+	pool.mutex.Lock()
+	pool.prune(now.Add(4 * time.Minute))
+	pool.mutex.Unlock()
+	if len(pool.fragments) != 0 || pool.size != 0 {
+		t.Fatalf("pool holds %d fragments of %d bytes after timeout", len(pool.fragments), pool.size)
+	}
+}
+
+func TestCheckChunk(t *testing.T) {
+	chunked := TopicParams{ChunkSize: 1024, MaxMessageSize: 4 << 20}.withDefaults()
+	hash := strings.Repeat("a", 64)
+	fragment := []byte("fragment")
+	valid := []*Header{
+		{Fragment: hashOf(fragment)},
+		{Manifest: &Manifest{ID: hash, Size: 100, Fragments: []string{hash, hash}}},
+		{Manifest: &Manifest{ID: hash, Size: 4 << 20, Fragments: []string{hash, hash, hash, hash, hash, hash, hash, hash}}},
+	}
+	for _, header := range valid {
+		payload := fragment
+		if header.Manifest != nil {
+			payload = nil
+		}
+		if err := checkChunk(header, payload, chunked); err != nil {
+			t.Fatalf("valid header %+v: %v", header, err)
+		}
+		if err := checkChunk(header, payload, TopicParams{}.withDefaults()); err == nil {
+			t.Fatalf("header %+v was accepted on a topic without chunking", header)
+		}
+	}
+
+	invalid := map[string]struct {
+		header  *Header
+		payload []byte
+	}{
+		"hash mismatch":       {&Header{Fragment: hash}, fragment},
+		"empty fragment":      {&Header{Fragment: hashOf(nil)}, nil},
+		"oversized fragment":  {&Header{Fragment: hashOf(make([]byte, MaxChunkSize+1))}, make([]byte, MaxChunkSize+1)},
+		"fragment manifest":   {&Header{Fragment: hashOf(fragment), Manifest: &Manifest{ID: hash, Size: 8, Fragments: []string{hash}}}, fragment},
+		"manifest payload":    {&Header{Manifest: &Manifest{ID: hash, Size: 8, Fragments: []string{hash}}}, fragment},
+		"empty manifest":      {&Header{Manifest: &Manifest{ID: hash, Size: 0}}, nil},
+		"too large":           {&Header{Manifest: &Manifest{ID: hash, Size: 8 << 20, Fragments: []string{hash}}}, nil},
+		"no fragments":        {&Header{Manifest: &Manifest{ID: hash, Size: 100}}, nil},
+		"too many fragments":  {&Header{Manifest: &Manifest{ID: hash, Size: 1, Fragments: []string{hash, hash}}}, nil},
+		"too few fragments":   {&Header{Manifest: &Manifest{ID: hash, Size: MaxChunkSize + 1, Fragments: []string{hash}}}, nil},
+		"invalid fragment ID": {&Header{Manifest: &Manifest{ID: hash, Size: 100, Fragments: []string{"x"}}}, nil},
+	}
+	for name, c := range invalid {
+		if err := checkChunk(c.header, c.payload, chunked); err == nil {
+			t.Fatalf("%s was accepted", name)
+		}
+	}
+}
+
+// testReceiver receiver of a topic with chunking which is driven by the test
+func testReceiver(t *testing.T) *receiver {
+	cfg := testConfig(t, ConfigureTopic("files", TopicParams{ChunkSize: 1024}), Reassembly(1<<20, time.Minute))
+	n := &Node{cfg: cfg, log: cfg.Logger, fragments: newFragmentPool(cfg.ReassemblyMemory, cfg.ReassemblyTimeout), queues: &queueCounters{}}
+	return &receiver{node: n, topic: "files"}
+}
+
+// chunkedMessage fragments and manifest message of a payload
+func chunkedMessage(t *testing.T, from peer.ID, data []byte) ([][]byte, *Manifest, *pubsub.Message) {
+	fragments, manifest := split(data, 1024)
+	raw, err := encodeHeader(&Header{Manifest: manifest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fragments, manifest, &pubsub.Message{Message: &pb.Message{From: []byte(from), Data: raw}}
+}
+
+func TestReceiverPending(t *testing.T) {
+	r := testReceiver(t)
+	now := time.Now()
+	data := bytes.Repeat([]byte("chunked"), 1000)
+	fragments, manifest, msg := chunkedMessage(t, "a", data)
+
+	// Incomplete messages wait without holding back others
+	if ready := r.receive(msg, now); len(ready) != 0 || len(r.pending) != 1 {
+		t.Fatalf("incomplete message is ready or not pending")
+	}
+	plain := &pubsub.Message{Message: &pb.Message{From: []byte("a"), Data: []byte("plain")}}
+	if ready := r.receive(plain, now); len(ready) != 1 || string(ready[0].Data) != "plain" {
+		t.Fatal("plain message was held back")
+	}
+	for i, fragment := range fragments[:len(fragments)-1] {
+		r.node.fragments.add(manifest.Fragments[i], fragment, now)
+	}
+	if ready := r.retry(now); len(ready) != 0 || len(r.pending) != 1 {
+		t.Fatal("message with a missing fragment is ready or not pending")
+	}
+	if stats := r.node.QueueStats(); stats.Reassembling != 1 || stats.FragmentBytes == 0 {
+		t.Fatalf("queue stats %+v while a fragment is missing", stats)
+	}
+	last := len(fragments) - 1
+	r.node.fragments.add(manifest.Fragments[last], fragments[last], now)
+	ready := r.retry(now)
+	if len(ready) != 1 || !bytes.Equal(ready[0].Data, data) || len(r.pending) != 0 {
+		t.Fatal("completed message was not assembled")
+	}
+}
+
+func TestReceiverPendingLimits(t *testing.T) {
+	r := testReceiver(t)
+	now := time.Now()
+	for i := 0; i < maxPendingManifests+4; i++ {
+		_, _, msg := chunkedMessage(t, "a", bytes.Repeat([]byte{byte(i)}, 2000))
+		r.receive(msg, now)
+	}
+	if len(r.pending) != maxPendingManifests {
+		t.Fatalf("%d messages of a publisher are pending, expected %d", len(r.pending), maxPendingManifests)
+	}
+	// Other publishers have their own limit
+	_, _, msg := chunkedMessage(t, "b", []byte(strings.Repeat("b", 2000)))
+	r.receive(msg, now)
+	if len(r.pending) != maxPendingManifests+1 {
+		t.Fatal("message of another publisher was dropped")
+	}
+
+	// Messages which are still incomplete after reassembly timeout are dropped
+	if ready := r.retry(now.Add(time.Minute - time.Second)); len(ready) != 0 || len(r.pending) != maxPendingManifests+1 {
+		t.Fatal("pending messages were dropped before reassembly timeout")
+	}
+	if ready := r.retry(now.Add(time.Minute)); len(ready) != 0 || len(r.pending) != 0 {
+		t.Fatalf("%d messages are pending after reassembly timeout", len(r.pending))
+	}
+	if stats := r.node.QueueStats(); stats.Reassembling != 0 {
+		t.Fatalf("%d messages are reassembling after reassembly timeout", stats.Reassembling)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encodings of compressed payloads
+const (
+	EncodingGzip   = "gzip"
+	EncodingZstd   = "zstd"
+	EncodingSnappy = "snappy"
+)
+
+// Defaults of compression
+const (
+	// DefaultCompressMin payloads smaller than it are not compressed
+	DefaultCompressMin = 1024
+	// DefaultMaxDecompressed largest decompressed payload
+	DefaultMaxDecompressed = 8 << 20
+)
+
+// Errors of compression
+var (
+	ErrUnknownEncoding = errors.New("unknown payload encoding")
+	ErrTooLarge        = errors.New("decompressed payload is too large")
+)
+
+var (
+	// zstdEncoder shared zstd encoder, EncodeAll is safe for concurrent use
+	zstdEncoder     *zstd.Encoder
+	zstdEncoderErr  error
+	zstdEncoderOnce sync.Once
+)
+
+// checkEncoding check if an encoding is supported, empty encoding means
+// payloads are not compressed
+func checkEncoding(encoding string) error {
+	switch encoding {
+	case "", EncodingGzip, EncodingZstd, EncodingSnappy:
+		return nil
+	}
+	return fmt.Errorf("%w %q", ErrUnknownEncoding, encoding)
+}
+
+// compressMessage compress payload of a message if its topic has compression
+// and payload is large enough, it returns encoding of compressed payload.
+// Payloads which don't shrink are published as they are, payloads larger than
+// max decompressed size of topic are refused
+func (c *Config) compressMessage(topic string, data []byte) ([]byte, string, error) {
+	params := c.topicParams(topic)
+	if params.Compression == "" || len(data) < params.CompressMin {
+		return data, "", nil
+	}
+	// Subscribers would drop it once decompressed
+	if len(data) > params.MaxDecompressed {
+		return nil, "", ErrMessageTooLarge
+	}
+	compressed, err := compress(params.Compression, data)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(compressed) >= len(data) {
+		return data, "", nil
+	}
+	return compressed, params.Compression, nil
+}
+
+// decompressMessage decompress payload of a message of a topic, payloads
+// decompressing to more than max decompressed size of topic are refused
+func (c *Config) decompressMessage(topic string, encoding string, data []byte) ([]byte, error) {
+	if encoding == "" {
+		return data, nil
+	}
+	return decompress(encoding, data, c.topicParams(topic).MaxDecompressed)
+}
+
+// compress compress data with an encoding
+func compress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case EncodingGzip:
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	case EncodingZstd:
+		zstdEncoderOnce.Do(func() {
+			zstdEncoder, zstdEncoderErr = zstd.NewWriter(nil)
+		})
+		if zstdEncoderErr != nil {
+			return nil, zstdEncoderErr
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case EncodingSnappy:
+		return snappy.Encode(nil, data), nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownEncoding, encoding)
+}
+
+// decompress decompress data with an encoding, at most max bytes are
+// decompressed so small bombs can't exhaust memory
+func decompress(encoding string, data []byte, max int) ([]byte, error) {
+	switch encoding {
+	case EncodingGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return readLimited(reader, max)
+	case EncodingZstd:
+		reader, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(max)))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return readLimited(reader, max)
+	case EncodingSnappy:
+		size, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if size > max {
+			return nil, ErrTooLarge
+		}
+		return snappy.Decode(nil, data)
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownEncoding, encoding)
+}
+
+// readLimited read at most max bytes from reader
+func readLimited(reader io.Reader, max int) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(reader, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > max {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+var encodings = []string{EncodingGzip, EncodingZstd, EncodingSnappy}
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"symbol": "BTC", "price": 100}`), 1000)
+	for _, encoding := range encodings {
+		compressed, err := compress(encoding, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(compressed) >= len(data) {
+			t.Fatalf("%s did not compress", encoding)
+		}
+		decompressed, err := decompress(encoding, compressed, len(data))
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Fatalf("%s changed payload", encoding)
+		}
+	}
+}
+
+func TestDecompressBomb(t *testing.T) {
+	// A few KiB expanding to 64 MiB must be refused before it's inflated
+	bomb := make([]byte, 64<<20)
+	for _, encoding := range encodings {
+		compressed, err := compress(encoding, bomb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decompress(encoding, compressed, DefaultMaxDecompressed); !errors.Is(err, ErrTooLarge) {
+			t.Fatalf("%s bomb of %d bytes: %v", encoding, len(compressed), err)
+		}
+		// Exactly max decompressed size is allowed
+		if _, err := decompress(encoding, compressed, len(bomb)); err != nil {
+			t.Fatalf("%s payload of max size: %v", encoding, err)
+		}
+	}
+}
+
+func TestDecompressInvalid(t *testing.T) {
+	for _, encoding := range encodings {
+		if _, err := decompress(encoding, []byte("not compressed"), DefaultMaxDecompressed); err == nil {
+			t.Fatalf("%s decompressed garbage", encoding)
+		}
+	}
+	if _, err := decompress("brotli", []byte("data"), DefaultMaxDecompressed); !errors.Is(err, ErrUnknownEncoding) {
+		t.Fatalf("unknown encoding: %v", err)
+	}
+}
+
+func TestCompressMessage(t *testing.T) {
+	cfg := testConfig(t,
+		ConfigureTopic("telemetry/#", TopicParams{Compression: EncodingZstd, CompressMin: 512, MaxDecompressed: 1 << 20}),
+	)
+	large := bytes.Repeat([]byte("metric "), 1000)
+	compressed, encoding, err := cfg.compressMessage("telemetry/cpu", large)
+	if err != nil || encoding != EncodingZstd {
+		t.Fatalf("payload was not compressed: %v", err)
+	}
+	decompressed, err := cfg.decompressMessage("telemetry/cpu", encoding, compressed)
+	if err != nil || !bytes.Equal(decompressed, large) {
+		t.Fatalf("payload was not decompressed: %v", err)
+	}
+
+	// Small, incompressible payloads and topics without compression are kept as they are
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	for topic, data := range map[string][]byte{"telemetry/cpu": random, "telemetry/mem": []byte("small"), "orders": large} {
+		kept, encoding, err := cfg.compressMessage(topic, data)
+		if err != nil || encoding != "" || !bytes.Equal(kept, data) {
+			t.Fatalf("payload of %d bytes of %s was compressed with %q: %v", len(data), topic, encoding, err)
+		}
+	}
+
+	// Payloads subscribers would not decompress are refused
+	if _, _, err := cfg.compressMessage("telemetry/cpu", make([]byte, 1<<20+1)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("payload larger than max decompressed size was compressed: %v", err)
+	}
+
+	// Max decompressed size of topic applies whatever encoding publisher used
+	bomb, err := compress(EncodingGzip, make([]byte, 2<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.decompressMessage("telemetry/cpu", EncodingGzip, bomb); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("payload larger than max decompressed size of topic: %v", err)
+	}
+	if _, err := cfg.decompressMessage("orders", EncodingGzip, bomb); err != nil {
+		t.Fatalf("payload within default max decompressed size: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+// Identities of messages used to detect duplicates
+const (
+	// DedupSeqno publisher and sequence number, only redundant copies of
+	// the same publish are duplicates. It's the gossipsub default
+	DedupSeqno = "seqno"
+	// DedupContent hash of topic and payload, messages with the same
+	// payload are duplicates whoever published them
+	DedupContent = "content"
+	// DedupKey key given by publisher e.g: an envelope or order ID,
+	// messages without key are identified by publisher and sequence number
+	DedupKey = "key"
+)
+
+// DefaultDedupWindow time a message ID is remembered by topics with dedup
+const DefaultDedupWindow = 10 * time.Minute
+
+// MaxKeyLength maximum length of message keys
+const MaxKeyLength = 256
+
+// ErrKeyTooLong message key is longer than MaxKeyLength
+var ErrKeyTooLong = fmt.Errorf("message key is longer than %d bytes", MaxKeyLength)
+
+// maxDedupIDs maximum number of IDs a dedup cache remembers
+const maxDedupIDs = 1 << 18
+
+// dedupCache IDs of accepted messages of topics with dedup, gossipsub only
+// remembers messages for two minutes so later retries would get through.
+// Once it holds limit IDs, the oldest ones are forgotten before their window
+// is over
+type dedupCache struct {
+	seen   map[string]*list.Element
+	order  *list.List
+	limit  int
+	pruned time.Time
+	mutex  sync.Mutex
+}
+
+// dedupEntry ID remembered by a dedup cache until its expiry
+type dedupEntry struct {
+	id     string
+	expiry time.Time
+}
+
+// newDedupCache create an empty dedup cache remembering at most limit IDs
+func newDedupCache(limit int) *dedupCache {
+	return &dedupCache{seen: make(map[string]*list.Element), order: list.New(), limit: limit, pruned: time.Now()}
+}
+
+// add remember an ID until window is over, it returns false if the ID was
+// already remembered
+func (c *dedupCache) add(id string, window time.Duration, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now.Sub(c.pruned) >= time.Minute {
+		for seenID, elem := range c.seen {
+			if !now.Before(elem.Value.(*dedupEntry).expiry) {
+				c.order.Remove(elem)
+				delete(c.seen, seenID)
+			}
+		}
+		c.pruned = now
+	}
+	if elem, ok := c.seen[id]; ok {
+		entry := elem.Value.(*dedupEntry)
+		if now.Before(entry.expiry) {
+			return false
+		}
+		entry.expiry = now.Add(window)
+		c.order.MoveToBack(elem)
+		return true
+	}
+	for c.order.Len() >= c.limit {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.seen, oldest.Value.(*dedupEntry).id)
+	}
+	c.seen[id] = c.order.PushBack(&dedupEntry{id: id, expiry: now.Add(window)})
+	return true
+}
+
+// contains check if an ID is remembered
+func (c *dedupCache) contains(id string, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.seen[id]
+	return ok && now.Before(elem.Value.(*dedupEntry).expiry)
+}
+
+// messageID identity of a gossipsub message, it's the message ID function
+// of gossipsub so all nodes must agree on dedup of topics
+func (n *Node) messageID(msg *pb.Message) string {
+	if len(msg.GetTopicIDs()) == 0 {
+		return pubsub.DefaultMsgIdFn(msg)
+	}
+	topic := msg.GetTopicIDs()[0]
+	id := contentID(topic, n.cfg.topicParams(topic).Dedup, msg.GetData())
+	if id == "" {
+		return pubsub.DefaultMsgIdFn(msg)
+	}
+	return id
+}
+
+// contentID identity of a message which doesn't depend on its publish,
+// it's empty if messages of topic are identified by sequence number
+func contentID(topic string, dedup string, data []byte) string {
+	header, payload, err := decodeHeader(data)
+	if err != nil || header.Fragment != "" {
+		// Fragments of chunked messages are identified by sequence number,
+		// equal fragments of different messages are no duplicates
+		return ""
+	}
+	switch dedup {
+	case DedupContent:
+		hash := sha256.New()
+		hash.Write([]byte(topic))
+		if header.Manifest != nil {
+			// Payload of a chunked message is identified by its manifest
+			hash.Write([]byte{1})
+			hash.Write([]byte(header.Manifest.ID))
+		} else {
+			hash.Write([]byte{0})
+			hash.Write(payload)
+		}
+		return "content:" + hex.EncodeToString(hash.Sum(nil))
+	case DedupKey:
+		if header.Key == "" {
+			return ""
+		}
+		return fmt.Sprintf("key:%s:%s", topic, header.Key)
+	}
+	return ""
+}
+
+// deduplicate check if a message of a topic with dedup was accepted within
+// dedup window, messages of other topics are never duplicates
+func (n *Node) deduplicate(topic string, msg *pubsub.Message) bool {
+	params := n.cfg.topicParams(topic)
+	id := contentID(topic, params.Dedup, msg.GetData())
+	if id == "" {
+		return false
+	}
+	return !n.dedup.add(id, time.Duration(params.DedupWindow), time.Now())
+}
+
+// isDuplicate check if a message recovered from a publisher was already
+// delivered, retries of ordered topics take a new sequence number
+func (n *Node) isDuplicate(topic string, data []byte) bool {
+	id := contentID(topic, n.cfg.topicParams(topic).Dedup, data)
+	return id != "" && n.dedup.contains(id, time.Now())
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+func TestContentID(t *testing.T) {
+	plain := []byte("payload")
+	keyed, err := encodeHeader(&Header{Key: "order-1", Seq: 1}, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retried, err := encodeHeader(&Header{Key: "order-1", Seq: 2}, []byte("other payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := contentID("orders", DedupSeqno, plain); id != "" {
+		t.Fatalf("seqno dedup has content ID %q", id)
+	}
+	if id := contentID("orders", DedupKey, plain); id != "" {
+		t.Fatalf("message without key has key ID %q", id)
+	}
+	if contentID("orders", DedupKey, keyed) != contentID("orders", DedupKey, retried) {
+		t.Fatal("retries with the same key have different IDs")
+	}
+	if contentID("orders", DedupKey, keyed) == contentID("invoices", DedupKey, keyed) {
+		t.Fatal("keys of different topics have the same ID")
+	}
+	// Content IDs ignore header of message but not its topic
+	if contentID("orders", DedupContent, plain) != contentID("orders", DedupContent, keyed) {
+		t.Fatal("equal payloads have different content IDs")
+	}
+	if contentID("orders", DedupContent, plain) == contentID("invoices", DedupContent, plain) {
+		t.Fatal("payloads of different topics have the same content ID")
+	}
+	if contentID("orders", DedupContent, plain) == contentID("orders", DedupContent, []byte("other payload")) {
+		t.Fatal("different payloads have the same content ID")
+	}
+}
+
+func TestContentIDChunks(t *testing.T) {
+	fragments, manifest := split([]byte(strings.Repeat("chunk", 100)), 64)
+	fragment, err := encodeHeader(&Header{Fragment: manifest.Fragments[0]}, fragments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := contentID("files", DedupContent, fragment); id != "" {
+		t.Fatalf("fragment has content ID %q", id)
+	}
+	first, err := encodeHeader(&Header{Manifest: manifest, Seq: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := encodeHeader(&Header{Manifest: manifest, Seq: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentID("files", DedupContent, first) != contentID("files", DedupContent, second) {
+		t.Fatal("manifests of the same payload have different content IDs")
+	}
+	// A manifest is not a duplicate of a plain message carrying its ID
+	if contentID("files", DedupContent, first) == contentID("files", DedupContent, []byte(manifest.ID)) {
+		t.Fatal("manifest has the content ID of a plain message")
+	}
+}
+
+func TestMessageID(t *testing.T) {
+	cfg := testConfig(t, ConfigureTopic("orders", TopicParams{Dedup: DedupContent}))
+	n := &Node{cfg: cfg, dedup: newDedupCache(maxDedupIDs)}
+	first := &pb.Message{From: []byte("a"), Seqno: []byte{1}, Data: []byte("payload"), TopicIDs: []string{"orders"}}
+	second := &pb.Message{From: []byte("b"), Seqno: []byte{2}, Data: []byte("payload"), TopicIDs: []string{"orders"}}
+	if n.messageID(first) != n.messageID(second) {
+		t.Fatal("equal payloads of a content dedup topic have different message IDs")
+	}
+	first.TopicIDs, second.TopicIDs = []string{"events"}, []string{"events"}
+	if n.messageID(first) != pubsub.DefaultMsgIdFn(first) || n.messageID(first) == n.messageID(second) {
+		t.Fatal("messages of topics without dedup are not identified by publisher and sequence number")
+	}
+
+	msg := &pubsub.Message{Message: &pb.Message{Data: []byte("payload")}}
+	if n.deduplicate("orders", msg) {
+		t.Fatal("first message is a duplicate")
+	}
+	if !n.deduplicate("orders", msg) {
+		t.Fatal("second message is not a duplicate")
+	}
+	if !n.isDuplicate("orders", []byte("payload")) || n.isDuplicate("orders", []byte("other")) {
+		t.Fatal("recovered messages are not checked against accepted ones")
+	}
+	if n.deduplicate("events", msg) || n.deduplicate("events", msg) {
+		t.Fatal("messages of topics without dedup are duplicates")
+	}
+}
+
+func TestDedupCache(t *testing.T) {
+	cache := newDedupCache(16)
+	now := time.Now()
+	if !cache.add("id", time.Minute, now) {
+		t.Fatal("new ID was remembered")
+	}
+	if cache.add("id", time.Minute, now.Add(30*time.Second)) {
+		t.Fatal("ID was forgotten within window")
+	}
+	if !cache.contains("id", now.Add(59*time.Second)) || cache.contains("id", now.Add(time.Minute)) {
+		t.Fatal("ID is not remembered for its window")
+	}
+	if !cache.add("id", time.Minute, now.Add(2*time.Minute)) {
+		t.Fatal("ID was remembered after window")
+	}
+	// Expired IDs are pruned
+	cache.add("other", time.Second, now)
+	cache.add("late", time.Second, now.Add(time.Hour))
+	if _, ok := cache.seen["other"]; ok {
+		t.Fatal("expired ID was not pruned")
+	}
+}
+
+func TestDedupCacheLimit(t *testing.T) {
+	cache := newDedupCache(3)
+	now := time.Now()
+	for _, id := range []string{"a", "b", "c"} {
+		cache.add(id, time.Hour, now)
+	}
+	// Full cache forgets its oldest ID
+	cache.add("d", time.Hour, now)
+	if len(cache.seen) != 3 || cache.order.Len() != 3 {
+		t.Fatalf("cache holds %d IDs, expected 3", len(cache.seen))
+	}
+	if cache.contains("a", now) {
+		t.Fatal("oldest ID was not evicted")
+	}
+	for _, id := range []string{"b", "c", "d"} {
+		if !cache.contains(id, now) {
+			t.Fatalf("ID %s was evicted", id)
+		}
+	}
+	// Renewed ID is the newest one
+	later := now.Add(2 * time.Hour)
+	cache.add("b", time.Hour, later)
+	cache.add("e", time.Hour, later)
+	if cache.contains("c", now) || !cache.contains("b", later) {
+		t.Fatal("renewed ID was evicted before older ones")
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// DirectProtocol protocol of streams carrying envelopes sent to a peer
+const DirectProtocol = protocol.ID("/p2sub/direct/1.0.0")
+
+// ErrNoDirectHandler remote node doesn't accept direct envelopes
+var ErrNoDirectHandler = errors.New("no direct handler")
+
+// Envelope message sent directly to a peer
+type Envelope struct {
+	ID string `json:"id"`
+	// From sender peer, it's set by receiver from the stream
+	From peer.ID `json:"-"`
+	// Sender address of sender inside its node e.g: a gateway client
+	Sender string `json:"sender,omitempty"`
+	// To address of recipient inside remote node, empty means the node itself
+	To   string `json:"to,omitempty"`
+	Data []byte `json:"data"`
+}
+
+// ack acknowledgement of an envelope, Error is set if it was not accepted
+type ack struct {
+	ID    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// DirectHandler handle an envelope received from a peer, returned error is
+// sent back to sender in acknowledgement
+type DirectHandler func(ctx context.Context, env *Envelope) error
+
+// HandleDirect set handler of envelopes addressed to the node itself, it
+// replaces previous handler
+func (n *Node) HandleDirect(handler DirectHandler) {
+	n.mutex.Lock()
+	n.directHandler = handler
+	n.mutex.Unlock()
+}
+
+// HandleRecipients set handler of envelopes addressed to a recipient inside
+// the node e.g: a gateway client, it replaces previous handler
+func (n *Node) HandleRecipients(handler DirectHandler) {
+	n.mutex.Lock()
+	n.recipientHandler = handler
+	n.mutex.Unlock()
+}
+
+// Send send an envelope directly to a peer and wait for its acknowledgement,
+// ID of envelope is generated if it's empty. Envelopes sent to the node
+// itself are handled without a stream
+func (n *Node) Send(ctx context.Context, to peer.ID, env *Envelope) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.cfg.RequestTimeout)
+		defer cancel()
+	}
+	if n.host == nil {
+		return ErrNotStarted
+	}
+	if env.ID == "" {
+		id, err := newRequestID()
+		if err != nil {
+			return err
+		}
+		env.ID = id
+	}
+	if to == n.host.ID() {
+		env.From = to
+		return n.deliverDirect(env)
+	}
+	stream, err := n.host.NewStream(ctx, to, DirectProtocol)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	if err := writeFrame(stream, env); err != nil {
+		stream.Reset()
+		return err
+	}
+	var received ack
+	if err := readFrame(bufio.NewReader(stream), &received); err != nil {
+		stream.Reset()
+		return fmt.Errorf("no acknowledgement from %s: %w", to.Pretty(), err)
+	}
+	helpers.FullClose(stream)
+	if received.ID != env.ID {
+		return fmt.Errorf("acknowledgement of unknown envelope %s from %s", received.ID, to.Pretty())
+	}
+	if received.Error != "" {
+		return &RemoteError{From: to, Message: received.Error}
+	}
+	return nil
+}
+
+// handleDirect stream handler of direct envelopes, each envelope of the
+// stream is acknowledged after it was handled
+func (n *Node) handleDirect(stream network.Stream) {
+	from := stream.Conn().RemotePeer()
+	reader := bufio.NewReader(stream)
+	for {
+		// Each envelope has request timeout to arrive and to be handled, idle
+		// or stalled streams are reset
+		stream.SetDeadline(time.Now().Add(n.cfg.RequestTimeout))
+		var env Envelope
+		if err := readFrame(reader, &env); err != nil {
+			if err != io.EOF {
+				n.log.Debugf("Invalid envelope from %s: %v", from, err)
+				stream.Reset()
+				return
+			}
+			helpers.FullClose(stream)
+			return
+		}
+		env.From = from
+		reply := ack{ID: env.ID}
+		if err := n.deliverDirect(&env); err != nil {
+			reply.Error = err.Error()
+		}
+		stream.SetDeadline(time.Now().Add(n.cfg.RequestTimeout))
+		if err := writeFrame(stream, reply); err != nil {
+			stream.Reset()
+			return
+		}
+	}
+}
+
+// deliverDirect give an envelope to direct handler of the node, or to
+// recipient handler if it's addressed to a recipient inside the node
+func (n *Node) deliverDirect(env *Envelope) error {
+	if env.From != n.host.ID() && !n.cfg.PeerRateLimit.Allow(string(env.From)) {
+		return n.throttled(ScopePeer, env.From.Pretty(), "")
+	}
+	n.mutex.Lock()
+	handler := n.directHandler
+	if env.To != "" {
+		handler = n.recipientHandler
+	}
+	n.mutex.Unlock()
+	if handler == nil {
+		return ErrNoDirectHandler
+	}
+	ctx, cancel := context.WithTimeout(n.ctx, n.cfg.RequestTimeout)
+	defer cancel()
+	return handler(ctx, env)
+}
+
+// writeFrame write a JSON value prefixed by its uvarint length
+func writeFrame(w io.Writer, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, binary.MaxVarintLen64)
+	size := binary.PutUvarint(prefix, uint64(len(data)))
+	if _, err := w.Write(append(prefix[:size], data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readFrame read a frame written by writeFrame, frames are limited to max
+// message size of gossipsub
+func readFrame(r *bufio.Reader, value interface{}) error {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	if size > pubsub.DefaultMaxMessageSize {
+		return fmt.Errorf("frame of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/p2sub/p2sub/harness"
+	"github.com/p2sub/p2sub/node"
+)
+
+// envelopeHandler direct handler passing envelopes to a channel
+func envelopeHandler(received chan<- *node.Envelope) node.DirectHandler {
+	return func(ctx context.Context, env *node.Envelope) error {
+		if string(env.Data) == "fail" {
+			return errors.New("refused")
+		}
+		received <- env
+		return nil
+	}
+}
+
+// awaitEnvelope wait for an envelope handled by a node
+func awaitEnvelope(t *testing.T, received <-chan *node.Envelope) *node.Envelope {
+	t.Helper()
+	select {
+	case env := <-received:
+		return env
+	case <-time.After(5 * time.Second):
+		t.Fatal("envelope was not handled")
+		return nil
+	}
+}
+
+func TestSendDirect(t *testing.T) {
+	h, err := harness.New(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Connect(harness.FullMesh); err != nil {
+		t.Fatal(err)
+	}
+	sender, receiver := h.Node(0), h.Node(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Nodes without handler refuse envelopes
+	err = sender.Send(ctx, receiver.ID(), &node.Envelope{Data: []byte("hello")})
+	var remote *node.RemoteError
+	if !errors.As(err, &remote) || remote.Message != node.ErrNoDirectHandler.Error() {
+		t.Fatalf("envelope to a node without handler returned %v", err)
+	}
+
+	// Envelopes addressed to a peer only go to direct handler of its node,
+	// envelopes naming a recipient go to recipient handler
+	direct, recipients := make(chan *node.Envelope, 1), make(chan *node.Envelope, 1)
+	receiver.HandleDirect(envelopeHandler(direct))
+	receiver.HandleRecipients(envelopeHandler(recipients))
+	if err := sender.Send(ctx, receiver.ID(), &node.Envelope{Sender: "3", Data: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	env := awaitEnvelope(t, direct)
+	if env.From != sender.ID() || env.Sender != "3" || env.To != "" || string(env.Data) != "hello" || env.ID == "" {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+	if err := sender.Send(ctx, receiver.ID(), &node.Envelope{To: "7", Data: []byte("psst")}); err != nil {
+		t.Fatal(err)
+	}
+	if env := awaitEnvelope(t, recipients); env.To != "7" || string(env.Data) != "psst" {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+
+	// Errors of handler are sent back in acknowledgement
+	err = sender.Send(ctx, receiver.ID(), &node.Envelope{Data: []byte("fail")})
+	if !errors.As(err, &remote) || remote.From != receiver.ID() || remote.Message != "refused" {
+		t.Fatalf("refused envelope returned %v", err)
+	}
+}
+
+func TestSendDirectToItself(t *testing.T) {
+	h, err := harness.New(context.Background(), 1, node.PeerRateLimit(0.001, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	n := h.Node(0)
+	direct := make(chan *node.Envelope, 2)
+	n.HandleDirect(envelopeHandler(direct))
+	// Envelopes of the node itself are not limited by its peer limit
+	for i := 0; i < 2; i++ {
+		if err := n.Send(context.Background(), n.ID(), &node.Envelope{Data: []byte("note")}); err != nil {
+			t.Fatal(err)
+		}
+		if env := awaitEnvelope(t, direct); env.From != n.ID() {
+			t.Fatalf("envelope of the node itself is from %s", env.From)
+		}
+	}
+}
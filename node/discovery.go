@@ -0,0 +1,70 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	mdns "github.com/libp2p/go-libp2p/p2p/discovery"
+	"go.uber.org/zap"
+)
+
+// Discovery modes
+const (
+	DiscoveryDHT  = "dht"
+	DiscoveryMDNS = "mdns"
+)
+
+// checkDiscoveryModes make sure all given discovery modes are supported
+func checkDiscoveryModes(modes []string) error {
+	for _, mode := range modes {
+		if mode != DiscoveryDHT && mode != DiscoveryMDNS {
+			return fmt.Errorf("unsupported discovery mode: %s", mode)
+		}
+	}
+	return nil
+}
+
+// mdnsServiceTag turn domain to a valid mDNS service tag,
+// e.g: P2Sub::alpha::0.0.1 -> _p2sub-alpha-0-0-1._udp
+func mdnsServiceTag(domain string) string {
+	label := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(domain))
+	// Collapse separators, `::` would become `--`
+	for strings.Contains(label, "--") {
+		label = strings.ReplaceAll(label, "--", "-")
+	}
+	return "_" + strings.Trim(label, "-") + "._udp"
+}
+
+// startMdnsDiscovery advertise current node and feed peers found in local network to notifee
+func startMdnsDiscovery(ctx context.Context, host host.Host, domain string, interval time.Duration, notifee mdns.Notifee, log *zap.SugaredLogger) (mdns.Service, error) {
+	serviceTag := mdnsServiceTag(domain)
+	service, err := mdns.NewMdnsService(ctx, host, interval, serviceTag)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("mDNS discovery started, service tag: %s", serviceTag)
+	service.RegisterNotifee(notifee)
+	return service, nil
+}
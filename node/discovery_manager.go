@@ -0,0 +1,343 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"go.uber.org/zap"
+)
+
+// Backoff between two reconnect attempts to a lost peer
+const (
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = 5 * time.Minute
+	// Peers are forgotten after this number of consecutive failures
+	maxFailedAttempts = 12
+)
+
+// PeerState state of a known peer
+type PeerState struct {
+	ID          peer.ID   `json:"id"`
+	Addrs       []string  `json:"addrs"`
+	Connected   bool      `json:"connected"`
+	Attempts    uint      `json:"attempts"`
+	LastSeen    time.Time `json:"lastSeen"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+
+	addrInfo peer.AddrInfo
+	backoff  time.Duration
+	dialing  bool
+}
+
+// DiscoveryState snapshot of discovery manager
+type DiscoveryState struct {
+	Domain        string      `json:"domain"`
+	TargetPeers   int         `json:"targetPeers"`
+	Connected     int         `json:"connected"`
+	LastAdvertise time.Time   `json:"lastAdvertise"`
+	LastQuery     time.Time   `json:"lastQuery"`
+	Peers         []PeerState `json:"peers"`
+}
+
+// DiscoveryManager keep current node connected to the network, it periodically
+// re-advertises and re-queries the rendezvous until target peer count is reached
+// and reconnects to lost peers with exponential backoff. Target peer count is a
+// lower bound, connections above it are never pruned by discovery manager
+type DiscoveryManager struct {
+	ctx           context.Context
+	host          host.Host
+	discoverer    discovery.Discovery
+	domain        string
+	interval      time.Duration
+	targetPeers   int
+	peers         map[peer.ID]*PeerState
+	nextAdvertise time.Time
+	lastAdvertise time.Time
+	lastQuery     time.Time
+	observer      Observer
+	notifiee      network.Notifiee
+	log           *zap.SugaredLogger
+	mutex         sync.Mutex
+}
+
+// NewDiscoveryManager create new discovery manager, discoverer could be nil if
+// peers are only fed by other sources e.g: mDNS
+func NewDiscoveryManager(ctx context.Context, host host.Host, discoverer discovery.Discovery, domain string, interval time.Duration, targetPeers int, log *zap.SugaredLogger) *DiscoveryManager {
+	return &DiscoveryManager{
+		ctx:         ctx,
+		host:        host,
+		discoverer:  discoverer,
+		domain:      domain,
+		interval:    interval,
+		targetPeers: targetPeers,
+		peers:       make(map[peer.ID]*PeerState),
+		log:         log,
+	}
+}
+
+// Start discovery loop in background, the loop stops when context of
+// discovery manager is done
+func (d *DiscoveryManager) Start() {
+	d.notifiee = &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			d.setConnected(conn.RemotePeer(), true)
+		},
+		DisconnectedF: func(net network.Network, conn network.Conn) {
+			// A peer could have several connections
+			if net.Connectedness(conn.RemotePeer()) != network.Connected {
+				d.setConnected(conn.RemotePeer(), false)
+			}
+		},
+	}
+	d.host.Network().Notify(d.notifiee)
+	go d.loop()
+}
+
+// Close stop tracking connections of host
+func (d *DiscoveryManager) Close() error {
+	if d.notifiee != nil {
+		d.host.Network().StopNotify(d.notifiee)
+	}
+	return nil
+}
+
+// HandlePeerFound add a discovered peer and connect to it
+func (d *DiscoveryManager) HandlePeerFound(peerInfo peer.AddrInfo) {
+	if peerInfo.ID == d.host.ID() || len(peerInfo.Addrs) == 0 {
+		return
+	}
+	d.mutex.Lock()
+	state, ok := d.peers[peerInfo.ID]
+	if !ok {
+		state = &PeerState{ID: peerInfo.ID, backoff: reconnectMinBackoff}
+		d.peers[peerInfo.ID] = state
+	}
+	state.addrInfo = peerInfo
+	state.LastSeen = time.Now()
+	// Rediscovered peers are dialed immediately
+	state.NextAttempt = time.Time{}
+	d.mutex.Unlock()
+	go d.connect(peerInfo.ID)
+}
+
+// State get snapshot of discovery manager
+func (d *DiscoveryManager) State() DiscoveryState {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	state := DiscoveryState{
+		Domain:        d.domain,
+		TargetPeers:   d.targetPeers,
+		Connected:     len(d.host.Network().Peers()),
+		LastAdvertise: d.lastAdvertise,
+		LastQuery:     d.lastQuery,
+		Peers:         make([]PeerState, 0, len(d.peers)),
+	}
+	for _, peerState := range d.peers {
+		snapshot := *peerState
+		snapshot.Addrs = make([]string, 0, len(peerState.addrInfo.Addrs))
+		for _, addr := range peerState.addrInfo.Addrs {
+			snapshot.Addrs = append(snapshot.Addrs, addr.String())
+		}
+		state.Peers = append(state.Peers, snapshot)
+	}
+	sort.Slice(state.Peers, func(i, j int) bool {
+		return state.Peers[i].ID < state.Peers[j].ID
+	})
+	return state
+}
+
+func (d *DiscoveryManager) loop() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		d.advertise()
+		if len(d.host.Network().Peers()) < d.targetPeers {
+			d.query()
+		}
+		d.reconnect()
+		d.ping()
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// advertise announce current node again when previous advertisement expired
+func (d *DiscoveryManager) advertise() {
+	if d.discoverer == nil || time.Now().Before(d.nextAdvertise) {
+		return
+	}
+	d.log.Debug("Announcing ourselves...")
+	start := time.Now()
+	ttl, err := d.discoverer.Advertise(d.ctx, d.domain)
+	d.observe(OperationAdvertise, start, 0, err)
+	if err != nil {
+		d.log.Warnf("Unable to advertise: %v", err)
+		d.nextAdvertise = time.Now().Add(d.interval)
+		return
+	}
+	// Renew before advertisement expired
+	d.nextAdvertise = time.Now().Add(ttl * 7 / 8)
+	d.mutex.Lock()
+	d.lastAdvertise = time.Now()
+	d.mutex.Unlock()
+	d.log.Debug("Successfully announced!")
+}
+
+// query look for other peers who have announced
+func (d *DiscoveryManager) query() {
+	if d.discoverer == nil {
+		return
+	}
+	d.log.Debug("Searching for other peers...")
+	ctx, cancel := context.WithTimeout(d.ctx, d.interval)
+	defer cancel()
+	start := time.Now()
+	peerChan, err := d.discoverer.FindPeers(ctx, d.domain)
+	if err != nil {
+		d.observe(OperationFindPeers, start, 0, err)
+		d.log.Warnf("Unable to find peers: %v", err)
+		return
+	}
+	found := 0
+	for peerInfo := range peerChan {
+		found++
+		d.HandlePeerFound(peerInfo)
+	}
+	d.observe(OperationFindPeers, start, found, nil)
+	d.mutex.Lock()
+	d.lastQuery = time.Now()
+	d.mutex.Unlock()
+}
+
+// observe report a discovery operation to observer
+func (d *DiscoveryManager) observe(operation string, start time.Time, found int, err error) {
+	if d.observer != nil {
+		d.observer.Discovered(operation, time.Since(start), found, err)
+	}
+}
+
+// reconnect dial lost peers whose backoff expired
+func (d *DiscoveryManager) reconnect() {
+	now := time.Now()
+	d.mutex.Lock()
+	candidates := make([]peer.ID, 0)
+	for peerID, state := range d.peers {
+		if !state.Connected && now.After(state.NextAttempt) {
+			candidates = append(candidates, peerID)
+		}
+	}
+	d.mutex.Unlock()
+	for _, peerID := range candidates {
+		go d.connect(peerID)
+	}
+}
+
+// ping measure round trip time of connected peers, results are recorded in
+// peerstore and exposed by Peerstore().LatencyEWMA
+func (d *DiscoveryManager) ping() {
+	for _, peerID := range d.host.Network().Peers() {
+		go func(peerID peer.ID) {
+			ctx, cancel := context.WithTimeout(d.ctx, d.interval)
+			defer cancel()
+			if result := <-ping.Ping(ctx, d.host, peerID); result.Error != nil {
+				d.log.Debugf("Unable to ping %s: %v", peerID.Pretty(), result.Error)
+			}
+		}(peerID)
+	}
+}
+
+// connect dial a known peer, failures are rescheduled with exponential backoff
+func (d *DiscoveryManager) connect(peerID peer.ID) {
+	d.mutex.Lock()
+	state, ok := d.peers[peerID]
+	if !ok || state.Connected || state.dialing {
+		d.mutex.Unlock()
+		return
+	}
+	peerInfo := state.addrInfo
+	state.dialing = true
+	d.mutex.Unlock()
+
+	d.log.Debugf("Connecting to: %s", peerID.Pretty())
+	clearDialBackoff(d.host, peerID)
+	err := d.host.Connect(d.ctx, peerInfo)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	state.dialing = false
+	if err == nil {
+		d.log.Infof("Connected to: %s", peerID.Pretty())
+		state.Connected = true
+		state.Attempts = 0
+		state.LastError = ""
+		return
+	}
+	d.log.Debugf("Connection failed: %v", err)
+	state.Attempts++
+	state.LastError = err.Error()
+	if state.Attempts >= maxFailedAttempts {
+		d.log.Debugf("Forget peer: %s", peerID.Pretty())
+		delete(d.peers, peerID)
+		return
+	}
+	state.NextAttempt = time.Now().Add(state.backoff)
+	if state.backoff *= 2; state.backoff > reconnectMaxBackoff {
+		state.backoff = reconnectMaxBackoff
+	}
+}
+
+// setConnected update connection state of a peer
+func (d *DiscoveryManager) setConnected(peerID peer.ID, connected bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	state, ok := d.peers[peerID]
+	if !ok {
+		if !connected {
+			return
+		}
+		// Inbound peers are kept so we could reconnect to them
+		state = &PeerState{ID: peerID, backoff: reconnectMinBackoff}
+		d.peers[peerID] = state
+	}
+	if connected {
+		state.Connected = true
+		state.Attempts = 0
+		state.backoff = reconnectMinBackoff
+		state.LastSeen = time.Now()
+		return
+	}
+	if state.Connected {
+		d.log.Infof("Lost connection to: %s", peerID.Pretty())
+		state.Connected = false
+		state.NextAttempt = time.Now().Add(state.backoff)
+		// Addresses of inbound peers were learnt by identify protocol
+		if len(state.addrInfo.Addrs) == 0 {
+			state.addrInfo = d.host.Peerstore().PeerInfo(peerID)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/p2sub/p2sub/harness"
+	"github.com/p2sub/p2sub/node"
+)
+
+// awaitPeerState wait until discovery manager of a node sees a peer in given
+// connection state
+func awaitPeerState(t *testing.T, n *node.Node, id peer.ID, connected bool) node.PeerState {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, state := range n.Discovery().State().Peers {
+			if state.ID == id && state.Connected == connected {
+				return state
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("peer %s never reached connected=%v", id, connected)
+	return node.PeerState{}
+}
+
+func TestDiscoveryReconnect(t *testing.T) {
+	h, err := harness.New(context.Background(), 2, node.DiscoveryInterval(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	a, b := h.Node(0), h.Node(1)
+	if _, err := h.Mocknet.LinkPeers(a.ID(), b.ID()); err != nil {
+		t.Fatal(err)
+	}
+	a.Discovery().HandlePeerFound(peer.AddrInfo{ID: b.ID(), Addrs: b.Addrs()})
+	awaitPeerState(t, a, b.ID(), true)
+
+	// Lost peer is dialed again once its backoff expired. Link is removed
+	// meanwhile, otherwise gossipsub could redial the peer before it was lost
+	if err := h.Unlink(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	lost := awaitPeerState(t, a, b.ID(), false)
+	if lost.NextAttempt.IsZero() {
+		t.Fatal("reconnect of lost peer was not scheduled")
+	}
+	if _, err := h.Mocknet.LinkPeers(a.ID(), b.ID()); err != nil {
+		t.Fatal(err)
+	}
+	awaitPeerState(t, a, b.ID(), true)
+	if len(a.Peers()) != 1 {
+		t.Fatalf("node has %d peers after reconnect", len(a.Peers()))
+	}
+}
+
+func TestDiscoveryInboundPeer(t *testing.T) {
+	h, err := harness.New(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Link(1, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Peers which connected to us are kept so they could be reconnected
+	state := awaitPeerState(t, h.Node(0), h.Node(1).ID(), true)
+	if state.Attempts != 0 {
+		t.Fatalf("inbound peer has %d failed attempts", state.Attempts)
+	}
+	if target := h.Node(0).Discovery().State().TargetPeers; target != h.Node(0).Config().TargetPeers {
+		t.Fatalf("discovery targets %d peers", target)
+	}
+}
+
+func TestDiscoveryStopsOnClose(t *testing.T) {
+	h, err := harness.New(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Link(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	a, b := h.Node(0), h.Node(1)
+	awaitPeerState(t, a, b.ID(), true)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Host of harness outlives the node, its connection events must not reach
+	// discovery manager of a closed node anymore
+	if err := h.Mocknet.DisconnectPeers(a.ID(), b.ID()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, state := range a.Discovery().State().Peers {
+		if state.ID == b.ID() && !state.Connected {
+			t.Fatal("closed discovery manager still tracks connections")
+		}
+	}
+}
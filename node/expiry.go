@@ -0,0 +1,113 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// DefaultClockSkew difference of clocks tolerated when expiry of messages is checked
+const DefaultClockSkew = 10 * time.Second
+
+// DefaultMaxTTL longest time to live of a message
+const DefaultMaxTTL = 24 * time.Hour
+
+// ErrInvalidTTL time to live of a published message is not positive or
+// longer than max TTL of its topic
+var ErrInvalidTTL = errors.New("invalid time to live")
+
+// PublishOption set header fields of a published message
+type PublishOption func(header *Header)
+
+// WithKey set application key of a message, retries with the same key are
+// delivered once on topics with key dedup
+func WithKey(key string) PublishOption {
+	return func(header *Header) {
+		header.Key = key
+	}
+}
+
+// WithTTL set time to live of a message, it overrides TTL of its topic.
+// Expired messages are neither forwarded nor delivered
+func WithTTL(ttl time.Duration) PublishOption {
+	return func(header *Header) {
+		header.Expires = expiryOf(time.Now(), ttl)
+	}
+}
+
+// expiryOf expiry timestamp in unix milliseconds of a message published now
+func expiryOf(now time.Time, ttl time.Duration) int64 {
+	return now.Add(ttl).UnixNano() / int64(time.Millisecond)
+}
+
+// ExpiresAt time after which the message is dropped, it's zero if the
+// message never expires
+func (h *Header) ExpiresAt() time.Time {
+	if h.Expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, h.Expires*int64(time.Millisecond))
+}
+
+// Expired check if a message is expired, skew is the tolerated difference
+// between clock of publisher and now
+func (h *Header) Expired(now time.Time, skew time.Duration) bool {
+	return h.Expires != 0 && now.After(h.ExpiresAt().Add(skew))
+}
+
+// checkTTL check expiry of a message which is being published
+func (c *Config) checkTTL(topic string, header *Header, now time.Time) error {
+	params := c.topicParams(topic)
+	if header.Expires == 0 && params.TTL > 0 {
+		header.Expires = expiryOf(now, time.Duration(params.TTL))
+	}
+	if header.Expires == 0 {
+		return nil
+	}
+	if !header.ExpiresAt().After(now) {
+		return fmt.Errorf("%w: message of %s expires before it's published", ErrInvalidTTL, topic)
+	}
+	if header.ExpiresAt().After(now.Add(time.Duration(params.MaxTTL))) {
+		return fmt.Errorf("%w: max TTL of %s is %s", ErrInvalidTTL, topic, time.Duration(params.MaxTTL))
+	}
+	return nil
+}
+
+// validateExpiry validate header of a received message, expired messages
+// are ignored since their relays could be slow but honest. Messages with a
+// broken header are ignored too, they could come from publishers which don't
+// use p2sub headers. Messages which live longer than max TTL of their topic
+// are rejected
+func (n *Node) validateExpiry(topic string, msg *pubsub.Message, now time.Time) pubsub.ValidationResult {
+	header, _, err := decodeHeader(msg.GetData())
+	if err != nil {
+		n.cfg.Logger.Debugf("Ignore message of %s from %s: %v", topic, msg.GetFrom(), err)
+		return pubsub.ValidationIgnore
+	}
+	if header.Expired(now, n.cfg.ClockSkew) {
+		n.cfg.Logger.Debugf("Ignore expired message of %s from %s", topic, msg.GetFrom())
+		return pubsub.ValidationIgnore
+	}
+	maxTTL := time.Duration(n.cfg.topicParams(topic).MaxTTL)
+	if header.Expires != 0 && header.ExpiresAt().After(now.Add(maxTTL+n.cfg.ClockSkew)) {
+		n.cfg.Logger.Debugf("Reject message of %s from %s: expiry too far in the future", topic, msg.GetFrom())
+		return pubsub.ValidationReject
+	}
+	return pubsub.ValidationAccept
+}
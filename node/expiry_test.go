@@ -0,0 +1,126 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+// expiryConfig configuration with a topic which has a TTL
+func expiryConfig(t *testing.T) *Config {
+	return testConfig(t,
+		ConfigureTopic("quotes", TopicParams{TTL: Duration(time.Minute), MaxTTL: Duration(time.Hour)}),
+		ClockSkew(10*time.Second),
+	)
+}
+
+func TestCheckTTL(t *testing.T) {
+	cfg := expiryConfig(t)
+	now := time.Now()
+
+	// TTL of topic applies unless publisher gave one
+	header := &Header{}
+	if err := cfg.checkTTL("quotes", header, now); err != nil {
+		t.Fatal(err)
+	}
+	if header.Expires != expiryOf(now, time.Minute) {
+		t.Fatalf("message expires at %s, expected TTL of topic", header.ExpiresAt())
+	}
+	header = &Header{Expires: expiryOf(now, 30*time.Minute)}
+	if err := cfg.checkTTL("quotes", header, now); err != nil || header.Expires != expiryOf(now, 30*time.Minute) {
+		t.Fatalf("TTL of publisher was not kept: %v", err)
+	}
+
+	for _, ttl := range []time.Duration{-time.Second, 2 * time.Hour} {
+		header := &Header{Expires: expiryOf(now, ttl)}
+		if err := cfg.checkTTL("quotes", header, now); !errors.Is(err, ErrInvalidTTL) {
+			t.Fatalf("TTL %s was accepted: %v", ttl, err)
+		}
+	}
+
+	// Messages of topics without TTL never expire
+	header = &Header{}
+	if err := cfg.checkTTL("orders", header, now); err != nil || header.Expires != 0 {
+		t.Fatalf("message of topic without TTL expires: %v", err)
+	}
+	header = &Header{Expires: expiryOf(now, 25*time.Hour)}
+	if err := cfg.checkTTL("orders", header, now); !errors.Is(err, ErrInvalidTTL) {
+		t.Fatalf("TTL longer than default max TTL was accepted: %v", err)
+	}
+}
+
+func TestConfigureTTL(t *testing.T) {
+	cfg := &Config{}
+	if err := ConfigureTopic("quotes", TopicParams{TTL: Duration(DefaultMaxTTL)})(cfg); err != nil {
+		t.Fatal(err)
+	}
+	invalid := []TopicParams{
+		{TTL: Duration(2 * time.Hour), MaxTTL: Duration(time.Hour)},
+		// Topic without max TTL has default max TTL
+		{TTL: Duration(DefaultMaxTTL + time.Hour)},
+	}
+	for _, params := range invalid {
+		if err := ConfigureTopic("quotes", params)(cfg); err == nil {
+			t.Fatalf("TTL %s longer than max TTL %s was accepted", time.Duration(params.TTL), time.Duration(params.MaxTTL))
+		}
+	}
+}
+
+func TestValidateExpiry(t *testing.T) {
+	n := &Node{cfg: expiryConfig(t)}
+	now := time.Now()
+	message := func(expires int64) *pubsub.Message {
+		data, err := encodeHeader(&Header{Expires: expires}, []byte("quote"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &pubsub.Message{Message: &pb.Message{Data: data}}
+	}
+	cases := []struct {
+		name     string
+		msg      *pubsub.Message
+		expected pubsub.ValidationResult
+	}{
+		{"plain", &pubsub.Message{Message: &pb.Message{Data: []byte("quote")}}, pubsub.ValidationAccept},
+		{"live", message(expiryOf(now, time.Minute)), pubsub.ValidationAccept},
+		{"within clock skew", message(expiryOf(now, -5*time.Second)), pubsub.ValidationAccept},
+		{"expired", message(expiryOf(now, -time.Minute)), pubsub.ValidationIgnore},
+		{"max TTL within clock skew", message(expiryOf(now, time.Hour+5*time.Second)), pubsub.ValidationAccept},
+		{"longer than max TTL", message(expiryOf(now, 2*time.Hour)), pubsub.ValidationReject},
+		{"broken header", &pubsub.Message{Message: &pb.Message{Data: append(append([]byte{}, headerMagic...), 9)}}, pubsub.ValidationIgnore},
+	}
+	for _, c := range cases {
+		if result := n.validateExpiry("quotes", c.msg, now); result != c.expected {
+			t.Fatalf("%s message: result %v, expected %v", c.name, result, c.expected)
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+	header := &Header{}
+	if header.Expired(now.Add(1000*time.Hour), 0) || !header.ExpiresAt().IsZero() {
+		t.Fatal("message without expiry expired")
+	}
+	header.Expires = expiryOf(now, time.Second)
+	if header.Expired(now, 0) || !header.Expired(now.Add(2*time.Second), 0) || header.Expired(now.Add(2*time.Second), 5*time.Second) {
+		t.Fatal("expiry does not tolerate clock skew")
+	}
+}
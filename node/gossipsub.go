@@ -0,0 +1,361 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// Presets of gossipsub parameters
+const (
+	// PresetDefault gossipsub defaults without peer scoring
+	PresetDefault = "default"
+	// PresetTrusted small cluster of trusted nodes, gossip is more redundant
+	// and peers are never penalized
+	PresetTrusted = "trusted"
+	// PresetOpen open network, peers are scored so spammers and eclipse
+	// attackers are pruned, graylisted and not accepted by peer exchange
+	PresetOpen = "open"
+)
+
+// Duration duration which is written as a string in JSON e.g: "1.5s"
+type Duration time.Duration
+
+// MarshalJSON implement json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implement json.Unmarshaler, numbers are nanoseconds
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(v)
+	case string:
+		duration, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(duration)
+	default:
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	return nil
+}
+
+// GossipSubParams parameters of gossipsub router, see go-libp2p-pubsub for
+// meaning of each parameter
+type GossipSubParams struct {
+	D                 int      `json:"d"`
+	Dlo               int      `json:"dlo"`
+	Dhi               int      `json:"dhi"`
+	Dscore            int      `json:"dscore"`
+	Dout              int      `json:"dout"`
+	Dlazy             int      `json:"dlazy"`
+	GossipFactor      float64  `json:"gossipFactor"`
+	HeartbeatInterval Duration `json:"heartbeatInterval"`
+	HistoryLength     int      `json:"historyLength"`
+	HistoryGossip     int      `json:"historyGossip"`
+	FloodPublish      bool     `json:"floodPublish"`
+	// PeerScore parameters of peer scoring, nil disables it
+	PeerScore *PeerScore `json:"peerScore"`
+}
+
+// PeerScore parameters of peer scoring
+type PeerScore struct {
+	Topics                      map[string]*TopicScore `json:"topics"`
+	TopicScoreCap               float64                `json:"topicScoreCap"`
+	AppSpecificWeight           float64                `json:"appSpecificWeight"`
+	IPColocationFactorWeight    float64                `json:"ipColocationFactorWeight"`
+	IPColocationFactorThreshold int                    `json:"ipColocationFactorThreshold"`
+	IPColocationFactorWhitelist []string               `json:"ipColocationFactorWhitelist"`
+	BehaviourPenaltyWeight      float64                `json:"behaviourPenaltyWeight"`
+	BehaviourPenaltyThreshold   float64                `json:"behaviourPenaltyThreshold"`
+	BehaviourPenaltyDecay       float64                `json:"behaviourPenaltyDecay"`
+	DecayInterval               Duration               `json:"decayInterval"`
+	DecayToZero                 float64                `json:"decayToZero"`
+	RetainScore                 Duration               `json:"retainScore"`
+	Thresholds                  ScoreThresholds        `json:"thresholds"`
+}
+
+// TopicScore parameters of peer scoring in a topic
+type TopicScore struct {
+	TopicWeight                     float64  `json:"topicWeight"`
+	TimeInMeshWeight                float64  `json:"timeInMeshWeight"`
+	TimeInMeshQuantum               Duration `json:"timeInMeshQuantum"`
+	TimeInMeshCap                   float64  `json:"timeInMeshCap"`
+	FirstMessageDeliveriesWeight    float64  `json:"firstMessageDeliveriesWeight"`
+	FirstMessageDeliveriesDecay     float64  `json:"firstMessageDeliveriesDecay"`
+	FirstMessageDeliveriesCap       float64  `json:"firstMessageDeliveriesCap"`
+	MeshMessageDeliveriesWeight     float64  `json:"meshMessageDeliveriesWeight"`
+	MeshMessageDeliveriesDecay      float64  `json:"meshMessageDeliveriesDecay"`
+	MeshMessageDeliveriesCap        float64  `json:"meshMessageDeliveriesCap"`
+	MeshMessageDeliveriesThreshold  float64  `json:"meshMessageDeliveriesThreshold"`
+	MeshMessageDeliveriesWindow     Duration `json:"meshMessageDeliveriesWindow"`
+	MeshMessageDeliveriesActivation Duration `json:"meshMessageDeliveriesActivation"`
+	MeshFailurePenaltyWeight        float64  `json:"meshFailurePenaltyWeight"`
+	MeshFailurePenaltyDecay         float64  `json:"meshFailurePenaltyDecay"`
+	InvalidMessageDeliveriesWeight  float64  `json:"invalidMessageDeliveriesWeight"`
+	InvalidMessageDeliveriesDecay   float64  `json:"invalidMessageDeliveriesDecay"`
+}
+
+// ScoreThresholds score thresholds of gossip, publish, graylist, peer
+// exchange and opportunistic graft
+type ScoreThresholds struct {
+	Gossip             float64 `json:"gossip"`
+	Publish            float64 `json:"publish"`
+	Graylist           float64 `json:"graylist"`
+	AcceptPX           float64 `json:"acceptPX"`
+	OpportunisticGraft float64 `json:"opportunisticGraft"`
+}
+
+// Preset get gossipsub parameters of a preset
+func Preset(name string) (GossipSubParams, error) {
+	params := GossipSubParams{
+		D:                 6,
+		Dlo:               5,
+		Dhi:               12,
+		Dscore:            4,
+		Dout:              2,
+		Dlazy:             6,
+		GossipFactor:      0.25,
+		HeartbeatInterval: Duration(time.Second),
+		HistoryLength:     5,
+		HistoryGossip:     3,
+		FloodPublish:      true,
+	}
+	switch name {
+	case PresetDefault:
+	case PresetTrusted:
+		// Every node is likely in the mesh of every other node, gossip and
+		// history make recovery of lost messages faster
+		params.Dlo = 4
+		params.Dhi = 10
+		params.GossipFactor = 0.5
+		params.HeartbeatInterval = Duration(700 * time.Millisecond)
+		params.HistoryLength = 10
+		params.HistoryGossip = 5
+	case PresetOpen:
+		// Only the first publish hop is flooded to well scored peers, peers
+		// sharing an IP and breaking gossip promises are penalized
+		params.PeerScore = &PeerScore{
+			Topics:                      map[string]*TopicScore{},
+			TopicScoreCap:               10,
+			AppSpecificWeight:           1,
+			IPColocationFactorWeight:    -100,
+			IPColocationFactorThreshold: 5,
+			BehaviourPenaltyWeight:      -10,
+			BehaviourPenaltyThreshold:   6,
+			BehaviourPenaltyDecay:       pubsub.ScoreParameterDecay(10 * time.Minute),
+			DecayInterval:               Duration(pubsub.DefaultDecayInterval),
+			DecayToZero:                 pubsub.DefaultDecayToZero,
+			RetainScore:                 Duration(time.Hour),
+			Thresholds: ScoreThresholds{
+				Gossip:             -500,
+				Publish:            -1000,
+				Graylist:           -2500,
+				AcceptPX:           10,
+				OpportunisticGraft: 3.5,
+			},
+		}
+	default:
+		return params, fmt.Errorf("unknown gossipsub preset %q", name)
+	}
+	return params, nil
+}
+
+// validate check constraints between parameters
+func (p GossipSubParams) validate() error {
+	if p.D <= 0 || p.Dlo <= 0 || p.Dlo > p.D || p.Dhi < p.D {
+		return errors.New("gossipsub degree must satisfy 0 < dlo <= d <= dhi")
+	}
+	if p.Dout >= p.Dlo || p.Dout > p.D/2 {
+		return errors.New("gossipsub dout must be less than dlo and at most d/2")
+	}
+	if p.Dscore < 0 || p.Dscore > p.D || p.Dlazy < 0 {
+		return errors.New("gossipsub dscore must be in [0, d] and dlazy must not be negative")
+	}
+	if p.HeartbeatInterval <= 0 {
+		return errors.New("gossipsub heartbeat interval must be positive")
+	}
+	if p.HistoryGossip <= 0 || p.HistoryGossip > p.HistoryLength {
+		return errors.New("gossipsub history gossip must be in [1, history length]")
+	}
+	return nil
+}
+
+// ErrRouterParams router parameters differ from parameters of another
+// running node of the process
+var ErrRouterParams = errors.New("gossipsub router parameters differ from another node of this process")
+
+// routerParams parameters gossipsub of this version keeps in package
+// variables, they are shared by all nodes of a process
+type routerParams struct {
+	D                 int
+	Dlo               int
+	Dhi               int
+	Dscore            int
+	Dout              int
+	Dlazy             int
+	GossipFactor      float64
+	HeartbeatInterval Duration
+	HistoryLength     int
+	HistoryGossip     int
+}
+
+// router router parameters of gossipsub parameters
+func (p GossipSubParams) router() routerParams {
+	return routerParams{
+		D:                 p.D,
+		Dlo:               p.Dlo,
+		Dhi:               p.Dhi,
+		Dscore:            p.Dscore,
+		Dout:              p.Dout,
+		Dlazy:             p.Dlazy,
+		GossipFactor:      p.GossipFactor,
+		HeartbeatInterval: p.HeartbeatInterval,
+		HistoryLength:     p.HistoryLength,
+		HistoryGossip:     p.HistoryGossip,
+	}
+}
+
+// routerConfig router parameters of the process and number of running nodes
+// using them, they could only change once no node is running
+var routerConfig struct {
+	params  routerParams
+	applied bool
+	nodes   int
+	mutex   sync.Mutex
+}
+
+// acquireRouter apply router parameters to gossipsub package variables, it
+// fails if another running node uses different parameters. A node which
+// acquired them must release them when it's closed
+func (p GossipSubParams) acquireRouter() error {
+	params := p.router()
+	routerConfig.mutex.Lock()
+	defer routerConfig.mutex.Unlock()
+	if routerConfig.nodes > 0 {
+		if routerConfig.params != params {
+			return ErrRouterParams
+		}
+		routerConfig.nodes++
+		return nil
+	}
+	routerConfig.nodes = 1
+	// Routers of closed nodes could still be stopping, variables they read
+	// are only written if parameters changed
+	if routerConfig.applied && routerConfig.params == params {
+		return nil
+	}
+	pubsub.GossipSubD = p.D
+	pubsub.GossipSubDlo = p.Dlo
+	pubsub.GossipSubDhi = p.Dhi
+	pubsub.GossipSubDscore = p.Dscore
+	pubsub.GossipSubDout = p.Dout
+	pubsub.GossipSubDlazy = p.Dlazy
+	pubsub.GossipSubGossipFactor = p.GossipFactor
+	pubsub.GossipSubHeartbeatInterval = time.Duration(p.HeartbeatInterval)
+	pubsub.GossipSubHistoryLength = p.HistoryLength
+	pubsub.GossipSubHistoryGossip = p.HistoryGossip
+	routerConfig.params = params
+	routerConfig.applied = true
+	return nil
+}
+
+// releaseRouter release router parameters acquired by a node
+func releaseRouter() error {
+	routerConfig.mutex.Lock()
+	defer routerConfig.mutex.Unlock()
+	if routerConfig.nodes > 0 {
+		routerConfig.nodes--
+	}
+	return nil
+}
+
+// options get gossipsub options of a node, router parameters are applied
+// by acquireRouter
+func (p GossipSubParams) options() []pubsub.Option {
+	options := []pubsub.Option{pubsub.WithFloodPublish(p.FloodPublish)}
+	if p.PeerScore != nil {
+		params, thresholds := p.PeerScore.pubsubParams()
+		options = append(options, pubsub.WithPeerScore(params, thresholds))
+	}
+	return options
+}
+
+// pubsubParams convert peer score parameters to gossipsub parameters,
+// they are validated by gossipsub
+func (s *PeerScore) pubsubParams() (*pubsub.PeerScoreParams, *pubsub.PeerScoreThresholds) {
+	params := &pubsub.PeerScoreParams{
+		Topics:        make(map[string]*pubsub.TopicScoreParams, len(s.Topics)),
+		TopicScoreCap: s.TopicScoreCap,
+		// Application specific score is not used yet
+		AppSpecificScore:            func(peer.ID) float64 { return 0 },
+		AppSpecificWeight:           s.AppSpecificWeight,
+		IPColocationFactorWeight:    s.IPColocationFactorWeight,
+		IPColocationFactorThreshold: s.IPColocationFactorThreshold,
+		IPColocationFactorWhitelist: make(map[string]struct{}, len(s.IPColocationFactorWhitelist)),
+		BehaviourPenaltyWeight:      s.BehaviourPenaltyWeight,
+		BehaviourPenaltyThreshold:   s.BehaviourPenaltyThreshold,
+		BehaviourPenaltyDecay:       s.BehaviourPenaltyDecay,
+		DecayInterval:               time.Duration(s.DecayInterval),
+		DecayToZero:                 s.DecayToZero,
+		RetainScore:                 time.Duration(s.RetainScore),
+	}
+	for _, ip := range s.IPColocationFactorWhitelist {
+		params.IPColocationFactorWhitelist[ip] = struct{}{}
+	}
+	for topic, t := range s.Topics {
+		params.Topics[topic] = &pubsub.TopicScoreParams{
+			TopicWeight:                     t.TopicWeight,
+			TimeInMeshWeight:                t.TimeInMeshWeight,
+			TimeInMeshQuantum:               time.Duration(t.TimeInMeshQuantum),
+			TimeInMeshCap:                   t.TimeInMeshCap,
+			FirstMessageDeliveriesWeight:    t.FirstMessageDeliveriesWeight,
+			FirstMessageDeliveriesDecay:     t.FirstMessageDeliveriesDecay,
+			FirstMessageDeliveriesCap:       t.FirstMessageDeliveriesCap,
+			MeshMessageDeliveriesWeight:     t.MeshMessageDeliveriesWeight,
+			MeshMessageDeliveriesDecay:      t.MeshMessageDeliveriesDecay,
+			MeshMessageDeliveriesCap:        t.MeshMessageDeliveriesCap,
+			MeshMessageDeliveriesThreshold:  t.MeshMessageDeliveriesThreshold,
+			MeshMessageDeliveriesWindow:     time.Duration(t.MeshMessageDeliveriesWindow),
+			MeshMessageDeliveriesActivation: time.Duration(t.MeshMessageDeliveriesActivation),
+			MeshFailurePenaltyWeight:        t.MeshFailurePenaltyWeight,
+			MeshFailurePenaltyDecay:         t.MeshFailurePenaltyDecay,
+			InvalidMessageDeliveriesWeight:  t.InvalidMessageDeliveriesWeight,
+			InvalidMessageDeliveriesDecay:   t.InvalidMessageDeliveriesDecay,
+		}
+	}
+	thresholds := &pubsub.PeerScoreThresholds{
+		GossipThreshold:             s.Thresholds.Gossip,
+		PublishThreshold:            s.Thresholds.Publish,
+		GraylistThreshold:           s.Thresholds.Graylist,
+		AcceptPXThreshold:           s.Thresholds.AcceptPX,
+		OpportunisticGraftThreshold: s.Thresholds.OpportunisticGraft,
+	}
+	return params, thresholds
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/p2sub/p2sub/harness"
+	"github.com/p2sub/p2sub/node"
+)
+
+func TestRouterParamsArePerProcess(t *testing.T) {
+	ctx := context.Background()
+	trusted, err := node.Preset(node.PresetTrusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := harness.New(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := harness.New(ctx, 1, node.GossipSub(trusted)); !errors.Is(err, node.ErrRouterParams) {
+		first.Close()
+		t.Fatalf("node with different router parameters started: %v", err)
+	}
+	same, err := harness.New(ctx, 1)
+	if err != nil {
+		t.Fatalf("node with the same router parameters failed: %v", err)
+	}
+	same.Close()
+	first.Close()
+
+	// Routers of closed nodes could still read package variables while they
+	// stop, which the race detector reports once parameters change
+	if raceEnabled {
+		t.Skip("router parameters are not changed under the race detector")
+	}
+	// Parameters could change once no node uses them anymore
+	changed, err := harness.New(ctx, 1, node.GossipSub(trusted))
+	if err != nil {
+		t.Fatalf("router parameters could not change after nodes were closed: %v", err)
+	}
+	changed.Close()
+}
@@ -0,0 +1,508 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/p2sub/p2sub/keypair"
+)
+
+// KeyTopicPrefix group keys of an encrypted topic are published to the topic
+// with this prefix, each key is sealed to public key of a member
+const KeyTopicPrefix = "p2sub/keys/"
+
+// Sealed payload of an encrypted topic is version, epoch of group key, nonce
+// then AES-GCM ciphertext bound to topic name
+const (
+	sealedVersion    = 1
+	sealedHeaderSize = 1 + 8 + 12
+)
+
+// keysKept group keys kept by members, previous keys open messages which
+// were sealed right before a rotation
+const keysKept = 3
+
+// keyRetryInterval interval of asking owner for group key until it's known,
+// owner pushes the key to members joining the key topic so retries are a
+// fallback for pushes which were missed
+const keyRetryInterval = 2 * time.Second
+
+// Errors of encrypted topics
+var (
+	ErrNoGroupKey   = errors.New("group key of topic is not known")
+	ErrNotMember    = errors.New("peer is not a member of the group")
+	ErrInvalidGroup = errors.New("topic is already an encrypted topic")
+)
+
+// groupKeys group keys of an encrypted topic known by this node
+type groupKeys struct {
+	owner   peer.ID
+	current uint64
+	keys    map[uint64][]byte
+}
+
+// add keep a group key, only the newest keys are kept
+func (g *groupKeys) add(epoch uint64, key []byte) {
+	g.keys[epoch] = key
+	if epoch > g.current {
+		g.current = epoch
+	}
+	if len(g.keys) <= keysKept {
+		return
+	}
+	epochs := make([]uint64, 0, len(g.keys))
+	for known := range g.keys {
+		epochs = append(epochs, known)
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+	for _, old := range epochs[:len(epochs)-keysKept] {
+		delete(g.keys, old)
+	}
+}
+
+// keyUpdate group key sealed to each member, keys are indexed by peer ID
+type keyUpdate struct {
+	Epoch uint64            `json:"epoch"`
+	Keys  map[string][]byte `json:"keys"`
+}
+
+// Group encrypted topic owned by this node, the owner generates group keys
+// and distributes them to members
+type Group struct {
+	node      *Node
+	topic     string
+	members   map[peer.ID]struct{}
+	responder *Responder
+	events    *pubsub.TopicEventHandler
+	cancel    context.CancelFunc
+	mutex     sync.Mutex
+}
+
+// CreateGroup make a topic encrypted with this node as owner, payloads are
+// sealed with a group key which is only given to members. Publish and
+// Subscribe of the topic seal and open payloads transparently
+func (n *Node) CreateGroup(topic string, members ...peer.ID) (*Group, error) {
+	if n.host == nil {
+		return nil, ErrNotStarted
+	}
+	if err := n.addGroup(topic, n.host.ID()); err != nil {
+		return nil, err
+	}
+	g := &Group{node: n, topic: topic, members: make(map[peer.ID]struct{})}
+	for _, member := range members {
+		g.members[member] = struct{}{}
+	}
+	// Members which missed an update ask for the current key
+	responder, err := n.Respond(KeyTopicPrefix+topic, g.answerKey)
+	if err != nil {
+		n.removeGroup(topic)
+		return nil, err
+	}
+	g.responder = responder
+	// Members joining the key topic get the current key without asking
+	handle, err := n.Topic(KeyTopicPrefix + topic)
+	if err != nil {
+		g.Close()
+		n.removeGroup(topic)
+		return nil, err
+	}
+	events, err := handle.EventHandler()
+	if err != nil {
+		g.Close()
+		n.removeGroup(topic)
+		return nil, err
+	}
+	g.events = events
+	if err := g.Rotate(); err != nil {
+		g.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(n.ctx)
+	g.cancel = cancel
+	go g.pushKeys(ctx)
+	return g, nil
+}
+
+// Topic get name of encrypted topic
+func (g *Group) Topic() string {
+	return g.topic
+}
+
+// Members get members of the group except the owner
+func (g *Group) Members() []peer.ID {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	members := make([]peer.ID, 0, len(g.members))
+	for member := range g.members {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i] < members[j] })
+	return members
+}
+
+// AddMembers add members then rotate group key, new members are not able to
+// open messages sealed before they joined
+func (g *Group) AddMembers(members ...peer.ID) error {
+	g.mutex.Lock()
+	for _, member := range members {
+		g.members[member] = struct{}{}
+	}
+	g.mutex.Unlock()
+	return g.Rotate()
+}
+
+// RemoveMembers remove members then rotate group key, removed members are
+// not able to open messages sealed after they left
+func (g *Group) RemoveMembers(members ...peer.ID) error {
+	g.mutex.Lock()
+	for _, member := range members {
+		delete(g.members, member)
+	}
+	g.mutex.Unlock()
+	return g.Rotate()
+}
+
+// SetMembers replace members, group key is rotated if membership changed
+func (g *Group) SetMembers(members ...peer.ID) error {
+	next := make(map[peer.ID]struct{}, len(members))
+	for _, member := range members {
+		next[member] = struct{}{}
+	}
+	g.mutex.Lock()
+	changed := len(next) != len(g.members)
+	for member := range next {
+		if _, ok := g.members[member]; !ok {
+			changed = true
+		}
+	}
+	g.members = next
+	g.mutex.Unlock()
+	if !changed {
+		return nil
+	}
+	return g.Rotate()
+}
+
+// Rotate generate a new group key and publish it to members
+func (g *Group) Rotate() error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	// Epochs are time based so they keep increasing after owner restarted
+	epoch := uint64(time.Now().UnixNano())
+	g.node.addGroupKey(g.topic, epoch, key)
+	update, err := g.sealKey(epoch, key, g.Members()...)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	g.node.log.Debugf("Rotate group key of %s, epoch %d", g.topic, epoch)
+	return g.node.Publish(g.node.ctx, KeyTopicPrefix+g.topic, raw)
+}
+
+// Close stop distributing group keys, the topic stays encrypted with known keys
+func (g *Group) Close() {
+	if g.responder != nil {
+		g.responder.Cancel()
+	}
+	if g.cancel != nil {
+		g.cancel()
+	}
+	if g.events != nil {
+		g.events.Cancel()
+	}
+}
+
+// pushKeys publish current group key to members once they join the key
+// topic, so members don't wait for a retry of their request
+func (g *Group) pushKeys(ctx context.Context) {
+	for {
+		event, err := g.events.NextPeerEvent(ctx)
+		if err != nil {
+			return
+		}
+		if event.Type != pubsub.PeerJoin {
+			continue
+		}
+		if err := g.pushKey(event.Peer); err != nil && err != ErrNotMember {
+			g.node.log.Debugf("Unable to push group key of %s to %s: %v", g.topic, event.Peer, err)
+		}
+	}
+}
+
+// pushKey publish current group key sealed to a member
+func (g *Group) pushKey(member peer.ID) error {
+	g.mutex.Lock()
+	_, ok := g.members[member]
+	g.mutex.Unlock()
+	if !ok {
+		return ErrNotMember
+	}
+	epoch, key, err := g.node.currentGroupKey(g.topic)
+	if err != nil {
+		return err
+	}
+	update, err := g.sealKey(epoch, key, member)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	return g.node.Publish(g.node.ctx, KeyTopicPrefix+g.topic, raw)
+}
+
+// sealKey seal a group key to each member
+func (g *Group) sealKey(epoch uint64, key []byte, members ...peer.ID) (*keyUpdate, error) {
+	update := &keyUpdate{Epoch: epoch, Keys: make(map[string][]byte, len(members))}
+	for _, member := range members {
+		pubKey, err := member.ExtractPublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("public key of member %s: %v", member.Pretty(), err)
+		}
+		sealed, err := keypair.Seal(pubKey, key)
+		if err != nil {
+			return nil, fmt.Errorf("seal key to member %s: %v", member.Pretty(), err)
+		}
+		update.Keys[member.Pretty()] = sealed
+	}
+	return update, nil
+}
+
+// answerKey answer request of a member for current group key
+func (g *Group) answerKey(ctx context.Context, req *Request) ([]byte, error) {
+	g.mutex.Lock()
+	_, ok := g.members[req.ReplyTo]
+	g.mutex.Unlock()
+	if !ok {
+		return nil, ErrNotMember
+	}
+	epoch, key, err := g.node.currentGroupKey(g.topic)
+	if err != nil {
+		return nil, err
+	}
+	update, err := g.sealKey(epoch, key, req.ReplyTo)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(update)
+}
+
+// JoinGroup join an encrypted topic of owner, group keys published by owner
+// are opened with private key of this node. Publish and Subscribe of the
+// topic seal and open payloads transparently once a key was received
+func (n *Node) JoinGroup(topic string, owner peer.ID) error {
+	if n.host == nil {
+		return ErrNotStarted
+	}
+	if err := n.addGroup(topic, owner); err != nil {
+		return err
+	}
+	sub, err := n.Subscribe(KeyTopicPrefix + topic)
+	if err != nil {
+		n.removeGroup(topic)
+		return err
+	}
+	go n.receiveKeys(topic, owner, sub)
+	go n.requestKey(topic)
+	return nil
+}
+
+// receiveKeys apply key updates published by owner of an encrypted topic
+func (n *Node) receiveKeys(topic string, owner peer.ID, sub *Subscription) {
+	for {
+		msg, err := sub.Next(n.ctx)
+		if err != nil {
+			return
+		}
+		if msg.From != owner {
+			n.log.Debugf("Ignore key update of %s from %s", topic, msg.From)
+			continue
+		}
+		if err := n.applyKeyUpdate(topic, msg.Data); err != nil {
+			n.log.Debugf("Unable to apply key update of %s: %v", topic, err)
+		}
+	}
+}
+
+// requestKey ask owner for current group key until a key is known
+func (n *Node) requestKey(topic string) {
+	for {
+		if _, _, err := n.currentGroupKey(topic); err == nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(n.ctx, keyRetryInterval)
+		reply, err := n.Request(ctx, KeyTopicPrefix+topic, nil)
+		cancel()
+		if err == nil {
+			err = n.applyKeyUpdate(topic, reply.Data)
+		}
+		if err != nil {
+			n.log.Debugf("Unable to get group key of %s: %v", topic, err)
+		}
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-time.After(keyRetryInterval):
+		}
+	}
+}
+
+// applyKeyUpdate open group key sealed to this node, updates without a key
+// of this node e.g: after it was removed from the group are ignored
+func (n *Node) applyKeyUpdate(topic string, raw []byte) error {
+	var update keyUpdate
+	if err := json.Unmarshal(raw, &update); err != nil {
+		return err
+	}
+	sealed, ok := update.Keys[n.host.ID().Pretty()]
+	if !ok {
+		return ErrNotMember
+	}
+	key, err := keypair.Open(n.host.Peerstore().PrivKey(n.host.ID()), sealed)
+	if err != nil {
+		return err
+	}
+	n.addGroupKey(topic, update.Epoch, key)
+	return nil
+}
+
+// addGroup register an encrypted topic
+func (n *Node) addGroup(topic string, owner peer.ID) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if _, ok := n.groups[topic]; ok {
+		return ErrInvalidGroup
+	}
+	n.groups[topic] = &groupKeys{owner: owner, keys: make(map[uint64][]byte)}
+	return nil
+}
+
+// removeGroup unregister an encrypted topic
+func (n *Node) removeGroup(topic string) {
+	n.mutex.Lock()
+	delete(n.groups, topic)
+	n.mutex.Unlock()
+}
+
+// addGroupKey keep a group key of an encrypted topic
+func (n *Node) addGroupKey(topic string, epoch uint64, key []byte) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if group, ok := n.groups[topic]; ok {
+		group.add(epoch, key)
+	}
+}
+
+// currentGroupKey get the newest group key of an encrypted topic
+func (n *Node) currentGroupKey(topic string) (uint64, []byte, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	group, ok := n.groups[topic]
+	if !ok || group.current == 0 {
+		return 0, nil, ErrNoGroupKey
+	}
+	return group.current, group.keys[group.current], nil
+}
+
+// isEncrypted check if a topic is encrypted
+func (n *Node) isEncrypted(topic string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	_, ok := n.groups[topic]
+	return ok
+}
+
+// sealMessage seal payload of an encrypted topic with current group key,
+// payloads of other topics are returned as they are
+func (n *Node) sealMessage(topic string, data []byte) ([]byte, error) {
+	if !n.isEncrypted(topic) {
+		return data, nil
+	}
+	epoch, key, err := n.currentGroupKey(topic)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := groupCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, sealedHeaderSize, sealedHeaderSize+len(data)+aead.Overhead())
+	sealed[0] = sealedVersion
+	binary.BigEndian.PutUint64(sealed[1:9], epoch)
+	nonce := sealed[9:sealedHeaderSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(sealed, nonce, data, []byte(topic)), nil
+}
+
+// openMessage open payload of an encrypted topic with the group key of its
+// epoch, payloads of other topics are returned as they are
+func (n *Node) openMessage(topic string, sealed []byte) ([]byte, error) {
+	n.mutex.Lock()
+	group, encrypted := n.groups[topic]
+	var keys map[uint64][]byte
+	if encrypted {
+		keys = make(map[uint64][]byte, len(group.keys))
+		for epoch, key := range group.keys {
+			keys[epoch] = key
+		}
+	}
+	n.mutex.Unlock()
+	if !encrypted {
+		return sealed, nil
+	}
+	if len(sealed) < sealedHeaderSize || sealed[0] != sealedVersion {
+		return nil, errors.New("payload is not sealed")
+	}
+	epoch := binary.BigEndian.Uint64(sealed[1:9])
+	key, ok := keys[epoch]
+	if !ok {
+		return nil, fmt.Errorf("%v, epoch %d", ErrNoGroupKey, epoch)
+	}
+	aead, err := groupCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, sealed[9:sealedHeaderSize], sealed[sealedHeaderSize:], []byte(topic))
+}
+
+// groupCipher AES-GCM cipher of a group key
+func groupCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// headerMagic prefix of messages carrying a p2sub header, payloads of plain
+// topics are published as they are unless they start with it. Neither text
+// nor JSON starts with zero
+var headerMagic = []byte{0, 'p', '2', 's'}
+
+// headerVersion version of header encoding
+const headerVersion = 1
+
+// maxHeaderSize maximum size of an encoded header, manifests of chunked
+// messages list hashes of their fragments
+const maxHeaderSize = 64 << 10
+
+// ErrInvalidHeader message starts with header magic but its header is broken
+var ErrInvalidHeader = errors.New("invalid message header")
+
+// Header p2sub header of a message, it's only added to messages of topics
+// which need it e.g: ordered topics. Header is not encrypted, relaying peers
+// are able to read it
+type Header struct {
+	// Epoch start of publisher, sequence numbers restart with each epoch
+	Epoch int64 `json:"epoch,omitempty"`
+	// Seq sequence number of message among messages of its publisher on the
+	// topic, it starts at 1
+	Seq uint64 `json:"seq,omitempty"`
+	// Key application key of message given by publisher, retries of a
+	// message with the same key are duplicates on topics with key dedup
+	Key string `json:"key,omitempty"`
+	// Expires expiry of message in unix milliseconds, expired messages are
+	// neither forwarded nor delivered
+	Expires int64 `json:"expires,omitempty"`
+	// Encoding compression of payload e.g: gzip, payloads of encrypted
+	// topics are never compressed
+	Encoding string `json:"encoding,omitempty"`
+	// Fragment hash of payload of a fragment of a chunked message
+	Fragment string `json:"fragment,omitempty"`
+	// Manifest manifest of a chunked message, its payload is joined from
+	// its fragments
+	Manifest *Manifest `json:"manifest,omitempty"`
+}
+
+// isEmpty check if header has no field set
+func (h *Header) isEmpty() bool {
+	return *h == Header{}
+}
+
+// encodeHeader prefix payload with a header:
+//
+//	magic(4) | version(1) | uvarint length | JSON header | payload
+func encodeHeader(header *Header, payload []byte) ([]byte, error) {
+	raw, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > maxHeaderSize {
+		return nil, fmt.Errorf("header of %d bytes is larger than %d bytes", len(raw), maxHeaderSize)
+	}
+	prefix := make([]byte, binary.MaxVarintLen64)
+	size := binary.PutUvarint(prefix, uint64(len(raw)))
+	data := make([]byte, 0, len(headerMagic)+1+size+len(raw)+len(payload))
+	data = append(data, headerMagic...)
+	data = append(data, headerVersion)
+	data = append(data, prefix[:size]...)
+	data = append(data, raw...)
+	return append(data, payload...), nil
+}
+
+// decodeHeader split a message into its header and payload, messages
+// without header have an empty header
+func decodeHeader(data []byte) (*Header, []byte, error) {
+	header := &Header{}
+	if !bytes.HasPrefix(data, headerMagic) {
+		return header, data, nil
+	}
+	data = data[len(headerMagic):]
+	if len(data) == 0 || data[0] != headerVersion {
+		return nil, nil, ErrInvalidHeader
+	}
+	size, n := binary.Uvarint(data[1:])
+	if n <= 0 || size > maxHeaderSize || uint64(len(data)-1-n) < size {
+		return nil, nil, ErrInvalidHeader
+	}
+	start := 1 + n
+	if err := json.Unmarshal(data[start:start+int(size)], header); err != nil {
+		return nil, nil, ErrInvalidHeader
+	}
+	return header, data[start+int(size):], nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	headers := []*Header{
+		{},
+		{Epoch: 1600000000000000000, Seq: 42},
+		{Key: "order-1", Expires: 1600000000000, Encoding: EncodingZstd},
+		{Fragment: strings.Repeat("a", 64)},
+		{Manifest: &Manifest{ID: strings.Repeat("b", 64), Size: 3, Fragments: []string{strings.Repeat("c", 64)}}},
+	}
+	for _, header := range headers {
+		for _, payload := range [][]byte{nil, []byte("payload"), {0, 'p', '2', 's'}} {
+			data, err := encodeHeader(header, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, decodedPayload, err := decodeHeader(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, header) {
+				t.Fatalf("decoded header %+v, expected %+v", decoded, header)
+			}
+			if !bytes.Equal(decodedPayload, payload) {
+				t.Fatalf("decoded payload %q, expected %q", decodedPayload, payload)
+			}
+		}
+	}
+}
+
+func TestDecodePlainMessage(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte(`{"a": 1}`), {0, 'p', '2'}} {
+		header, payload, err := decodeHeader(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !header.isEmpty() || !bytes.Equal(payload, data) {
+			t.Fatalf("plain message %q was changed to %+v %q", data, header, payload)
+		}
+	}
+}
+
+func TestDecodeInvalidHeader(t *testing.T) {
+	valid, err := encodeHeader(&Header{Seq: 1}, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := [][]byte{
+		headerMagic,
+		append(append([]byte{}, headerMagic...), 2),
+		append(append([]byte{}, headerMagic...), headerVersion),
+		append(append([]byte{}, headerMagic...), headerVersion, 0xff, 0xff, 0xff, 0xff, 0x0f),
+		append(append([]byte{}, headerMagic...), headerVersion, 10, '{'),
+		append(append([]byte{}, headerMagic...), headerVersion, 3, 'n', 'o', 't'),
+		valid[:len(headerMagic)+3],
+	}
+	for _, data := range invalid {
+		if _, _, err := decodeHeader(data); err != ErrInvalidHeader {
+			t.Fatalf("invalid header %q: %v", data, err)
+		}
+	}
+}
+
+func TestEncodeHeaderTooLarge(t *testing.T) {
+	if _, err := encodeHeader(&Header{Key: strings.Repeat("k", maxHeaderSize)}, nil); err == nil {
+		t.Fatal("header larger than max header size was encoded")
+	}
+}
+
+func TestEncodeMagicPayload(t *testing.T) {
+	cfg := testConfig(t)
+	n := &Node{cfg: cfg, log: cfg.Logger}
+	// Payload which looks like a header is framed, even without header fields
+	data := append(append([]byte{}, headerMagic...), "payload"...)
+	raw, err := n.encodeMessage("plain", &Header{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, payload, err := decodeHeader(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.isEmpty() || !bytes.Equal(payload, data) {
+		t.Fatalf("payload %q was decoded as %+v %q", data, header, payload)
+	}
+	raw, err = n.encodeMessage("plain", &Header{}, []byte("payload"))
+	if err != nil || string(raw) != "payload" {
+		t.Fatalf("plain payload was encoded as %q: %v", raw, err)
+	}
+}
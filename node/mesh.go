@@ -0,0 +1,88 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+// meshTracker keep track of gossipsub mesh of each topic, gossipsub doesn't
+// expose its mesh so it's rebuilt from GRAFT/PRUNE trace events
+type meshTracker struct {
+	mesh  map[string]map[peer.ID]struct{}
+	mutex sync.RWMutex
+}
+
+var _ pubsub.EventTracer = (*meshTracker)(nil)
+
+// newMeshTracker create an empty mesh tracker
+func newMeshTracker() *meshTracker {
+	return &meshTracker{mesh: make(map[string]map[peer.ID]struct{})}
+}
+
+// Trace handle a trace event, it's called from gossipsub event loop so it must not block
+func (m *meshTracker) Trace(evt *pb.TraceEvent) {
+	switch evt.GetType() {
+	case pb.TraceEvent_GRAFT:
+		graft := evt.GetGraft()
+		if peerID, err := peer.IDFromBytes(graft.GetPeerID()); err == nil {
+			m.mutex.Lock()
+			if _, ok := m.mesh[graft.GetTopic()]; !ok {
+				m.mesh[graft.GetTopic()] = make(map[peer.ID]struct{})
+			}
+			m.mesh[graft.GetTopic()][peerID] = struct{}{}
+			m.mutex.Unlock()
+		}
+	case pb.TraceEvent_PRUNE:
+		prune := evt.GetPrune()
+		if peerID, err := peer.IDFromBytes(prune.GetPeerID()); err == nil {
+			m.mutex.Lock()
+			delete(m.mesh[prune.GetTopic()], peerID)
+			m.mutex.Unlock()
+		}
+	case pb.TraceEvent_REMOVE_PEER:
+		// Gossipsub removes a disconnected peer from all meshes without pruning
+		if peerID, err := peer.IDFromBytes(evt.GetRemovePeer().GetPeerID()); err == nil {
+			m.mutex.Lock()
+			for _, peers := range m.mesh {
+				delete(peers, peerID)
+			}
+			m.mutex.Unlock()
+		}
+	case pb.TraceEvent_LEAVE:
+		m.mutex.Lock()
+		delete(m.mesh, evt.GetLeave().GetTopic())
+		m.mutex.Unlock()
+	}
+}
+
+// peers get mesh peers of a topic
+func (m *meshTracker) peers(topic string) []peer.ID {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	peers := make([]peer.ID, 0, len(m.mesh[topic]))
+	for peerID := range m.mesh[topic] {
+		peers = append(peers, peerID)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i] < peers[j]
+	})
+	return peers
+}
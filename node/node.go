@@ -0,0 +1,516 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package node embeddable p2sub node, it wires libp2p host, gossipsub, DHT
+// and peer discovery together
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	coreDiscovery "github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	discovery "github.com/libp2p/go-libp2p-discovery"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+)
+
+// Errors of node
+var (
+	ErrNotStarted     = errors.New("node was not started")
+	ErrAlreadyStarted = errors.New("node was already started")
+	ErrClosed         = errors.New("node was closed")
+)
+
+// closer component which has to be released on close
+type closer struct {
+	name  string
+	close func() error
+}
+
+// Node p2sub node
+type Node struct {
+	cfg *Config
+	log *zap.SugaredLogger
+	// ctx context of network services, it's canceled after all components were closed
+	ctx           context.Context
+	cancel        context.CancelFunc
+	host          host.Host
+	pubsub        *pubsub.PubSub
+	discovery     *DiscoveryManager
+	mesh          *meshTracker
+	known         *topicTracker
+	topics        map[string]*pubsub.Topic
+	subscriptions map[*Subscription]struct{}
+	pending       map[string]chan *Reply
+	directHandler DirectHandler
+	// recipientHandler handler of envelopes addressed to a recipient inside the node
+	recipientHandler DirectHandler
+	groups           map[string]*groupKeys
+	history          *history
+	dedup            *dedupCache
+	fragments        *fragmentPool
+	queues           *queueCounters
+	// epoch start of the node, sequence numbers of ordered topics restart with it
+	epoch   int64
+	closers []closer
+	started bool
+	closed  bool
+	mutex   sync.Mutex
+}
+
+// New create a new node with given options, the node does nothing until it's started
+func New(opts ...Option) (*Node, error) {
+	cfg := defaultConfig()
+	if err := cfg.Apply(opts...); err != nil {
+		return nil, err
+	}
+	if cfg.Host == nil && cfg.PrivateKey == nil {
+		return nil, errors.New("identity of node is required")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Node{
+		cfg:           cfg,
+		log:           cfg.Logger,
+		ctx:           ctx,
+		cancel:        cancel,
+		mesh:          newMeshTracker(),
+		known:         newTopicTracker(cfg.MaxKnownTopics),
+		topics:        make(map[string]*pubsub.Topic),
+		subscriptions: make(map[*Subscription]struct{}),
+		pending:       make(map[string]chan *Reply),
+		groups:        make(map[string]*groupKeys),
+		history:       newHistory(),
+		dedup:         newDedupCache(maxDedupIDs),
+		fragments:     newFragmentPool(cfg.ReassemblyMemory, cfg.ReassemblyTimeout),
+		queues:        &queueCounters{},
+		epoch:         time.Now().UnixNano(),
+	}, nil
+}
+
+// Start start libp2p host, gossipsub and peer discovery, given context only
+// bounds the startup e.g: connecting to bootstrap nodes, use Close to stop the node
+func (n *Node) Start(ctx context.Context) error {
+	n.mutex.Lock()
+	if n.closed {
+		n.mutex.Unlock()
+		return ErrClosed
+	}
+	if n.started {
+		n.mutex.Unlock()
+		return ErrAlreadyStarted
+	}
+	n.started = true
+	n.mutex.Unlock()
+
+	if err := n.start(ctx); err != nil {
+		n.Close()
+		return err
+	}
+	return nil
+}
+
+func (n *Node) start(ctx context.Context) error {
+	cfg := n.cfg
+
+	// Setup host with key
+	if cfg.Host == nil {
+		hostOptions := []libp2p.Option{
+			libp2p.ListenAddrs(cfg.ListenAddrs...),
+			libp2p.Identity(cfg.PrivateKey),
+		}
+		// Only peers with the same pre-shared key are able to handshake with
+		// current node if private network was set
+		if cfg.PSK != nil {
+			n.log.Debug("Private network mode")
+			hostOptions = append(hostOptions, libp2p.PrivateNetwork(cfg.PSK))
+		}
+		host, err := libp2p.New(n.ctx, hostOptions...)
+		if err != nil {
+			return err
+		}
+		n.host = host
+		n.onClose("host", host.Close)
+	} else {
+		n.host = cfg.Host
+	}
+	n.log.Debugf("Node ID: %s", n.host.ID())
+
+	// Replies of requests, direct envelopes and recovered messages come
+	// over direct streams
+	n.host.SetStreamHandler(ReplyProtocol, n.handleReply)
+	n.host.SetStreamHandler(DirectProtocol, n.handleDirect)
+	n.host.SetStreamHandler(RecoverProtocol, n.handleRecover)
+	n.onClose("stream handlers", func() error {
+		n.host.RemoveStreamHandler(ReplyProtocol)
+		n.host.RemoveStreamHandler(DirectProtocol)
+		n.host.RemoveStreamHandler(RecoverProtocol)
+		return nil
+	})
+
+	// Bootstrap peers of current node
+	bootstrapPeers, err := n.bootstrapPeers()
+	if err != nil {
+		return err
+	}
+
+	// Trace events are written to files or sent to a remote tracer
+	tracers, err := n.startTracers()
+	if err != nil {
+		return err
+	}
+	tracer := append(multiTracer{n.mesh, n.known}, cfg.Tracers...)
+	tracer = append(tracer, tracers...)
+
+	// Router parameters are process-wide, nodes of a process must agree on them
+	if err := cfg.GossipSub.acquireRouter(); err != nil {
+		return err
+	}
+	n.onClose("gossipsub router parameters", releaseRouter)
+
+	// Start new gossip pub sub
+	pubsubOptions := append([]pubsub.Option{
+		pubsub.WithPeerExchange(true),
+		pubsub.WithEventTracer(tracer),
+		pubsub.WithMessageIdFn(n.messageID),
+	}, cfg.GossipSub.options()...)
+	n.pubsub, err = pubsub.NewGossipSub(n.ctx, n.host, pubsubOptions...)
+	if err != nil {
+		return err
+	}
+	go n.fragments.run(n.ctx)
+	if cfg.Observer != nil {
+		for pattern := range cfg.Topics {
+			if !IsPattern(pattern) {
+				cfg.Observer.Known(pattern)
+			}
+		}
+	}
+
+	// Detect other nodes by domain
+	var discoverer coreDiscovery.Discovery
+	if cfg.Domain != "" && cfg.isDiscoveryEnabled(DiscoveryDHT) {
+		// Start a DHT, for use in peer discovery. We can't just make a new DHT
+		// client because we want each peer to maintain its own local copy of the
+		// DHT, so that the bootstrapping node of the DHT can go down without
+		// inhibiting future peer discovery.
+		kademliaDHT, err := dht.New(n.ctx, n.host, dht.BootstrapPeers(bootstrapPeers...))
+		if err != nil {
+			return err
+		}
+		n.onClose("DHT", kademliaDHT.Close)
+
+		// Bootstrap the DHT. In the default configuration, this spawns a Background
+		// thread that will refresh the peer table every five minutes.
+		n.log.Debug("Bootstrapping the DHT")
+		if err = kademliaDHT.Bootstrap(n.ctx); err != nil {
+			return err
+		}
+
+		// Let's connect to the bootstrap nodes first. They will tell us about the
+		// other nodes in the network.
+		n.connectBootstrapPeers(ctx, bootstrapPeers)
+
+		// We use a rendezvous point `domain` to announce our location and look
+		// for others who have announced, discovery manager will keep doing it.
+		discoverer = discovery.NewRoutingDiscovery(kademliaDHT)
+	}
+
+	// Discovery manager keeps current node connected and reconnects lost peers
+	n.discovery = NewDiscoveryManager(n.ctx, n.host, discoverer, cfg.Domain, cfg.DiscoveryInterval, cfg.TargetPeers, n.log)
+	n.discovery.observer = cfg.Observer
+	n.discovery.Start()
+	n.onClose("discovery manager", n.discovery.Close)
+
+	// Look for nodes advertising the same domain in local network
+	if cfg.Domain != "" && cfg.isDiscoveryEnabled(DiscoveryMDNS) {
+		mdnsService, err := startMdnsDiscovery(n.ctx, n.host, cfg.Domain, cfg.MdnsInterval, n.discovery, n.log)
+		if err != nil {
+			return err
+		}
+		n.onClose("mDNS service", mdnsService.Close)
+	}
+
+	// Connect to direct peers, they will be reconnected if connection was lost
+	for _, peerInfo := range cfg.DirectPeers {
+		n.log.Infof("Boot node is: %s", peerInfo)
+		n.discovery.HandlePeerFound(peerInfo)
+	}
+
+	return nil
+}
+
+// Close unsubscribe all topics and stop all services of the node
+func (n *Node) Close() error {
+	n.mutex.Lock()
+	if n.closed {
+		n.mutex.Unlock()
+		return nil
+	}
+	n.closed = true
+	subscriptions := make([]*Subscription, 0, len(n.subscriptions))
+	for sub := range n.subscriptions {
+		subscriptions = append(subscriptions, sub)
+	}
+	n.mutex.Unlock()
+
+	// Subscriptions have to be canceled before their topics could be closed
+	for _, sub := range subscriptions {
+		sub.Cancel()
+	}
+
+	errs := make([]string, 0)
+	n.mutex.Lock()
+	for name, topic := range n.topics {
+		n.log.Debugf("Closing topic %s", name)
+		if err := closeTopic(topic); err != nil {
+			errs = append(errs, fmt.Sprintf("topic %s: %v", name, err))
+		}
+		delete(n.topics, name)
+	}
+	closers := n.closers
+	n.closers = nil
+	n.mutex.Unlock()
+
+	for i := len(closers) - 1; i >= 0; i-- {
+		n.log.Debugf("Closing %s", closers[i].name)
+		if err := closers[i].close(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", closers[i].name, err))
+		}
+	}
+	n.cancel()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to close node: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// closeTopic close a topic, canceled subscriptions are removed asynchronously
+// by gossipsub so we give it a moment
+func closeTopic(topic *pubsub.Topic) error {
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		if err = topic.Close(); err == nil {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
+// onClose register a component, components are closed in reverse order
+func (n *Node) onClose(name string, close func() error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.closers = append(n.closers, closer{name: name, close: close})
+}
+
+// Topic get handle of a topic, the node joins the topic if it did not
+func (n *Node) Topic(name string) (*pubsub.Topic, error) {
+	topic, _, err := n.join(name)
+	return topic, err
+}
+
+// join get handle of a topic, joined is true if the node just joined it
+func (n *Node) join(name string) (*pubsub.Topic, bool, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed {
+		return nil, false, ErrClosed
+	}
+	if n.pubsub == nil {
+		return nil, false, ErrNotStarted
+	}
+	if topic, ok := n.topics[name]; ok {
+		return topic, false, nil
+	}
+	// Validators are cheap checks, running them inline avoids a goroutine per message
+	if err := n.pubsub.RegisterTopicValidator(name, n.validator(name), pubsub.WithValidatorInline(true)); err != nil {
+		return nil, false, err
+	}
+	topic, err := n.pubsub.Join(name)
+	if err != nil {
+		n.pubsub.UnregisterTopicValidator(name)
+		return nil, false, err
+	}
+	n.topics[name] = topic
+	if n.cfg.Observer != nil {
+		n.cfg.Observer.Known(name)
+	}
+	return topic, true, nil
+}
+
+// Topics get names of joined topics
+func (n *Node) Topics() []string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	names := make([]string, 0, len(n.topics))
+	for name := range n.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MeshPeers get peers in gossipsub mesh of a topic
+func (n *Node) MeshPeers(topic string) []peer.ID {
+	return n.mesh.peers(topic)
+}
+
+// Publish publish data to a topic, options set header fields of the message
+// e.g: its key or its time to live
+func (n *Node) Publish(ctx context.Context, topic string, data []byte, opts ...PublishOption) error {
+	if IsPattern(topic) {
+		return ErrWildcardTopic
+	}
+	header := &Header{}
+	for _, opt := range opts {
+		opt(header)
+	}
+	if len(header.Key) > MaxKeyLength {
+		return ErrKeyTooLong
+	}
+	if err := n.cfg.checkTTL(topic, header, time.Now()); err != nil {
+		return err
+	}
+	if !n.cfg.TopicRateLimit.Allow(topic) {
+		return n.throttled(ScopeTopic, topic, topic)
+	}
+	// Payloads of encrypted topics are not compressed, size of a compressed
+	// payload would leak how compressible the plaintext is
+	if !n.isEncrypted(topic) {
+		compressed, encoding, err := n.cfg.compressMessage(topic, data)
+		if err != nil {
+			return err
+		}
+		data = compressed
+		header.Encoding = encoding
+	}
+	data, err := n.sealMessage(topic, data)
+	if err != nil {
+		return err
+	}
+	params := n.cfg.topicParams(topic)
+	if len(data) > params.MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	handle, joined, err := n.join(topic)
+	if err != nil {
+		return err
+	}
+	if joined {
+		// Matching pattern subscriptions of this node must not miss the first
+		// message of a topic it just joined
+		n.known.notify(topic)
+	}
+	if params.ChunkSize > 0 && len(data) > params.ChunkSize {
+		// Manifest is published after fragments, so subscribers mostly
+		// have all of them when it arrives
+		if err := n.publishFragments(ctx, handle, header, data, params.ChunkSize); err != nil {
+			return err
+		}
+		data = nil
+	}
+	data, err = n.encodeMessage(topic, header, data)
+	if err != nil {
+		return err
+	}
+	return handle.Publish(ctx, data)
+}
+
+// PublishWithKey publish data to a topic with an application key, retries
+// with the same key are delivered once on topics with key dedup
+func (n *Node) PublishWithKey(ctx context.Context, topic string, key string, data []byte) error {
+	return n.Publish(ctx, topic, data, WithKey(key))
+}
+
+// Subscribe subscribe to a topic, use SubscribePattern to subscribe to
+// topics matching a pattern
+func (n *Node) Subscribe(topic string) (*Subscription, error) {
+	if IsPattern(topic) {
+		return nil, ErrWildcardTopic
+	}
+	handle, err := n.Topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := handle.Subscribe()
+	if err != nil {
+		return nil, err
+	}
+	subscription := &Subscription{topic: topic, sub: sub, node: n}
+	subscription.received = newReceiver(n.ctx, n, topic, sub)
+	if params := n.cfg.topicParams(topic); params.Ordered {
+		subscription.ordered = newSequencer(n, topic, subscription.received, params)
+	}
+	n.mutex.Lock()
+	n.subscriptions[subscription] = struct{}{}
+	n.mutex.Unlock()
+	return subscription, nil
+}
+
+// Peers get connected peers
+func (n *Node) Peers() []peer.ID {
+	if n.host == nil {
+		return nil
+	}
+	return n.host.Network().Peers()
+}
+
+// ID get peer ID of the node
+func (n *Node) ID() peer.ID {
+	if n.host == nil {
+		return ""
+	}
+	return n.host.ID()
+}
+
+// Addrs get listen addresses of the node
+func (n *Node) Addrs() []multiaddr.Multiaddr {
+	if n.host == nil {
+		return nil
+	}
+	return n.host.Addrs()
+}
+
+// Host get underlying libp2p host
+func (n *Node) Host() host.Host {
+	return n.host
+}
+
+// PubSub get underlying gossipsub
+func (n *Node) PubSub() *pubsub.PubSub {
+	return n.pubsub
+}
+
+// Discovery get discovery manager of the node
+func (n *Node) Discovery() *DiscoveryManager {
+	return n.discovery
+}
+
+// Config get configuration of the node
+func (n *Node) Config() Config {
+	return *n.cfg
+}
@@ -0,0 +1,375 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"errors"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/pnet"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/p2sub/p2sub/logger"
+	"github.com/p2sub/p2sub/ratelimit"
+	"go.uber.org/zap"
+)
+
+// DefaultDomain rendezvous string used to discover same node
+const DefaultDomain = "P2Sub::alpha::0.0.1"
+
+// DefaultRequestTimeout timeout of requests without deadline
+const DefaultRequestTimeout = 10 * time.Second
+
+// Config configuration of a node
+type Config struct {
+	Host              host.Host
+	PrivateKey        crypto.PrivKey
+	ListenAddrs       []multiaddr.Multiaddr
+	PSK               pnet.PSK
+	BootstrapPeers    []peer.AddrInfo
+	BootstrapRetries  uint
+	NoPublicBootstrap bool
+	DirectPeers       []peer.AddrInfo
+	Domain            string
+	DiscoveryModes    []string
+	DiscoveryInterval time.Duration
+	TargetPeers       int
+	MdnsInterval      time.Duration
+	GossipSub         GossipSubParams
+	Topics            map[string]TopicParams
+	Tracers           []pubsub.EventTracer
+	TraceFile         string
+	TraceFormat       string
+	RemoteTracer      *peer.AddrInfo
+	Validators        []Validator
+	PeerRateLimit     *ratelimit.Limiter
+	TopicRateLimit    *ratelimit.Limiter
+	RequestTimeout    time.Duration
+	ClockSkew         time.Duration
+	ReassemblyMemory  int
+	ReassemblyTimeout time.Duration
+	MaxKnownTopics    int
+	MaxPatternTopics  int
+	CatchAllPatterns  bool
+	Observer          Observer
+	Logger            *zap.SugaredLogger
+}
+
+// Option add new options to node configuration
+type Option func(cfg *Config) error
+
+// Apply apply options to current configuration
+func (c *Config) Apply(opts ...Option) error {
+	for _, opt := range opts {
+		err := opt(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultConfig configuration of a node before options were applied
+func defaultConfig() *Config {
+	gossipSub, _ := Preset(PresetDefault)
+	return &Config{
+		BootstrapRetries:  5,
+		Domain:            DefaultDomain,
+		DiscoveryModes:    []string{DiscoveryDHT},
+		DiscoveryInterval: 30 * time.Second,
+		TargetPeers:       8,
+		MdnsInterval:      10 * time.Second,
+		GossipSub:         gossipSub,
+		RequestTimeout:    DefaultRequestTimeout,
+		ClockSkew:         DefaultClockSkew,
+		ReassemblyMemory:  DefaultReassemblyMemory,
+		ReassemblyTimeout: DefaultReassemblyTimeout,
+		MaxKnownTopics:    DefaultMaxKnownTopics,
+		MaxPatternTopics:  DefaultMaxPatternTopics,
+		Logger:            logger.GetSugarLogger(),
+	}
+}
+
+// Host use an existing libp2p host instead of creating a new one, identity,
+// listen addresses and private network options are ignored
+func Host(h host.Host) Option {
+	return func(cfg *Config) error {
+		cfg.Host = h
+		return nil
+	}
+}
+
+// Identity private key of the node
+func Identity(key crypto.PrivKey) Option {
+	return func(cfg *Config) error {
+		cfg.PrivateKey = key
+		return nil
+	}
+}
+
+// ListenAddrs addresses the node listens on
+func ListenAddrs(addrs ...multiaddr.Multiaddr) Option {
+	return func(cfg *Config) error {
+		cfg.ListenAddrs = append(cfg.ListenAddrs, addrs...)
+		return nil
+	}
+}
+
+// PrivateNetwork join private network with given pre-shared key, public
+// bootstrap nodes are never dialed
+func PrivateNetwork(psk pnet.PSK) Option {
+	return func(cfg *Config) error {
+		cfg.PSK = psk
+		return nil
+	}
+}
+
+// BootstrapPeers bootstrap nodes replace public bootstrap nodes
+func BootstrapPeers(peers ...peer.AddrInfo) Option {
+	return func(cfg *Config) error {
+		cfg.BootstrapPeers = append(cfg.BootstrapPeers, peers...)
+		return nil
+	}
+}
+
+// BootstrapRetries number of retries with exponential backoff for each bootstrap node
+func BootstrapRetries(retries uint) Option {
+	return func(cfg *Config) error {
+		cfg.BootstrapRetries = retries
+		return nil
+	}
+}
+
+// NoPublicBootstrap never dial public bootstrap nodes
+func NoPublicBootstrap() Option {
+	return func(cfg *Config) error {
+		cfg.NoPublicBootstrap = true
+		return nil
+	}
+}
+
+// DirectConnect peers to connect to on start, they are reconnected if
+// connection was lost
+func DirectConnect(peers ...peer.AddrInfo) Option {
+	return func(cfg *Config) error {
+		cfg.DirectPeers = append(cfg.DirectPeers, peers...)
+		return nil
+	}
+}
+
+// Domain rendezvous string used to discover same node, empty domain disables discovery
+func Domain(domain string) Option {
+	return func(cfg *Config) error {
+		cfg.Domain = domain
+		return nil
+	}
+}
+
+// Discovery discovery modes of nodes in the same domain
+func Discovery(modes ...string) Option {
+	return func(cfg *Config) error {
+		if err := checkDiscoveryModes(modes); err != nil {
+			return err
+		}
+		cfg.DiscoveryModes = modes
+		return nil
+	}
+}
+
+// DiscoveryInterval interval of discovery loop
+func DiscoveryInterval(interval time.Duration) Option {
+	return func(cfg *Config) error {
+		if interval <= 0 {
+			return errors.New("discovery interval must be positive")
+		}
+		cfg.DiscoveryInterval = interval
+		return nil
+	}
+}
+
+// TargetPeers number of connected peers discovery manager tries to reach, it
+// stops querying the rendezvous above it but doesn't close any connection
+func TargetPeers(targetPeers int) Option {
+	return func(cfg *Config) error {
+		cfg.TargetPeers = targetPeers
+		return nil
+	}
+}
+
+// MdnsInterval interval of mDNS queries
+func MdnsInterval(interval time.Duration) Option {
+	return func(cfg *Config) error {
+		if interval <= 0 {
+			return errors.New("mDNS interval must be positive")
+		}
+		cfg.MdnsInterval = interval
+		return nil
+	}
+}
+
+// GossipSub parameters of gossipsub router and peer scoring. Router
+// parameters are process-wide, not per node: a node fails to start with
+// ErrRouterParams while another node of the process runs with different ones
+func GossipSub(params GossipSubParams) Option {
+	return func(cfg *Config) error {
+		if err := params.validate(); err != nil {
+			return err
+		}
+		cfg.GossipSub = params
+		return nil
+	}
+}
+
+// EventTracer receive gossipsub trace events, it could be given several times
+func EventTracer(tracer pubsub.EventTracer) Option {
+	return func(cfg *Config) error {
+		cfg.Tracers = append(cfg.Tracers, tracer)
+		return nil
+	}
+}
+
+// TraceFile write gossipsub trace events to a file in given format
+func TraceFile(file string, format string) Option {
+	return func(cfg *Config) error {
+		if err := checkTraceFormat(format); err != nil {
+			return err
+		}
+		cfg.TraceFile = file
+		cfg.TraceFormat = format
+		return nil
+	}
+}
+
+// RemoteTracer send gossipsub trace events to a remote tracer peer e.g: traced
+// of go-libp2p-pubsub-tracer
+func RemoteTracer(tracer peer.AddrInfo) Option {
+	return func(cfg *Config) error {
+		cfg.RemoteTracer = &tracer
+		return nil
+	}
+}
+
+// Validators validate messages of all topics, they run in given order
+func Validators(validators ...Validator) Option {
+	return func(cfg *Config) error {
+		cfg.Validators = append(cfg.Validators, validators...)
+		return nil
+	}
+}
+
+// PeerRateLimit limit messages originated by each remote peer to rate
+// messages per second with given burst, messages over limit are ignored
+func PeerRateLimit(rate float64, burst int) Option {
+	return func(cfg *Config) error {
+		cfg.PeerRateLimit = ratelimit.New(rate, burst)
+		return nil
+	}
+}
+
+// TopicRateLimit limit messages of each topic to rate messages per second
+// with given burst, local publishes over limit fail with *RateLimitError
+func TopicRateLimit(rate float64, burst int) Option {
+	return func(cfg *Config) error {
+		cfg.TopicRateLimit = ratelimit.New(rate, burst)
+		return nil
+	}
+}
+
+// RequestTimeout timeout of requests without deadline and of handling a request
+func RequestTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) error {
+		if timeout <= 0 {
+			return errors.New("request timeout must be positive")
+		}
+		cfg.RequestTimeout = timeout
+		return nil
+	}
+}
+
+// ClockSkew difference of clocks between nodes tolerated when expiry of
+// messages is checked
+func ClockSkew(skew time.Duration) Option {
+	return func(cfg *Config) error {
+		if skew < 0 {
+			return errors.New("clock skew must not be negative")
+		}
+		cfg.ClockSkew = skew
+		return nil
+	}
+}
+
+// Reassembly bytes of fragments of chunked messages a node keeps and time
+// a chunked message waits for its missing fragments
+func Reassembly(memory int, timeout time.Duration) Option {
+	return func(cfg *Config) error {
+		if memory <= 0 || timeout <= 0 {
+			return errors.New("reassembly memory and timeout must be positive")
+		}
+		cfg.ReassemblyMemory = memory
+		cfg.ReassemblyTimeout = timeout
+		return nil
+	}
+}
+
+// TopicLimits topics the node keeps track of and topics a pattern
+// subscription joins at most
+func TopicLimits(known int, perPattern int) Option {
+	return func(cfg *Config) error {
+		if known <= 0 || perPattern <= 0 {
+			return errors.New("topic limits must be positive")
+		}
+		cfg.MaxKnownTopics = known
+		cfg.MaxPatternTopics = perPattern
+		return nil
+	}
+}
+
+// CatchAllPatterns allow patterns matching every topic e.g: "#", they join
+// any topic a peer announces
+func CatchAllPatterns() Option {
+	return func(cfg *Config) error {
+		cfg.CatchAllPatterns = true
+		return nil
+	}
+}
+
+// Observe observe events of the node
+func Observe(observer Observer) Option {
+	return func(cfg *Config) error {
+		cfg.Observer = observer
+		return nil
+	}
+}
+
+// Logger logger of the node
+func Logger(sugar *zap.SugaredLogger) Option {
+	return func(cfg *Config) error {
+		cfg.Logger = sugar
+		return nil
+	}
+}
+
+// isDiscoveryEnabled check if given discovery mode was enabled
+func (c *Config) isDiscoveryEnabled(mode string) bool {
+	for _, enabledMode := range c.DiscoveryModes {
+		if enabledMode == mode {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,430 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// RecoverProtocol protocol of streams asking a publisher for messages of an
+// ordered topic which were missed
+const RecoverProtocol = protocol.ID("/p2sub/recover/1.0.0")
+
+// recoverRequest request of messages First to Last, Last excluded, of a
+// publisher epoch. Messages are sent back one frame each
+type recoverRequest struct {
+	Topic string `json:"topic"`
+	Epoch int64  `json:"epoch"`
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+}
+
+// history sequence numbers and recent messages published by the node to
+// ordered topics
+type history struct {
+	sequences map[string]uint64
+	messages  map[string]map[uint64][]byte
+	mutex     sync.Mutex
+}
+
+// newHistory create an empty history
+func newHistory() *history {
+	return &history{
+		sequences: make(map[string]uint64),
+		messages:  make(map[string]map[uint64][]byte),
+	}
+}
+
+// next assign next sequence number of a topic
+func (h *history) next(topic string) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.sequences[topic]++
+	return h.sequences[topic]
+}
+
+// store keep a published message, only the last size messages of a topic are kept
+func (h *history) store(topic string, seq uint64, data []byte, size int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.messages[topic]; !ok {
+		h.messages[topic] = make(map[uint64][]byte)
+	}
+	h.messages[topic][seq] = data
+	if seq > uint64(size) {
+		delete(h.messages[topic], seq-uint64(size))
+	}
+}
+
+// get get kept messages of a topic from first to last, last excluded
+func (h *history) get(topic string, first uint64, last uint64) [][]byte {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	found := make([][]byte, 0)
+	for seq := first; seq < last; seq++ {
+		if data, ok := h.messages[topic][seq]; ok {
+			found = append(found, data)
+		}
+	}
+	return found
+}
+
+// encodeMessage add p2sub header to a message if its topic or its publish
+// options need one, or if its payload starts with header magic so it's not
+// mistaken for a header. Messages of ordered topics are numbered and kept
+// for recovery, except chunked ones
+func (n *Node) encodeMessage(topic string, header *Header, data []byte) ([]byte, error) {
+	params := n.cfg.topicParams(topic)
+	if params.Ordered {
+		header.Epoch = n.epoch
+		header.Seq = n.history.next(topic)
+	}
+	if header.isEmpty() && !bytes.HasPrefix(data, headerMagic) {
+		return data, nil
+	}
+	raw, err := encodeHeader(header, data)
+	if err != nil {
+		return nil, err
+	}
+	// Manifests of chunked messages are not kept, their fragments could be
+	// gone from fragment pools so chunked messages are never recovered
+	if params.Ordered && header.Manifest == nil {
+		n.history.store(topic, header.Seq, raw, params.History)
+	}
+	return raw, nil
+}
+
+// handleRecover stream handler of recover requests, only messages still in
+// history which did not expire are sent back
+func (n *Node) handleRecover(stream network.Stream) {
+	from := stream.Conn().RemotePeer()
+	var req recoverRequest
+	if err := readFrame(bufio.NewReader(stream), &req); err != nil {
+		n.log.Debugf("Invalid recover request from %s: %v", from, err)
+		stream.Reset()
+		return
+	}
+	params := n.cfg.topicParams(req.Topic)
+	if !params.Ordered || req.Epoch != n.epoch || req.Last < req.First || !n.cfg.PeerRateLimit.Allow(string(from)) {
+		helpers.FullClose(stream)
+		return
+	}
+	if req.Last-req.First > uint64(params.History) {
+		req.Last = req.First + uint64(params.History)
+	}
+	now := time.Now()
+	for _, data := range n.history.get(req.Topic, req.First, req.Last) {
+		if header, _, err := decodeHeader(data); err != nil || header.Expired(now, 0) {
+			continue
+		}
+		if err := writeFrame(stream, data); err != nil {
+			stream.Reset()
+			return
+		}
+	}
+	helpers.FullClose(stream)
+}
+
+// recoverMessages ask a publisher for messages of an ordered topic
+func (n *Node) recoverMessages(ctx context.Context, from peer.ID, req recoverRequest) ([]*Message, error) {
+	stream, err := n.host.NewStream(ctx, from, RecoverProtocol)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	if err := writeFrame(stream, req); err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	stream.Close()
+	reader := bufio.NewReader(stream)
+	messages := make([]*Message, 0, req.Last-req.First)
+	for {
+		var data []byte
+		if err := readFrame(reader, &data); err != nil {
+			if err == io.EOF {
+				break
+			}
+			stream.Reset()
+			return messages, err
+		}
+		msg, err := n.decodeMessage(req.Topic, from, from, data, nil)
+		if err != nil || msg.Header.Epoch != req.Epoch || msg.Header.Expired(time.Now(), n.cfg.ClockSkew) {
+			continue
+		}
+		msg.duplicate = n.isDuplicate(req.Topic, data)
+		messages = append(messages, msg)
+	}
+	helpers.FullClose(stream)
+	return messages, nil
+}
+
+// sequence reorder state of messages of a publisher
+type sequence struct {
+	epoch    int64
+	expected uint64
+	pending  map[uint64]*Message
+	// since time the oldest pending message has been waiting
+	since time.Time
+	// seen time the last message of the publisher was received
+	seen       time.Time
+	recovering bool
+}
+
+// recovered messages recovered from a publisher
+type recovered struct {
+	from     peer.ID
+	messages []*Message
+}
+
+// sequencer deliver messages of an ordered topic in order of each publisher,
+// messages are held back while an earlier one is missing, until ordering
+// window is full or order delay is over
+type sequencer struct {
+	node       *Node
+	topic      string
+	params     TopicParams
+	received   *receiver
+	ctx        context.Context
+	cancel     context.CancelFunc
+	messages   chan *Message
+	recovered  chan recovered
+	publishers map[peer.ID]*sequence
+	err        error
+	mutex      sync.Mutex
+}
+
+// newSequencer create a sequencer of decoded messages of a subscription, it
+// runs until it's canceled
+func newSequencer(n *Node, topic string, received *receiver, params TopicParams) *sequencer {
+	ctx, cancel := context.WithCancel(n.ctx)
+	q := &sequencer{
+		node:       n,
+		topic:      topic,
+		params:     params,
+		received:   received,
+		ctx:        ctx,
+		cancel:     cancel,
+		messages:   make(chan *Message),
+		recovered:  make(chan recovered),
+		publishers: make(map[peer.ID]*sequence),
+	}
+	go q.run()
+	return q
+}
+
+// next get next message in order
+func (q *sequencer) next(ctx context.Context) (*Message, error) {
+	select {
+	case msg := <-q.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-q.ctx.Done():
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		if q.err != nil {
+			return nil, q.err
+		}
+		return nil, pubsub.ErrSubscriptionCancelled
+	}
+}
+
+// run reorder received and recovered messages until sequencer was canceled
+func (q *sequencer) run() {
+	defer func() {
+		for _, st := range q.publishers {
+			atomic.AddInt64(&q.node.queues.reordering, -int64(len(st.pending)))
+		}
+	}()
+	received := make(chan *Message)
+	go func() {
+		for {
+			msg, err := q.received.next(q.ctx)
+			if err != nil {
+				q.mutex.Lock()
+				q.err = err
+				q.mutex.Unlock()
+				q.cancel()
+				return
+			}
+			select {
+			case received <- msg:
+			case <-q.ctx.Done():
+				return
+			}
+		}
+	}()
+	delay := time.Duration(q.params.OrderDelay)
+	interval := delay / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var ready []*Message
+		select {
+		case <-q.ctx.Done():
+			return
+		case msg := <-received:
+			ready = q.add(msg, time.Now())
+		case result := <-q.recovered:
+			for _, msg := range result.messages {
+				ready = append(ready, q.add(msg, time.Now())...)
+			}
+			if st, ok := q.publishers[result.from]; ok {
+				st.recovering = false
+			}
+		case now := <-ticker.C:
+			for _, st := range q.publishers {
+				if len(st.pending) > 0 && now.Sub(st.since) >= delay {
+					ready = append(ready, q.skip(st, now)...)
+				}
+			}
+			q.expire(now)
+		}
+		for _, msg := range ready {
+			if msg.Header.Expired(time.Now(), q.node.cfg.ClockSkew) {
+				continue
+			}
+			select {
+			case q.messages <- msg:
+			case <-q.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// add add a message to sequence of its publisher, it returns messages which
+// are ready in order. Messages without sequence number are ready at once
+func (q *sequencer) add(msg *Message, now time.Time) []*Message {
+	seq := msg.Header.Seq
+	if seq == 0 {
+		return []*Message{msg}
+	}
+	st, ok := q.publishers[msg.From]
+	if !ok || msg.Header.Epoch > st.epoch {
+		// First message of a publisher or of its new epoch starts the sequence
+		if ok {
+			atomic.AddInt64(&q.node.queues.reordering, -int64(len(st.pending)))
+		}
+		st = &sequence{epoch: msg.Header.Epoch, expected: seq, pending: make(map[uint64]*Message)}
+		q.publishers[msg.From] = st
+	}
+	st.seen = now
+	if msg.Header.Epoch < st.epoch || seq < st.expected {
+		return nil
+	}
+	if _, ok := st.pending[seq]; ok {
+		return nil
+	}
+	if len(st.pending) == 0 {
+		st.since = now
+	}
+	st.pending[seq] = msg
+	atomic.AddInt64(&q.node.queues.reordering, 1)
+	ready := q.drain(st, now, nil)
+	for len(st.pending) > 0 && seq > st.expected && seq-st.expected >= uint64(q.params.OrderWindow) {
+		ready = append(ready, q.skip(st, now)...)
+	}
+	if len(st.pending) > 0 && q.params.Recover && !st.recovering && msg.From != q.node.ID() {
+		st.recovering = true
+		go q.recover(msg.From, recoverRequest{Topic: q.topic, Epoch: st.epoch, First: st.expected, Last: lowest(st.pending)})
+	}
+	return ready
+}
+
+// expire forget publishers which have sent nothing for a dedup window, their
+// next message starts a new sequence
+func (q *sequencer) expire(now time.Time) {
+	for from, st := range q.publishers {
+		if len(st.pending) == 0 && !st.recovering && now.Sub(st.seen) >= time.Duration(q.params.DedupWindow) {
+			delete(q.publishers, from)
+		}
+	}
+}
+
+// skip give up missing messages before the first pending one
+func (q *sequencer) skip(st *sequence, now time.Time) []*Message {
+	first := lowest(st.pending)
+	st.pending[first].Missed = first - st.expected
+	q.node.log.Debugf("Missed %d messages of %s", first-st.expected, q.topic)
+	st.expected = first
+	return q.drain(st, now, nil)
+}
+
+// drain append messages which follow expected sequence number to ready
+func (q *sequencer) drain(st *sequence, now time.Time, ready []*Message) []*Message {
+	drained := false
+	for {
+		msg, ok := st.pending[st.expected]
+		if !ok {
+			break
+		}
+		delete(st.pending, st.expected)
+		atomic.AddInt64(&q.node.queues.reordering, -1)
+		st.expected++
+		drained = true
+		if msg.duplicate {
+			continue
+		}
+		ready = append(ready, msg)
+	}
+	if drained {
+		st.since = now
+	}
+	return ready
+}
+
+// recover ask publisher for missing messages, they are added to its sequence
+func (q *sequencer) recover(from peer.ID, req recoverRequest) {
+	ctx, cancel := context.WithTimeout(q.ctx, time.Duration(q.params.OrderDelay))
+	defer cancel()
+	messages, err := q.node.recoverMessages(ctx, from, req)
+	if err != nil {
+		q.node.log.Debugf("Unable to recover messages of %s from %s: %v", q.topic, from, err)
+	}
+	select {
+	case q.recovered <- recovered{from: from, messages: messages}:
+	case <-q.ctx.Done():
+	}
+}
+
+// lowest lowest sequence number of pending messages
+func lowest(pending map[uint64]*Message) uint64 {
+	first := uint64(0)
+	for seq := range pending {
+		if first == 0 || seq < first {
+			first = seq
+		}
+	}
+	return first
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/zap"
+)
+
+// testConfig default configuration with options applied, nothing is logged
+func testConfig(t *testing.T, opts ...Option) *Config {
+	t.Helper()
+	cfg := defaultConfig()
+	if err := cfg.Apply(append([]Option{Logger(zap.NewNop().Sugar())}, opts...)...); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// testSequencer sequencer of an ordered topic which is driven by the test
+func testSequencer(t *testing.T, window int) *sequencer {
+	cfg := testConfig(t)
+	n := &Node{cfg: cfg, log: cfg.Logger, fragments: newFragmentPool(cfg.ReassemblyMemory, cfg.ReassemblyTimeout), queues: &queueCounters{}}
+	params := TopicParams{Ordered: true, OrderWindow: window}.withDefaults()
+	return &sequencer{node: n, topic: "orders", params: params, publishers: make(map[peer.ID]*sequence)}
+}
+
+// sequenced message of a publisher with an epoch and a sequence number
+func sequenced(from peer.ID, epoch int64, seq uint64) *Message {
+	return &Message{Topic: "orders", From: from, Header: Header{Epoch: epoch, Seq: seq}}
+}
+
+// expectSeqs check sequence numbers of ready messages
+func expectSeqs(t *testing.T, ready []*Message, seqs ...uint64) {
+	t.Helper()
+	if len(ready) != len(seqs) {
+		t.Fatalf("%d messages are ready, expected %v", len(ready), seqs)
+	}
+	for i, msg := range ready {
+		if msg.Header.Seq != seqs[i] {
+			t.Fatalf("message %d has sequence %d, expected %v", i, msg.Header.Seq, seqs)
+		}
+	}
+}
+
+func TestSequencerInOrder(t *testing.T) {
+	q := testSequencer(t, 0)
+	now := time.Now()
+	for seq := uint64(5); seq < 10; seq++ {
+		expectSeqs(t, q.add(sequenced("a", 1, seq), now), seq)
+	}
+	// Messages without sequence number are ready at once
+	expectSeqs(t, q.add(sequenced("a", 0, 0), now), 0)
+}
+
+func TestSequencerReorder(t *testing.T) {
+	q := testSequencer(t, 0)
+	now := time.Now()
+	expectSeqs(t, q.add(sequenced("a", 1, 1), now), 1)
+	expectSeqs(t, q.add(sequenced("a", 1, 4), now))
+	expectSeqs(t, q.add(sequenced("a", 1, 3), now))
+	// Publishers are ordered independently
+	expectSeqs(t, q.add(sequenced("b", 1, 7), now), 7)
+	expectSeqs(t, q.add(sequenced("a", 1, 3), now))
+	if stats := q.node.QueueStats(); stats.Reordering != 2 {
+		t.Fatalf("%d messages are reordering, expected 2", stats.Reordering)
+	}
+	expectSeqs(t, q.add(sequenced("a", 1, 2), now), 2, 3, 4)
+	// Late copies are dropped
+	expectSeqs(t, q.add(sequenced("a", 1, 2), now))
+	if stats := q.node.QueueStats(); stats.Reordering != 0 {
+		t.Fatalf("%d messages are reordering after they were ready", stats.Reordering)
+	}
+}
+
+func TestSequencerSkip(t *testing.T) {
+	q := testSequencer(t, 0)
+	now := time.Now()
+	expectSeqs(t, q.add(sequenced("a", 1, 1), now), 1)
+	expectSeqs(t, q.add(sequenced("a", 1, 4), now))
+	expectSeqs(t, q.add(sequenced("a", 1, 6), now))
+	ready := q.skip(q.publishers["a"], now)
+	expectSeqs(t, ready, 4)
+	if ready[0].Missed != 2 {
+		t.Fatalf("missed %d messages, expected 2", ready[0].Missed)
+	}
+	ready = q.skip(q.publishers["a"], now)
+	expectSeqs(t, ready, 6)
+	if ready[0].Missed != 1 {
+		t.Fatalf("missed %d messages, expected 1", ready[0].Missed)
+	}
+	expectSeqs(t, q.add(sequenced("a", 1, 5), now))
+	expectSeqs(t, q.add(sequenced("a", 1, 7), now), 7)
+}
+
+func TestSequencerWindow(t *testing.T) {
+	q := testSequencer(t, 4)
+	now := time.Now()
+	expectSeqs(t, q.add(sequenced("a", 1, 1), now), 1)
+	expectSeqs(t, q.add(sequenced("a", 1, 3), now))
+	expectSeqs(t, q.add(sequenced("a", 1, 5), now))
+	// Gaps are given up on until the newest message is within ordering window
+	ready := q.add(sequenced("a", 1, 6), now)
+	expectSeqs(t, ready, 3)
+	if ready[0].Missed != 1 {
+		t.Fatalf("missed %d messages, expected 1", ready[0].Missed)
+	}
+	ready = q.add(sequenced("a", 1, 9), now)
+	expectSeqs(t, ready, 5, 6)
+	if ready[0].Missed != 1 || ready[1].Missed != 0 {
+		t.Fatalf("missed %d and %d messages", ready[0].Missed, ready[1].Missed)
+	}
+	expectSeqs(t, q.add(sequenced("a", 1, 7), now), 7)
+}
+
+func TestSequencerEpoch(t *testing.T) {
+	q := testSequencer(t, 0)
+	now := time.Now()
+	expectSeqs(t, q.add(sequenced("a", 1, 10), now), 10)
+	expectSeqs(t, q.add(sequenced("a", 1, 12), now))
+	// Restarted publisher starts a new sequence, messages held back of its
+	// previous epoch are given up
+	expectSeqs(t, q.add(sequenced("a", 2, 1), now), 1)
+	if stats := q.node.QueueStats(); stats.Reordering != 0 {
+		t.Fatalf("%d messages of previous epoch are reordering", stats.Reordering)
+	}
+	expectSeqs(t, q.add(sequenced("a", 1, 11), now))
+	expectSeqs(t, q.add(sequenced("a", 2, 2), now), 2)
+}
+
+func TestSequencerDrainDuplicates(t *testing.T) {
+	q := testSequencer(t, 0)
+	now := time.Now()
+	expectSeqs(t, q.add(sequenced("a", 1, 1), now), 1)
+	expectSeqs(t, q.add(sequenced("a", 1, 4), now))
+	// Recovered duplicates only fill their gap
+	duplicate := sequenced("a", 1, 2)
+	duplicate.duplicate = true
+	expectSeqs(t, q.add(duplicate, now))
+	expectSeqs(t, q.add(sequenced("a", 1, 3), now), 3, 4)
+	st := q.publishers["a"]
+	if st.expected != 5 || len(st.pending) != 0 {
+		t.Fatalf("sequence expects %d with %d pending messages", st.expected, len(st.pending))
+	}
+}
+
+func TestSequencerExpirePublishers(t *testing.T) {
+	q := testSequencer(t, 0)
+	now := time.Now()
+	window := time.Duration(q.params.DedupWindow)
+	expectSeqs(t, q.add(sequenced("a", 1, 1), now), 1)
+	expectSeqs(t, q.add(sequenced("b", 1, 1), now), 1)
+	expectSeqs(t, q.add(sequenced("b", 1, 3), now.Add(window/2)))
+	q.expire(now.Add(window))
+	// Idle publisher is forgotten, publisher with held back messages is kept
+	if _, ok := q.publishers["a"]; ok {
+		t.Fatal("idle publisher was kept")
+	}
+	if _, ok := q.publishers["b"]; !ok {
+		t.Fatal("publisher with pending messages was expired")
+	}
+	expectSeqs(t, q.add(sequenced("a", 1, 5), now.Add(window)), 5)
+}
@@ -0,0 +1,255 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Topic names are hierarchical, levels are separated by TopicSeparator.
+// Patterns match topic names level by level, WildcardOne matches exactly one
+// level and WildcardMany, which must be the last level, matches any number of
+// remaining levels including none, e.g: "orders/*/created" or "metrics/#"
+const (
+	TopicSeparator = "/"
+	WildcardOne    = "*"
+	WildcardMany   = "#"
+)
+
+// internalPrefix prefix of topics used by the node itself e.g: requests and
+// group keys, patterns only match them if they start with it
+const internalPrefix = "p2sub/"
+
+// DefaultMaxPatternTopics topics a pattern subscription joins at most
+const DefaultMaxPatternTopics = 256
+
+// Errors of pattern subscriptions
+var (
+	ErrWildcardTopic = errors.New("wildcards are not allowed in topic names")
+	ErrCatchAll      = errors.New("patterns matching every topic are not allowed")
+	ErrPatternTopics = errors.New("pattern subscription joined too many topics")
+)
+
+// IsPattern check if a topic name contains wildcard levels
+func IsPattern(name string) bool {
+	for _, level := range strings.Split(name, TopicSeparator) {
+		if level == WildcardOne || level == WildcardMany {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidatePattern check that wildcards of a pattern are whole levels and
+// WildcardMany is the last level
+func ValidatePattern(pattern string) error {
+	if pattern == "" {
+		return errors.New("pattern is empty")
+	}
+	levels := strings.Split(pattern, TopicSeparator)
+	for i, level := range levels {
+		if level == WildcardMany && i != len(levels)-1 {
+			return fmt.Errorf("invalid pattern %q: %s must be the last level", pattern, WildcardMany)
+		}
+		if level != WildcardOne && level != WildcardMany && strings.ContainsAny(level, WildcardOne+WildcardMany) {
+			return fmt.Errorf("invalid pattern %q: wildcards must be whole levels", pattern)
+		}
+	}
+	return nil
+}
+
+// IsCatchAll check if a pattern matches every topic whatever its levels are,
+// e.g: "#" or "*/#"
+func IsCatchAll(pattern string) bool {
+	levels := strings.Split(pattern, TopicSeparator)
+	for _, level := range levels[:len(levels)-1] {
+		if level != WildcardOne {
+			return false
+		}
+	}
+	return levels[len(levels)-1] == WildcardMany
+}
+
+// MatchTopic check if a topic name matches a pattern
+func MatchTopic(pattern string, topic string) bool {
+	patternLevels := strings.Split(pattern, TopicSeparator)
+	topicLevels := strings.Split(topic, TopicSeparator)
+	for i, level := range patternLevels {
+		if level == WildcardMany {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != WildcardOne && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(patternLevels) == len(topicLevels)
+}
+
+// PatternSubscription subscription of all topics matching a pattern, topics
+// are subscribed as the node learns about them
+type PatternSubscription struct {
+	pattern  string
+	node     *Node
+	ctx      context.Context
+	cancel   context.CancelFunc
+	messages chan *Message
+	subs     map[string]*Subscription
+	mutex    sync.Mutex
+}
+
+// SubscribePattern subscribe to topics matching a pattern, topics the node
+// already knows are subscribed at once and topics announced later by peers
+// are subscribed when they are learned. Patterns matching every topic are
+// refused unless CatchAllPatterns was given
+func (n *Node) SubscribePattern(pattern string) (*PatternSubscription, error) {
+	if err := ValidatePattern(pattern); err != nil {
+		return nil, err
+	}
+	if IsCatchAll(pattern) && !n.cfg.CatchAllPatterns {
+		return nil, ErrCatchAll
+	}
+	if n.pubsub == nil {
+		return nil, ErrNotStarted
+	}
+	ctx, cancel := context.WithCancel(n.ctx)
+	ps := &PatternSubscription{
+		pattern:  pattern,
+		node:     n,
+		ctx:      ctx,
+		cancel:   cancel,
+		messages: make(chan *Message),
+		subs:     make(map[string]*Subscription),
+	}
+	known := append(n.known.watch(ps), n.pubsub.GetTopics()...)
+	for _, topic := range known {
+		err := ps.join(topic)
+		if err == ErrPatternTopics {
+			n.log.Debugf("Pattern %s joined %d topics, other topics are skipped", pattern, n.cfg.MaxPatternTopics)
+			break
+		}
+		if err != nil {
+			ps.Cancel()
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// KnownTopics get topics known by the node, they are topics it joined and
+// topics its peers subscribed to
+func (n *Node) KnownTopics() []string {
+	return n.known.topics()
+}
+
+// Pattern get pattern of subscription
+func (ps *PatternSubscription) Pattern() string {
+	return ps.pattern
+}
+
+// Topics get topics currently subscribed by the pattern
+func (ps *PatternSubscription) Topics() []string {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	topics := make([]string, 0, len(ps.subs))
+	for topic := range ps.subs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Next get next message of any matching topic, Topic of message is the
+// concrete topic it was published to
+func (ps *PatternSubscription) Next(ctx context.Context) (*Message, error) {
+	select {
+	case msg := <-ps.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-ps.ctx.Done():
+		return nil, ErrClosed
+	}
+}
+
+// Cancel cancel subscriptions of all matching topics
+func (ps *PatternSubscription) Cancel() {
+	ps.node.known.unwatch(ps)
+	ps.mutex.Lock()
+	ps.cancel()
+	subs := ps.subs
+	ps.subs = make(map[string]*Subscription)
+	ps.mutex.Unlock()
+	for _, sub := range subs {
+		sub.Cancel()
+	}
+}
+
+// learn subscribe a topic learned after subscription was created
+func (ps *PatternSubscription) learn(topic string) {
+	if err := ps.join(topic); err != nil {
+		ps.node.log.Debugf("Unable to subscribe %s of pattern %s: %v", topic, ps.pattern, err)
+	}
+}
+
+// join subscribe a topic if it matches the pattern and it was not subscribed
+func (ps *PatternSubscription) join(topic string) error {
+	if !MatchTopic(ps.pattern, topic) || IsPattern(topic) {
+		return nil
+	}
+	if strings.HasPrefix(topic, internalPrefix) && !strings.HasPrefix(ps.pattern, internalPrefix) {
+		return nil
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if ps.ctx.Err() != nil {
+		return nil
+	}
+	if _, ok := ps.subs[topic]; ok {
+		return nil
+	}
+	if len(ps.subs) >= ps.node.cfg.MaxPatternTopics {
+		return ErrPatternTopics
+	}
+	sub, err := ps.node.Subscribe(topic)
+	if err != nil {
+		return err
+	}
+	ps.subs[topic] = sub
+	go ps.forward(sub)
+	return nil
+}
+
+// forward pass messages of a topic to the pattern subscription
+func (ps *PatternSubscription) forward(sub *Subscription) {
+	for {
+		msg, err := sub.Next(ps.ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case ps.messages <- msg:
+		case <-ps.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/p2sub/p2sub/harness"
+	"github.com/p2sub/p2sub/node"
+)
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"orders", "orders", true},
+		{"orders", "orders/eu", false},
+		{"orders/*/created", "orders/eu/created", true},
+		{"orders/*/created", "orders/eu/deleted", false},
+		{"orders/*/created", "orders/created", false},
+		{"orders/*/created", "orders/eu/created/late", false},
+		{"metrics/#", "metrics", true},
+		{"metrics/#", "metrics/cpu/core0", true},
+		{"metrics/#", "metricsx/cpu", false},
+		{"*/cpu", "metrics/cpu", true},
+		{"*", "metrics/cpu", false},
+	}
+	for _, c := range cases {
+		if node.MatchTopic(c.pattern, c.topic) != c.match {
+			t.Errorf("%s matches %s: %v, expected %v", c.pattern, c.topic, !c.match, c.match)
+		}
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	for _, pattern := range []string{"orders", "orders/*/created", "metrics/#", "#", "*/*"} {
+		if err := node.ValidatePattern(pattern); err != nil {
+			t.Errorf("valid pattern %s: %v", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"", "metrics/#/cpu", "orders/eu*", "metrics/#x"} {
+		if err := node.ValidatePattern(pattern); err == nil {
+			t.Errorf("invalid pattern %q was accepted", pattern)
+		}
+	}
+	for pattern, catchAll := range map[string]bool{"#": true, "*/#": true, "*/*/#": true, "*": false, "orders/#": false} {
+		if node.IsCatchAll(pattern) != catchAll {
+			t.Errorf("%s is catch all: %v, expected %v", pattern, !catchAll, catchAll)
+		}
+	}
+}
+
+// awaitPatternTopics wait until a pattern subscription joined given topics
+func awaitPatternTopics(t *testing.T, ps *node.PatternSubscription, topics ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(ps.Topics(), topics) {
+		if time.Now().After(deadline) {
+			t.Fatalf("pattern %s joined %v, expected %v", ps.Pattern(), ps.Topics(), topics)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSubscribePattern(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h, err := harness.New(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Connect(harness.FullMesh); err != nil {
+		t.Fatal(err)
+	}
+	subscriber, publisher := h.Node(0), h.Node(1)
+	ps, err := subscriber.SubscribePattern("orders/*/created")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Cancel()
+
+	// Topics announced by peers later are joined if they match
+	for _, topic := range []string{"orders/eu/created", "orders/eu/deleted", "orders/us/created/late"} {
+		sub, err := publisher.Subscribe(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Cancel()
+	}
+	awaitPatternTopics(t, ps, "orders/eu/created")
+	if err := h.AwaitMesh(ctx, "orders/eu/created", 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"orders/eu/deleted", "orders/eu/created"} {
+		if err := publisher.Publish(ctx, topic, []byte(topic)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := ps.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Topic != "orders/eu/created" || string(msg.Data) != "orders/eu/created" {
+		t.Fatalf("unexpected message %s of %s", msg.Data, msg.Topic)
+	}
+
+	// Canceled subscriptions leave their topics
+	ps.Cancel()
+	if _, err := ps.Next(ctx); err != node.ErrClosed {
+		t.Fatalf("canceled subscription returned %v", err)
+	}
+	if topics := ps.Topics(); len(topics) != 0 {
+		t.Fatalf("canceled subscription still has topics %v", topics)
+	}
+}
+
+func TestPatternFirstMessage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h, err := harness.New(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ps, err := h.Node(0).SubscribePattern("metrics/#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Cancel()
+	// Topic joined by publishing is subscribed before its first message is sent
+	if err := h.Publish(ctx, 0, "metrics/cpu", []byte("42")); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ps.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Topic != "metrics/cpu" || string(msg.Data) != "42" {
+		t.Fatalf("unexpected message %s of %s", msg.Data, msg.Topic)
+	}
+}
+
+func TestPatternLimits(t *testing.T) {
+	h, err := harness.New(context.Background(), 1, node.TopicLimits(3, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	n := h.Node(0)
+	if _, err := n.SubscribePattern("#"); err != node.ErrCatchAll {
+		t.Fatalf("catch all pattern returned %v", err)
+	}
+	if _, err := n.Subscribe("orders/*"); err != node.ErrWildcardTopic {
+		t.Fatalf("subscribe to a pattern returned %v", err)
+	}
+	if err := n.Publish(context.Background(), "orders/*", nil); err != node.ErrWildcardTopic {
+		t.Fatalf("publish to a pattern returned %v", err)
+	}
+
+	for _, topic := range []string{"a/1", "a/2", "a/3", "a/4"} {
+		sub, err := n.Subscribe(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Cancel()
+	}
+	// Only the newest topics are known
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(n.KnownTopics(), []string{"a/2", "a/3", "a/4"}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("known topics %v", n.KnownTopics())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Pattern subscriptions join a limited number of topics
+	ps, err := n.SubscribePattern("a/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Cancel()
+	if topics := ps.Topics(); len(topics) != 2 {
+		t.Fatalf("pattern joined %v, expected 2 topics", topics)
+	}
+}
+
+func TestPatternInternalTopics(t *testing.T) {
+	h, err := harness.New(context.Background(), 1, node.CatchAllPatterns())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	n := h.Node(0)
+	responder, err := n.Respond("prices", func(ctx context.Context, req *node.Request) ([]byte, error) {
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Cancel()
+	sub, err := n.Subscribe("prices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Cancel()
+	// Internal topics are only matched by patterns of their prefix
+	all, err := n.SubscribePattern("#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Cancel()
+	awaitPatternTopics(t, all, "prices")
+	internal, err := n.SubscribePattern("p2sub/#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer internal.Cancel()
+	awaitPatternTopics(t, internal, node.RequestTopicPrefix+"prices")
+}
@@ -0,0 +1,146 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/p2sub/p2sub/harness"
+	"github.com/p2sub/p2sub/node"
+)
+
+// throttleCounter observer counting throttled messages of each scope
+type throttleCounter struct {
+	counts map[string]int
+	mutex  sync.Mutex
+}
+
+func (c *throttleCounter) Validated(string, time.Duration, pubsub.ValidationResult) {}
+
+func (c *throttleCounter) Discovered(string, time.Duration, int, error) {}
+
+func (c *throttleCounter) Known(string) {}
+
+func (c *throttleCounter) Throttled(scope string, topic string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counts[scope]++
+}
+
+// count get number of throttled messages of a scope
+func (c *throttleCounter) count(scope string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counts[scope]
+}
+
+func TestPeerRateLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	counter := &throttleCounter{counts: make(map[string]int)}
+	h, err := harness.New(ctx, 2, node.PeerRateLimit(0.001, 2), node.Observe(counter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Connect(harness.FullMesh); err != nil {
+		t.Fatal(err)
+	}
+	subs, err := h.SubscribeAll("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AwaitMesh(ctx, "orders", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages published by the node itself are not limited by its peer limit
+	for _, data := range []string{"1", "2", "3", "4"} {
+		if err := h.Publish(ctx, 0, "orders", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.AwaitDelivery(ctx, subs[:1], []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Remote subscriber only accepts burst of the publisher
+	for _, data := range []string{"1", "2"} {
+		if err := h.AwaitDelivery(ctx, subs[1:], []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	quiet, stop := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer stop()
+	if msg, err := subs[1].Next(quiet); err == nil {
+		t.Fatalf("message %s over rate limit was delivered", msg.Data)
+	}
+	if throttled := counter.count(node.ScopePeer); throttled < 2 {
+		t.Fatalf("%d messages were throttled, expected 2", throttled)
+	}
+}
+
+func TestChunkedRateLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h, err := harness.New(ctx, 2, node.PeerRateLimit(0.001, 1), node.ConfigureTopic("files", node.TopicParams{ChunkSize: 1024}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Connect(harness.FullMesh); err != nil {
+		t.Fatal(err)
+	}
+	subs, err := h.SubscribeAll("files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AwaitMesh(ctx, "files", 1); err != nil {
+		t.Fatal(err)
+	}
+	// Fragments don't take tokens, a chunked message fits a burst of one
+	data := bytes.Repeat([]byte("chunk "), 1000)
+	if err := h.Publish(ctx, 0, "files", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AwaitDelivery(ctx, subs[1:], data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTopicRateLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h, err := harness.New(ctx, 1, node.TopicRateLimit(0.001, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Publish(ctx, 0, "orders", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	err = h.Publish(ctx, 0, "orders", []byte("2"))
+	if limited, ok := err.(*node.RateLimitError); !ok || limited.Scope != node.ScopeTopic || limited.Key != "orders" {
+		t.Fatalf("publish over topic rate limit returned %v", err)
+	}
+	// Topics have their own bucket
+	if err := h.Publish(ctx, 0, "events", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+}
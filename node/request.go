@@ -0,0 +1,231 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// ReplyProtocol protocol of streams carrying replies to requests
+const ReplyProtocol = protocol.ID("/p2sub/reply/1.0.0")
+
+// RequestTopicPrefix requests of a topic are published to the topic with
+// this prefix, so subscribers of the topic don't receive them as messages
+const RequestTopicPrefix = "p2sub/request/"
+
+// Request request published to responders of a topic
+type Request struct {
+	// ID correlation ID of request, it's echoed in reply
+	ID    string `json:"id"`
+	Topic string `json:"topic"`
+	// ReplyTo peer which is waiting for reply, responders which are not
+	// connected to it dial its addresses
+	ReplyTo peer.ID  `json:"replyTo"`
+	Addrs   []string `json:"addrs"`
+	Data    []byte   `json:"data"`
+}
+
+// Reply reply of a responder
+type Reply struct {
+	ID string `json:"id"`
+	// From responder of request, it's the peer which opened reply stream
+	From  peer.ID `json:"-"`
+	Data  []byte  `json:"data,omitempty"`
+	Error string  `json:"error,omitempty"`
+}
+
+// Handler answer a request, returned error is sent back to caller
+type Handler func(ctx context.Context, req *Request) ([]byte, error)
+
+// RemoteError remote peer failed to handle a request or an envelope
+type RemoteError struct {
+	From    peer.ID
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("peer %s failed: %s", e.From.Pretty(), e.Message)
+}
+
+// Responder answers requests of a topic until it's canceled
+type Responder struct {
+	sub    *Subscription
+	cancel context.CancelFunc
+}
+
+// Cancel stop answering requests
+func (r *Responder) Cancel() {
+	r.cancel()
+	r.sub.Cancel()
+}
+
+// Request publish a request to responders of a topic and wait for the first
+// reply, ctx bounds the wait, request timeout of the node is used if ctx has
+// no deadline
+func (n *Node) Request(ctx context.Context, topic string, data []byte) (*Reply, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.cfg.RequestTimeout)
+		defer cancel()
+	}
+	id, err := newRequestID()
+	if err != nil {
+		return nil, err
+	}
+	replies := make(chan *Reply, 1)
+	n.mutex.Lock()
+	if n.host == nil {
+		n.mutex.Unlock()
+		return nil, ErrNotStarted
+	}
+	n.pending[id] = replies
+	n.mutex.Unlock()
+	defer func() {
+		n.mutex.Lock()
+		delete(n.pending, id)
+		n.mutex.Unlock()
+	}()
+
+	req := Request{ID: id, Topic: topic, ReplyTo: n.host.ID(), Addrs: make([]string, 0), Data: data}
+	for _, addr := range n.host.Addrs() {
+		req.Addrs = append(req.Addrs, addr.String())
+	}
+	raw, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.Publish(ctx, RequestTopicPrefix+topic, raw); err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-replies:
+		if reply.Error != "" {
+			return reply, &RemoteError{From: reply.From, Message: reply.Error}
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no reply to request of topic %s: %w", topic, ctx.Err())
+	}
+}
+
+// Respond answer requests of a topic with handler, each request is handled
+// in its own goroutine. Requests of this node are not answered by itself
+func (n *Node) Respond(topic string, handler Handler) (*Responder, error) {
+	sub, err := n.Subscribe(RequestTopicPrefix + topic)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(n.ctx)
+	go n.serveRequests(ctx, sub, handler)
+	return &Responder{sub: sub, cancel: cancel}, nil
+}
+
+// serveRequests handle requests of a subscription until it was canceled
+func (n *Node) serveRequests(ctx context.Context, sub *Subscription, handler Handler) {
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		var req Request
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			n.log.Debugf("Invalid request from %s: %v", msg.From, err)
+			continue
+		}
+		// Replies only go back to origin of request, otherwise a request
+		// could make responders dial any peer
+		if req.ID == "" || req.ReplyTo != msg.From || req.ReplyTo == n.host.ID() {
+			continue
+		}
+		go n.answer(ctx, &req, handler)
+	}
+}
+
+// answer handle a request and send its reply over a stream to caller
+func (n *Node) answer(ctx context.Context, req *Request, handler Handler) {
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.RequestTimeout)
+	defer cancel()
+	reply := Reply{ID: req.ID}
+	data, err := handler(ctx, req)
+	if err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.Data = data
+	}
+	for _, rawAddr := range req.Addrs {
+		if addr, err := multiaddr.NewMultiaddr(rawAddr); err == nil {
+			n.host.Peerstore().AddAddr(req.ReplyTo, addr, peerstore.TempAddrTTL)
+		}
+	}
+	stream, err := n.host.NewStream(ctx, req.ReplyTo, ReplyProtocol)
+	if err != nil {
+		n.log.Debugf("Unable to reply to %s: %v", req.ReplyTo, err)
+		return
+	}
+	if err := json.NewEncoder(stream).Encode(reply); err != nil {
+		n.log.Debugf("Unable to reply to %s: %v", req.ReplyTo, err)
+		stream.Reset()
+		return
+	}
+	helpers.FullClose(stream)
+}
+
+// handleReply stream handler of replies, replies of unknown or answered
+// requests are dropped
+func (n *Node) handleReply(stream network.Stream) {
+	stream.SetDeadline(time.Now().Add(n.cfg.RequestTimeout))
+	var reply Reply
+	decoder := json.NewDecoder(io.LimitReader(stream, pubsub.DefaultMaxMessageSize))
+	if err := decoder.Decode(&reply); err != nil {
+		n.log.Debugf("Invalid reply from %s: %v", stream.Conn().RemotePeer(), err)
+		stream.Reset()
+		return
+	}
+	helpers.FullClose(stream)
+	reply.From = stream.Conn().RemotePeer()
+	n.mutex.Lock()
+	replies, ok := n.pending[reply.ID]
+	n.mutex.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case replies <- &reply:
+	default:
+	}
+}
+
+// newRequestID random correlation ID of a request
+func newRequestID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
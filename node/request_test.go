@@ -0,0 +1,156 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/p2sub/p2sub/harness"
+	"github.com/p2sub/p2sub/node"
+)
+
+// startResponders start linked nodes, every node but the first one answers
+// requests of topic with handler. It returns once the first node sees them
+func startResponders(t *testing.T, size int, topic string, handler node.Handler) *harness.Harness {
+	t.Helper()
+	h, err := harness.New(context.Background(), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	if err := h.Connect(harness.FullMesh); err != nil {
+		t.Fatal(err)
+	}
+	for _, responder := range h.Nodes()[1:] {
+		if _, err := responder.Respond(topic, handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+	awaitTopicPeers(t, h.Node(0), node.RequestTopicPrefix+topic, size-1)
+	return h
+}
+
+// awaitTopicPeers wait until a node sees peers subscribed to a topic
+func awaitTopicPeers(t *testing.T, n *node.Node, topic string, peers int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(n.PubSub().ListPeers(topic)) < peers {
+		if time.Now().After(deadline) {
+			t.Fatalf("node sees %d peers of %s, expected %d", len(n.PubSub().ListPeers(topic)), topic, peers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	h := startResponders(t, 2, "prices", func(ctx context.Context, req *node.Request) ([]byte, error) {
+		return bytes.ToUpper(req.Data), nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := h.Node(0).Request(ctx, "prices", []byte("btc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Data) != "BTC" || reply.From != h.Node(1).ID() || reply.ID == "" {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+}
+
+func TestRequestError(t *testing.T) {
+	h := startResponders(t, 2, "prices", func(ctx context.Context, req *node.Request) ([]byte, error) {
+		return nil, errors.New("unknown symbol")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := h.Node(0).Request(ctx, "prices", []byte("xyz"))
+	var remote *node.RemoteError
+	if !errors.As(err, &remote) || remote.From != h.Node(1).ID() || remote.Message != "unknown symbol" {
+		t.Fatalf("failed request returned %v", err)
+	}
+}
+
+func TestRequestFirstReply(t *testing.T) {
+	replies := make(chan struct{}, 2)
+	h := startResponders(t, 3, "prices", func(ctx context.Context, req *node.Request) ([]byte, error) {
+		replies <- struct{}{}
+		return []byte("ok"), nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Both responders answer, caller gets the first reply only
+	if _, err := h.Node(0).Request(ctx, "prices", nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-replies:
+		case <-ctx.Done():
+			t.Fatal("request was not handled by every responder")
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	h, err := harness.New(context.Background(), 1, node.RequestTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	// Requests of a node are not answered by itself
+	responder, err := h.Node(0).Respond("prices", func(ctx context.Context, req *node.Request) ([]byte, error) {
+		return []byte("ok"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Cancel()
+	start := time.Now()
+	_, err = h.Node(0).Request(context.Background(), "prices", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unanswered request returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("request timeout of node was not applied, request took %v", elapsed)
+	}
+}
+
+func TestResponderCancel(t *testing.T) {
+	h, err := harness.New(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Connect(harness.FullMesh); err != nil {
+		t.Fatal(err)
+	}
+	responder, err := h.Node(1).Respond("prices", func(ctx context.Context, req *node.Request) ([]byte, error) {
+		return []byte("ok"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	awaitTopicPeers(t, h.Node(0), node.RequestTopicPrefix+"prices", 1)
+	responder.Cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if reply, err := h.Node(0).Request(ctx, "prices", nil); err == nil {
+		t.Fatalf("canceled responder replied %+v", reply)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import "sync/atomic"
+
+// QueueStats messages held in queues of a node
+type QueueStats struct {
+	// Reordering messages of ordered topics held back until earlier ones arrive
+	Reordering int
+	// Reassembling chunked messages waiting for their missing fragments
+	Reassembling int
+	// FragmentBytes bytes of received fragments kept for reassembly
+	FragmentBytes int
+}
+
+// queueCounters messages held by receivers and sequencers of all
+// subscriptions, they are updated atomically
+type queueCounters struct {
+	reordering   int64
+	reassembling int64
+}
+
+// QueueStats get number of messages held in queues of the node
+func (n *Node) QueueStats() QueueStats {
+	return QueueStats{
+		Reordering:    int(atomic.LoadInt64(&n.queues.reordering)),
+		Reassembling:  int(atomic.LoadInt64(&n.queues.reassembling)),
+		FragmentBytes: n.fragments.bytes(),
+	}
+}
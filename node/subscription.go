@@ -0,0 +1,317 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// Message message delivered to subscribers
+type Message struct {
+	Topic        string
+	From         peer.ID
+	ReceivedFrom peer.ID
+	Data         []byte
+	Header       Header
+	// Missed number of messages of the same publisher which were skipped
+	// before this one on an ordered topic
+	Missed uint64
+	// Raw message of gossipsub, it's nil for recovered messages
+	Raw *pubsub.Message
+	// duplicate recovered message which was delivered under another
+	// sequence number, it only fills its gap
+	duplicate bool
+}
+
+// Headers get headers of message, e.g: to be matched by filters. Numeric
+// headers are float64 like numbers of JSON payloads, headers which were not
+// set by publisher are missing
+func (m *Message) Headers() map[string]interface{} {
+	headers := map[string]interface{}{
+		"topic": m.Topic,
+		"from":  m.From.Pretty(),
+	}
+	if m.Header.Key != "" {
+		headers["key"] = m.Header.Key
+	}
+	if m.Header.Expires != 0 {
+		headers["expires"] = float64(m.Header.Expires)
+	}
+	if m.Header.Seq != 0 {
+		headers["seq"] = float64(m.Header.Seq)
+	}
+	if m.Header.Epoch != 0 {
+		headers["epoch"] = float64(m.Header.Epoch)
+	}
+	return headers
+}
+
+// Subscription subscription of a topic
+type Subscription struct {
+	topic string
+	sub   *pubsub.Subscription
+	node  *Node
+	// received decoded messages of the topic
+	received *receiver
+	// ordered sequencer of an ordered topic
+	ordered *sequencer
+}
+
+// Topic get topic name of subscription
+func (s *Subscription) Topic() string {
+	return s.topic
+}
+
+// Next get next message of the topic, it blocks until a message arrived,
+// context was canceled or subscription was canceled. Messages of encrypted
+// topics which could not be opened and expired messages are skipped,
+// messages of ordered topics come in order of each publisher
+func (s *Subscription) Next(ctx context.Context) (*Message, error) {
+	if s.ordered != nil {
+		return s.ordered.next(ctx)
+	}
+	for {
+		msg, err := s.received.next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Header.Expired(time.Now(), s.node.cfg.ClockSkew) {
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// decodeMessage split header from payload of a message, join payloads of
+// chunked messages, open payloads of encrypted topics and decompress
+// compressed payloads. Fragments are delivered with their manifest, it
+// returns ErrIncomplete if fragments of a manifest are missing
+func (n *Node) decodeMessage(topic string, from peer.ID, receivedFrom peer.ID, data []byte, raw *pubsub.Message) (*Message, error) {
+	header, payload, err := decodeHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if header.Fragment != "" {
+		return nil, errFragment
+	}
+	if header.Manifest != nil {
+		if payload, err = n.fragments.assemble(header.Manifest); err != nil {
+			return nil, err
+		}
+	}
+	payload, err = n.openMessage(topic, payload)
+	if err != nil {
+		return nil, err
+	}
+	payload, err = n.cfg.decompressMessage(topic, header.Encoding, payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		Topic:        topic,
+		From:         from,
+		ReceivedFrom: receivedFrom,
+		Data:         payload,
+		Header:       *header,
+		Raw:          raw,
+	}, nil
+}
+
+// Cancel cancel subscription
+func (s *Subscription) Cancel() {
+	s.node.mutex.Lock()
+	delete(s.node.subscriptions, s)
+	s.node.mutex.Unlock()
+	if s.ordered != nil {
+		s.ordered.cancel()
+	}
+	s.received.cancel()
+	s.sub.Cancel()
+}
+
+// pendingManifest chunked message held back until its fragments arrived
+type pendingManifest struct {
+	msg      *pubsub.Message
+	deadline time.Time
+}
+
+// receiver decode messages of a gossipsub subscription in its own goroutine.
+// Chunked messages wait for their missing fragments until reassembly timeout
+// without holding back messages received after them
+type receiver struct {
+	node     *Node
+	topic    string
+	sub      *pubsub.Subscription
+	ctx      context.Context
+	cancel   context.CancelFunc
+	messages chan *Message
+	pending  []*pendingManifest
+	err      error
+	mutex    sync.Mutex
+}
+
+// newReceiver create a receiver of a subscription, it runs until it's canceled
+func newReceiver(ctx context.Context, n *Node, topic string, sub *pubsub.Subscription) *receiver {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &receiver{
+		node:     n,
+		topic:    topic,
+		sub:      sub,
+		ctx:      ctx,
+		cancel:   cancel,
+		messages: make(chan *Message),
+	}
+	go r.run()
+	return r
+}
+
+// next get next decoded message
+func (r *receiver) next(ctx context.Context) (*Message, error) {
+	select {
+	case msg := <-r.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.ctx.Done():
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, pubsub.ErrSubscriptionCancelled
+	}
+}
+
+// run decode received messages and retry pending chunked messages when
+// fragments were added, until receiver was canceled
+func (r *receiver) run() {
+	defer func() {
+		atomic.AddInt64(&r.node.queues.reassembling, -int64(len(r.pending)))
+	}()
+	received := make(chan *pubsub.Message)
+	go func() {
+		for {
+			msg, err := r.sub.Next(r.ctx)
+			if err != nil {
+				// Errors after receiver was canceled only report the cancel
+				r.mutex.Lock()
+				if r.ctx.Err() == nil {
+					r.err = err
+				}
+				r.mutex.Unlock()
+				r.cancel()
+				return
+			}
+			select {
+			case received <- msg:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}()
+	for {
+		// Pending messages are retried when a fragment was added or the
+		// oldest of them timed out, nothing is polled while none is pending
+		var changed <-chan struct{}
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if len(r.pending) > 0 {
+			changed = r.node.fragments.changes()
+			timer = time.NewTimer(time.Until(r.pending[0].deadline))
+			expired = timer.C
+		}
+		var ready []*Message
+		select {
+		case <-r.ctx.Done():
+			return
+		case msg := <-received:
+			ready = r.receive(msg, time.Now())
+		case <-changed:
+			ready = r.retry(time.Now())
+		case now := <-expired:
+			ready = r.retry(now)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		for _, msg := range ready {
+			select {
+			case r.messages <- msg:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// receive decode a message, chunked messages with missing fragments are
+// kept pending, at most maxPendingManifests of each publisher
+func (r *receiver) receive(msg *pubsub.Message, now time.Time) []*Message {
+	decoded, err := r.node.decodeMessage(r.topic, msg.GetFrom(), msg.ReceivedFrom, msg.GetData(), msg)
+	switch {
+	case err == errFragment:
+		return nil
+	case err == ErrIncomplete:
+		count := 0
+		for _, pending := range r.pending {
+			if pending.msg.GetFrom() == msg.GetFrom() {
+				count++
+			}
+		}
+		if count >= maxPendingManifests {
+			r.node.log.Debugf("Skip chunked message of %s from %s: too many pending messages", r.topic, msg.GetFrom())
+			return nil
+		}
+		r.pending = append(r.pending, &pendingManifest{msg: msg, deadline: now.Add(r.node.cfg.ReassemblyTimeout)})
+		atomic.AddInt64(&r.node.queues.reassembling, 1)
+		return nil
+	case err != nil:
+		r.node.log.Debugf("Skip message of %s from %s: %v", r.topic, msg.GetFrom(), err)
+		return nil
+	}
+	return []*Message{decoded}
+}
+
+// retry decode pending chunked messages, messages whose fragments are still
+// missing after reassembly timeout are dropped
+func (r *receiver) retry(now time.Time) []*Message {
+	var ready []*Message
+	kept := r.pending[:0]
+	for _, pending := range r.pending {
+		msg := pending.msg
+		decoded, err := r.node.decodeMessage(r.topic, msg.GetFrom(), msg.ReceivedFrom, msg.GetData(), msg)
+		if err == ErrIncomplete && now.Before(pending.deadline) {
+			kept = append(kept, pending)
+			continue
+		}
+		if err != nil {
+			r.node.log.Debugf("Skip message of %s from %s: %v", r.topic, msg.GetFrom(), err)
+			continue
+		}
+		ready = append(ready, decoded)
+	}
+	for i := len(kept); i < len(r.pending); i++ {
+		r.pending[i] = nil
+	}
+	atomic.AddInt64(&r.node.queues.reassembling, int64(len(kept)-len(r.pending)))
+	r.pending = kept
+	return ready
+}
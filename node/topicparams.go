@@ -0,0 +1,163 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Defaults of topic parameters
+const (
+	DefaultOrderWindow = 64
+	DefaultOrderDelay  = time.Second
+	DefaultHistory     = 256
+)
+
+// TopicParams p2sub features of a topic, publishers and subscribers of a
+// topic should agree on them
+type TopicParams struct {
+	// Ordered messages of each publisher are delivered in the order they
+	// were published, messages are held back while an earlier one is missing
+	Ordered bool `json:"ordered"`
+	// OrderWindow number of messages of a publisher held back at most
+	OrderWindow int `json:"orderWindow,omitempty"`
+	// OrderDelay time a message is held back at most, missing messages are
+	// skipped afterwards
+	OrderDelay Duration `json:"orderDelay,omitempty"`
+	// Recover missing messages are requested from their publisher
+	Recover bool `json:"recover,omitempty"`
+	// History number of published messages kept for peers recovering them,
+	// chunked messages are not recoverable
+	History int `json:"history,omitempty"`
+	// Dedup identity of messages: seqno, content or key. Messages with the
+	// same identity are delivered once within dedup window
+	Dedup string `json:"dedup,omitempty"`
+	// DedupWindow time a message identity is remembered
+	DedupWindow Duration `json:"dedupWindow,omitempty"`
+	// TTL time to live of messages published without one, zero means
+	// messages never expire
+	TTL Duration `json:"ttl,omitempty"`
+	// MaxTTL longest time to live of messages, messages expiring later are
+	// rejected
+	MaxTTL Duration `json:"maxTTL,omitempty"`
+	// Compression encoding of published payloads: gzip, zstd or snappy.
+	// Subscribers decompress any encoding whatever compression of topic is,
+	// payloads of encrypted topics are never compressed
+	Compression string `json:"compression,omitempty"`
+	// CompressMin payloads smaller than it are published uncompressed
+	CompressMin int `json:"compressMin,omitempty"`
+	// MaxDecompressed messages decompressing to more bytes are dropped
+	MaxDecompressed int `json:"maxDecompressed,omitempty"`
+	// ChunkSize payloads larger than it are published in fragments, topics
+	// without chunk size neither publish nor accept fragments
+	ChunkSize int `json:"chunkSize,omitempty"`
+	// MaxMessageSize largest payload of a chunked message
+	MaxMessageSize int `json:"maxMessageSize,omitempty"`
+}
+
+// withDefaults fill unset parameters with defaults
+func (p TopicParams) withDefaults() TopicParams {
+	if p.OrderWindow <= 0 {
+		p.OrderWindow = DefaultOrderWindow
+	}
+	if p.OrderDelay <= 0 {
+		p.OrderDelay = Duration(DefaultOrderDelay)
+	}
+	if p.History <= 0 {
+		p.History = DefaultHistory
+	}
+	if p.DedupWindow <= 0 {
+		p.DedupWindow = Duration(DefaultDedupWindow)
+	}
+	if p.MaxTTL <= 0 {
+		p.MaxTTL = Duration(DefaultMaxTTL)
+	}
+	if p.CompressMin <= 0 {
+		p.CompressMin = DefaultCompressMin
+	}
+	if p.MaxDecompressed <= 0 {
+		p.MaxDecompressed = DefaultMaxDecompressed
+	}
+	if p.MaxMessageSize <= 0 {
+		p.MaxMessageSize = DefaultMaxMessageSize
+	}
+	return p
+}
+
+// ConfigureTopic set parameters of topics matching a pattern e.g: "orders"
+// or "orders/#", parameters of the most specific pattern apply to a topic
+func ConfigureTopic(pattern string, params TopicParams) Option {
+	return func(cfg *Config) error {
+		if err := ValidatePattern(pattern); err != nil {
+			return err
+		}
+		if params.OrderWindow < 0 || params.History < 0 || params.OrderDelay < 0 || params.DedupWindow < 0 || params.TTL < 0 || params.MaxTTL < 0 || params.CompressMin < 0 || params.MaxDecompressed < 0 || params.ChunkSize < 0 || params.MaxMessageSize < 0 {
+			return fmt.Errorf("invalid parameters of topic %s: negative values", pattern)
+		}
+		switch params.Dedup {
+		case "", DedupSeqno, DedupContent, DedupKey:
+		default:
+			return fmt.Errorf("invalid parameters of topic %s: unknown dedup %q", pattern, params.Dedup)
+		}
+		if err := checkEncoding(params.Compression); err != nil {
+			return fmt.Errorf("invalid parameters of topic %s: %v", pattern, err)
+		}
+		if params.ChunkSize > MaxChunkSize {
+			return fmt.Errorf("invalid parameters of topic %s: chunk size is larger than %d", pattern, MaxChunkSize)
+		}
+		// TTL can't be longer than default max TTL either
+		params = params.withDefaults()
+		if params.TTL > params.MaxTTL {
+			return fmt.Errorf("invalid parameters of topic %s: TTL is longer than max TTL", pattern)
+		}
+		if cfg.Topics == nil {
+			cfg.Topics = make(map[string]TopicParams)
+		}
+		cfg.Topics[pattern] = params
+		return nil
+	}
+}
+
+// TopicParams get parameters of a topic
+func (n *Node) TopicParams(topic string) TopicParams {
+	return n.cfg.topicParams(topic)
+}
+
+// topicParams get parameters of a topic, a topic without parameters has
+// default parameters. Exact names win over patterns, longer patterns win over
+// shorter ones
+func (c *Config) topicParams(topic string) TopicParams {
+	if params, ok := c.Topics[topic]; ok {
+		return params
+	}
+	patterns := make([]string, 0, len(c.Topics))
+	for pattern := range c.Topics {
+		if IsPattern(pattern) && MatchTopic(pattern, topic) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if len(patterns) == 0 {
+		return TopicParams{}.withDefaults()
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	return c.Topics[patterns[0]]
+}
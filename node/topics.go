@@ -0,0 +1,131 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"sort"
+	"sync"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+// DefaultMaxKnownTopics topics a node keeps track of, the oldest topic is
+// forgotten when peers announce more
+const DefaultMaxKnownTopics = 4096
+
+// topicTracker keep track of topics known by the node, they are topics joined
+// by the node and topics which peers announced subscriptions to. Peers are
+// able to announce any number of topics so only the newest topics are kept
+type topicTracker struct {
+	known    map[string]struct{}
+	order    []string
+	limit    int
+	watchers map[*PatternSubscription]struct{}
+	mutex    sync.Mutex
+}
+
+var _ pubsub.EventTracer = (*topicTracker)(nil)
+
+// newTopicTracker create an empty topic tracker keeping at most limit topics
+func newTopicTracker(limit int) *topicTracker {
+	return &topicTracker{
+		known:    make(map[string]struct{}),
+		limit:    limit,
+		watchers: make(map[*PatternSubscription]struct{}),
+	}
+}
+
+// Trace handle a trace event, it's called from gossipsub event loop so it must not block
+func (t *topicTracker) Trace(evt *pb.TraceEvent) {
+	switch evt.GetType() {
+	case pb.TraceEvent_JOIN:
+		t.add(evt.GetJoin().GetTopic())
+	case pb.TraceEvent_RECV_RPC:
+		for _, sub := range evt.GetRecvRPC().GetMeta().GetSubscription() {
+			if sub.GetSubscribe() {
+				t.add(sub.GetTopic())
+			}
+		}
+	}
+}
+
+// add learn a topic, watchers are notified in their own goroutine since
+// they join topics through gossipsub event loop
+func (t *topicTracker) add(topic string) {
+	if topic == "" {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.known[topic]; ok {
+		return
+	}
+	if len(t.order) >= t.limit {
+		delete(t.known, t.order[0])
+		t.order = t.order[1:]
+	}
+	t.known[topic] = struct{}{}
+	t.order = append(t.order, topic)
+	for watcher := range t.watchers {
+		go watcher.learn(topic)
+	}
+}
+
+// notify subscribe matching pattern subscriptions to a topic before it
+// returns, e.g: before the node publishes its first message
+func (t *topicTracker) notify(topic string) {
+	t.mutex.Lock()
+	watchers := make([]*PatternSubscription, 0, len(t.watchers))
+	for watcher := range t.watchers {
+		watchers = append(watchers, watcher)
+	}
+	t.mutex.Unlock()
+	for _, watcher := range watchers {
+		watcher.learn(topic)
+	}
+}
+
+// watch notify a pattern subscription of topics learned from now on, it
+// returns topics which are already known
+func (t *topicTracker) watch(watcher *PatternSubscription) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.watchers[watcher] = struct{}{}
+	topics := make([]string, 0, len(t.known))
+	for topic := range t.known {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// unwatch stop notifying a pattern subscription
+func (t *topicTracker) unwatch(watcher *PatternSubscription) {
+	t.mutex.Lock()
+	delete(t.watchers, watcher)
+	t.mutex.Unlock()
+}
+
+// topics get known topics
+func (t *topicTracker) topics() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	topics := make([]string, 0, len(t.known))
+	for topic := range t.known {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"fmt"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+// Formats of trace files
+const (
+	// TraceJSON newline delimited JSON
+	TraceJSON = "json"
+	// TracePB length delimited protobuf, it's smaller and faster to write
+	TracePB = "pb"
+)
+
+// checkTraceFormat check if format of trace file is supported
+func checkTraceFormat(format string) error {
+	if format != TraceJSON && format != TracePB {
+		return fmt.Errorf("unsupported trace format %q", format)
+	}
+	return nil
+}
+
+// multiTracer gossipsub accepts only one event tracer, it forwards events to
+// all tracers of the node
+type multiTracer []pubsub.EventTracer
+
+var _ pubsub.EventTracer = multiTracer(nil)
+
+// Trace forward event to every tracer
+func (m multiTracer) Trace(evt *pb.TraceEvent) {
+	for _, tracer := range m {
+		tracer.Trace(evt)
+	}
+}
+
+// startTracers create tracers of trace file and remote tracer if they were
+// set, they are closed with the node
+func (n *Node) startTracers() ([]pubsub.EventTracer, error) {
+	tracers := make([]pubsub.EventTracer, 0)
+	if n.cfg.TraceFile != "" {
+		var tracer interface {
+			pubsub.EventTracer
+			Close()
+		}
+		var err error
+		if n.cfg.TraceFormat == TracePB {
+			tracer, err = pubsub.NewPBTracer(n.cfg.TraceFile)
+		} else {
+			tracer, err = pubsub.NewJSONTracer(n.cfg.TraceFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.log.Infof("Write gossipsub traces to: %s", n.cfg.TraceFile)
+		n.onClose("trace file", func() error {
+			tracer.Close()
+			return nil
+		})
+		tracers = append(tracers, tracer)
+	}
+	if n.cfg.RemoteTracer != nil {
+		tracer, err := pubsub.NewRemoteTracer(n.ctx, n.host, *n.cfg.RemoteTracer)
+		if err != nil {
+			return nil, err
+		}
+		n.log.Infof("Send gossipsub traces to: %s", n.cfg.RemoteTracer.ID.Pretty())
+		n.onClose("remote tracer", func() error {
+			tracer.Close()
+			return nil
+		})
+		tracers = append(tracers, tracer)
+	}
+	return tracers, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// Validator validate a message of any topic before it's delivered and
+// forwarded, topic of message is msg.GetTopicIDs()[0]
+type Validator func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult
+
+// Observer observe events of a node which are not traced by gossipsub, e.g:
+// to export metrics. Methods are called synchronously so they must not block
+type Observer interface {
+	// Validated a message was validated by validators of the node
+	Validated(topic string, elapsed time.Duration, result pubsub.ValidationResult)
+	// Discovered a discovery operation (advertise or find_peers) was done
+	Discovered(operation string, elapsed time.Duration, found int, err error)
+	// Throttled a message of topic exceeded rate limit of scope (peer or topic)
+	Throttled(scope string, topic string)
+	// Known a topic was joined by the node or configured by its name, a topic
+	// could be reported more than once
+	Known(topic string)
+}
+
+// Discovery operations reported to observers
+const (
+	OperationAdvertise = "advertise"
+	OperationFindPeers = "find_peers"
+)
+
+// Scopes of rate limits
+const (
+	ScopePeer    = "peer"
+	ScopeTopic   = "topic"
+	ScopeChannel = "channel"
+)
+
+// RateLimitError a message was rejected because it exceeded a rate limit
+type RateLimitError struct {
+	Scope string
+	Key   string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit of %s %s exceeded", e.Scope, e.Key)
+}
+
+// validator chain of validators of a topic, gossipsub allows only one
+// validator for each topic. Expiry of messages is checked first, the first
+// result which is not accept stops the chain. Accepted duplicates of topics
+// with dedup are ignored, accepted fragments are kept for reassembly
+func (n *Node) validator(topic string) pubsub.ValidatorEx {
+	return func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		start := time.Now()
+		if err := n.throttle(from, msg, topic); err != nil {
+			// Ignored messages don't penalize peers which forwarded them
+			n.cfg.Logger.Debugf("Ignore message: %v", err)
+			return pubsub.ValidationIgnore
+		}
+		result := n.validateExpiry(topic, msg, start)
+		if result == pubsub.ValidationAccept {
+			result = n.validateChunk(topic, msg)
+		}
+		for _, validate := range n.cfg.Validators {
+			if result != pubsub.ValidationAccept {
+				break
+			}
+			result = validate(ctx, from, msg)
+		}
+		if result == pubsub.ValidationAccept && n.deduplicate(topic, msg) {
+			n.cfg.Logger.Debugf("Ignore duplicate message of %s from %s", topic, msg.GetFrom())
+			result = pubsub.ValidationIgnore
+		}
+		if result == pubsub.ValidationAccept {
+			n.keepFragment(topic, msg)
+		}
+		if n.cfg.Observer != nil {
+			n.cfg.Observer.Validated(topic, time.Since(start), result)
+		}
+		return result
+	}
+}
+
+// throttle take tokens of origin peer and topic of a message, messages
+// published by this node are limited by Publish. Fragments take no tokens,
+// a chunked message is charged once by its manifest
+func (n *Node) throttle(from peer.ID, msg *pubsub.Message, topic string) error {
+	if from == n.host.ID() {
+		return nil
+	}
+	if header, _, err := decodeHeader(msg.GetData()); err == nil && header.Fragment != "" {
+		return nil
+	}
+	origin := msg.GetFrom()
+	if !n.cfg.PeerRateLimit.Allow(string(origin)) {
+		return n.throttled(ScopePeer, origin.Pretty(), topic)
+	}
+	if !n.cfg.TopicRateLimit.Allow(topic) {
+		return n.throttled(ScopeTopic, topic, topic)
+	}
+	return nil
+}
+
+// throttled report a message which exceeded a rate limit
+func (n *Node) throttled(scope string, key string, topic string) error {
+	if n.cfg.Observer != nil {
+		n.cfg.Observer.Throttled(scope, topic)
+	}
+	return &RateLimitError{Scope: scope, Key: key}
+}
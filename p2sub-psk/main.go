@@ -0,0 +1,60 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// p2sub-psk generate the pre-shared key file of a private network, copy it
+// to every node and give it to p2sub with --psk-file:
+//
+//	p2sub-psk /swarm.key
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/p2sub/p2sub/keypair"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s <psk file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := generate(flag.Arg(0)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// generate save a new pre-shared key to file, an existing file is never
+// overwritten since nodes using its key would be locked out
+func generate(pskFile string) error {
+	if _, err := os.Stat(pskFile); err == nil {
+		return fmt.Errorf("pre-shared key file %s already exists", pskFile)
+	}
+	psk, err := keypair.NewPSK()
+	if err != nil {
+		return err
+	}
+	if _, err := keypair.SavePSKToFile(psk, pskFile); err != nil {
+		return err
+	}
+	fmt.Printf("Pre-shared key saved to %s\n", pskFile)
+	return nil
+}
@@ -0,0 +1,375 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// p2sub-trace summarizes gossipsub traces of p2sub nodes: propagation delay
+// and duplicates of messages, mesh churn of each topic and reasons of
+// rejected messages. It reads the protobuf trace files of --trace-format pb
+// and traced, gzipped or not. Delay is measured from the publish event to
+// delivery events of other nodes, so traces of publishers and subscribers
+// must be given together:
+//
+//	p2sub-trace [-topic name] [-json] node1.pb traces/trace.1600000000.pb.gz ...
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	ggio "github.com/gogo/protobuf/io"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+// maxEventSize upper bound of a protobuf trace event
+const maxEventSize = 4 << 20
+
+// Summary result of analysis
+type Summary struct {
+	Files      []string             `json:"files"`
+	Start      time.Time            `json:"start"`
+	End        time.Time            `json:"end"`
+	Messages   map[string]*Messages `json:"messages"`
+	Delay      Delay                `json:"delay"`
+	Mesh       map[string]*Churn    `json:"mesh"`
+	Rejections map[string]int       `json:"rejections"`
+}
+
+// Messages message events of a topic
+type Messages struct {
+	Published  int `json:"published"`
+	Delivered  int `json:"delivered"`
+	Duplicates int `json:"duplicates"`
+	// DuplicateRatio duplicates received for each delivered message
+	DuplicateRatio float64 `json:"duplicateRatio"`
+}
+
+// Delay propagation delay in milliseconds of deliveries whose publish event
+// was traced
+type Delay struct {
+	Deliveries int     `json:"deliveries"`
+	Min        float64 `json:"min"`
+	P50        float64 `json:"p50"`
+	P95        float64 `json:"p95"`
+	P99        float64 `json:"p99"`
+	Max        float64 `json:"max"`
+}
+
+// event message event of a node
+type event struct {
+	peer      string
+	timestamp int64
+}
+
+// Churn mesh changes of a topic
+type Churn struct {
+	Grafts int `json:"grafts"`
+	Prunes int `json:"prunes"`
+	// PerMinute grafts and prunes per minute over the whole trace
+	PerMinute float64 `json:"perMinute"`
+}
+
+// analyzer state of analysis
+type analyzer struct {
+	topic      string
+	first      int64
+	last       int64
+	rejections map[string]int
+	mesh       map[string]*Churn
+	messages   map[string]*Messages
+	// published publish time of each message, deliveries are matched to
+	// them once all files were read
+	published  map[string]event
+	deliveries map[string][]event
+}
+
+func main() {
+	topic := flag.String("topic", "", "Analyze events of this topic only")
+	jsonOutput := flag.Bool("json", false, "Print summary as JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] trace-file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	a := &analyzer{
+		topic:      *topic,
+		rejections: make(map[string]int),
+		mesh:       make(map[string]*Churn),
+		messages:   make(map[string]*Messages),
+		published:  make(map[string]event),
+		deliveries: make(map[string][]event),
+	}
+	for _, file := range flag.Args() {
+		if err := load(file, a.add); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to load %s: %v\n", file, err)
+			os.Exit(1)
+		}
+	}
+
+	summary := a.summary(flag.Args())
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(summary)
+		return
+	}
+	printSummary(summary)
+}
+
+// load read length delimited protobuf events of a file, gzipped files of
+// traced are detected by their magic
+func load(file string, handle func(evt *pb.TraceEvent)) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var source io.Reader = reader
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		source = gzipReader
+	}
+
+	events := ggio.NewDelimitedReader(source, maxEventSize)
+	for {
+		evt := new(pb.TraceEvent)
+		switch err := events.ReadMsg(evt); err {
+		case nil:
+			handle(evt)
+		case io.EOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// add account an event
+func (a *analyzer) add(evt *pb.TraceEvent) {
+	var topics []string
+	switch evt.GetType() {
+	case pb.TraceEvent_PUBLISH_MESSAGE:
+		topics = evt.GetPublishMessage().GetTopics()
+	case pb.TraceEvent_DELIVER_MESSAGE:
+		topics = evt.GetDeliverMessage().GetTopics()
+	case pb.TraceEvent_DUPLICATE_MESSAGE:
+		topics = evt.GetDuplicateMessage().GetTopics()
+	case pb.TraceEvent_REJECT_MESSAGE:
+		topics = evt.GetRejectMessage().GetTopics()
+	case pb.TraceEvent_GRAFT:
+		topics = []string{evt.GetGraft().GetTopic()}
+	case pb.TraceEvent_PRUNE:
+		topics = []string{evt.GetPrune().GetTopic()}
+	default:
+		return
+	}
+	if !a.matchTopic(topics) {
+		return
+	}
+	timestamp := evt.GetTimestamp()
+	if a.first == 0 || timestamp < a.first {
+		a.first = timestamp
+	}
+	if timestamp > a.last {
+		a.last = timestamp
+	}
+
+	switch evt.GetType() {
+	case pb.TraceEvent_PUBLISH_MESSAGE:
+		a.published[string(evt.GetPublishMessage().GetMessageID())] = event{peer: string(evt.GetPeerID()), timestamp: timestamp}
+		for _, topic := range topics {
+			a.topicMessages(topic).Published++
+		}
+	case pb.TraceEvent_DELIVER_MESSAGE:
+		id := string(evt.GetDeliverMessage().GetMessageID())
+		a.deliveries[id] = append(a.deliveries[id], event{peer: string(evt.GetPeerID()), timestamp: timestamp})
+		for _, topic := range topics {
+			a.topicMessages(topic).Delivered++
+		}
+	case pb.TraceEvent_DUPLICATE_MESSAGE:
+		for _, topic := range topics {
+			a.topicMessages(topic).Duplicates++
+		}
+	case pb.TraceEvent_REJECT_MESSAGE:
+		a.rejections[evt.GetRejectMessage().GetReason()]++
+	case pb.TraceEvent_GRAFT:
+		a.churn(topics[0]).Grafts++
+	case pb.TraceEvent_PRUNE:
+		a.churn(topics[0]).Prunes++
+	}
+}
+
+// matchTopic check if topics of an event include analyzed topic
+func (a *analyzer) matchTopic(topics []string) bool {
+	if a.topic == "" {
+		return true
+	}
+	for _, topic := range topics {
+		if topic == a.topic {
+			return true
+		}
+	}
+	return false
+}
+
+// churn get churn of a topic
+func (a *analyzer) churn(topic string) *Churn {
+	if _, ok := a.mesh[topic]; !ok {
+		a.mesh[topic] = &Churn{}
+	}
+	return a.mesh[topic]
+}
+
+// topicMessages get message events of a topic
+func (a *analyzer) topicMessages(topic string) *Messages {
+	if _, ok := a.messages[topic]; !ok {
+		a.messages[topic] = &Messages{}
+	}
+	return a.messages[topic]
+}
+
+// delay compute propagation delay of deliveries to other nodes whose
+// message was published in analyzed traces
+func (a *analyzer) delay() Delay {
+	delays := make([]int64, 0)
+	for id, deliveries := range a.deliveries {
+		publish, ok := a.published[id]
+		if !ok {
+			continue
+		}
+		for _, d := range deliveries {
+			if d.peer != publish.peer {
+				delays = append(delays, d.timestamp-publish.timestamp)
+			}
+		}
+	}
+	if len(delays) == 0 {
+		return Delay{}
+	}
+	sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+	percentile := func(p float64) float64 {
+		return milliseconds(delays[int(p*float64(len(delays)-1))])
+	}
+	return Delay{
+		Deliveries: len(delays),
+		Min:        milliseconds(delays[0]),
+		P50:        percentile(0.5),
+		P95:        percentile(0.95),
+		P99:        percentile(0.99),
+		Max:        milliseconds(delays[len(delays)-1]),
+	}
+}
+
+// milliseconds convert nanoseconds to milliseconds
+func milliseconds(nanoseconds int64) float64 {
+	return float64(nanoseconds) / float64(time.Millisecond)
+}
+
+// summary compute summary of all accounted events
+func (a *analyzer) summary(files []string) Summary {
+	summary := Summary{
+		Files:      files,
+		Start:      time.Unix(0, a.first),
+		End:        time.Unix(0, a.last),
+		Messages:   a.messages,
+		Delay:      a.delay(),
+		Mesh:       a.mesh,
+		Rejections: a.rejections,
+	}
+	for _, messages := range a.messages {
+		if messages.Delivered > 0 {
+			messages.DuplicateRatio = float64(messages.Duplicates) / float64(messages.Delivered)
+		}
+	}
+	if minutes := time.Duration(a.last - a.first).Minutes(); minutes > 0 {
+		for _, churn := range a.mesh {
+			churn.PerMinute = float64(churn.Grafts+churn.Prunes) / minutes
+		}
+	}
+	return summary
+}
+
+// printSummary print human readable summary
+func printSummary(s Summary) {
+	fmt.Printf("Span: %s - %s (%v)\n", s.Start.Format(time.RFC3339), s.End.Format(time.RFC3339), s.End.Sub(s.Start))
+
+	fmt.Println("\nMessages:")
+	if len(s.Messages) == 0 {
+		fmt.Println("  No message events")
+	}
+	topics := make([]string, 0, len(s.Messages))
+	for topic := range s.Messages {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		messages := s.Messages[topic]
+		fmt.Printf("  %-20s published: %d delivered: %d duplicates: %d (%.2f/delivery)\n", topic, messages.Published, messages.Delivered, messages.Duplicates, messages.DuplicateRatio)
+	}
+
+	fmt.Println("\nDelay (ms):")
+	if s.Delay.Deliveries == 0 {
+		fmt.Println("  No delivery of a traced publish")
+	} else {
+		fmt.Printf("  deliveries: %d min: %.2f p50: %.2f p95: %.2f p99: %.2f max: %.2f\n", s.Delay.Deliveries, s.Delay.Min, s.Delay.P50, s.Delay.P95, s.Delay.P99, s.Delay.Max)
+	}
+
+	fmt.Println("\nRejections:")
+	if len(s.Rejections) == 0 {
+		fmt.Println("  No rejected message")
+	}
+	for _, reason := range sortedKeys(s.Rejections) {
+		fmt.Printf("  %-20s %d\n", reason, s.Rejections[reason])
+	}
+
+	fmt.Println("\nMesh churn:")
+	if len(s.Mesh) == 0 {
+		fmt.Println("  No GRAFT/PRUNE events")
+	}
+	topics = make([]string, 0, len(s.Mesh))
+	for topic := range s.Mesh {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		churn := s.Mesh[topic]
+		fmt.Printf("  %-20s grafts: %d prunes: %d (%.2f/min)\n", topic, churn.Grafts, churn.Prunes, churn.PerMinute)
+	}
+}
+
+// sortedKeys get keys of a counter map in order
+func sortedKeys(counters map[string]int) []string {
+	keys := make([]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,28 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build tools
+// +build tools
+
+package main
+
+// Trace collector and statistics of go-libp2p-pubsub-tracer are used as they
+// are, they are pinned by go.mod:
+//
+//	go run github.com/libp2p/go-libp2p-pubsub-tracer/cmd/traced -dir traces
+//	go run github.com/libp2p/go-libp2p-pubsub-tracer/cmd/tracestat -cdf traces/*.pb.gz
+import (
+	_ "github.com/libp2p/go-libp2p-pubsub-tracer/cmd/traced"
+	_ "github.com/libp2p/go-libp2p-pubsub-tracer/cmd/tracestat"
+)
@@ -0,0 +1,58 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/p2sub/p2sub/node"
+)
+
+// readBootstrapFile read multiaddrs from DNS TXT-style file, each line is a
+// record likes `dnsaddr=/ip4/1.2.3.4/tcp/4433/p2p/<ID>`, blank lines and
+// lines start with # are ignored
+func readBootstrapFile(fileName string) ([]string, error) {
+	fid, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+	peerList := make([]string, 0)
+	scanner := bufio.NewScanner(fid)
+	for scanner.Scan() {
+		line := strings.Trim(strings.TrimSpace(scanner.Text()), "\"")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		peerList = append(peerList, strings.TrimPrefix(line, "dnsaddr="))
+	}
+	return peerList, scanner.Err()
+}
+
+// getBootstrapPeers get bootstrap peers given by flags and bootstrap file
+func getBootstrapPeers() ([]peer.AddrInfo, error) {
+	peerList := conf.GetBootstrapPeers()
+	if bootstrapFile := conf.GetBootstrapFile(); bootstrapFile != "" {
+		filePeers, err := readBootstrapFile(bootstrapFile)
+		if err != nil {
+			return nil, err
+		}
+		peerList = append(peerList, filePeers...)
+	}
+	return node.ParsePeers(peerList)
+}
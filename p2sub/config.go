@@ -15,14 +15,21 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/p2sub/p2sub/admin"
 	"github.com/p2sub/p2sub/config"
 	"github.com/p2sub/p2sub/logger"
+	"github.com/p2sub/p2sub/node"
 	"go.uber.org/zap"
 )
 
@@ -102,6 +109,488 @@ func (p *P2SubConfig) SetDomain(domain string) bool {
 	return p.cfg.Set("node::domain", domain)
 }
 
+// GetPSKFile get pre-shared key file of private network
+func (p *P2SubConfig) GetPSKFile() string {
+	return p.cfg.GetString("node::psk_file")
+}
+
+// SetPSKFile set pre-shared key file of private network
+func (p *P2SubConfig) SetPSKFile(pskFile string) bool {
+	return p.cfg.Set("node::psk_file", pskFile)
+}
+
+// IsPrivateNetwork check if current node joins a private network
+func (p *P2SubConfig) IsPrivateNetwork() bool {
+	return p.GetPSKFile() != ""
+}
+
+// GetBootstrapPeers get multiaddrs of bootstrap peers
+func (p *P2SubConfig) GetBootstrapPeers() []string {
+	return p.cfg.GetStrings("node::bootstrap_peers")
+}
+
+// SetBootstrapPeers set multiaddrs of bootstrap peers
+func (p *P2SubConfig) SetBootstrapPeers(bootstrapPeers []string) bool {
+	return p.cfg.Set("node::bootstrap_peers", bootstrapPeers)
+}
+
+// GetBootstrapFile get DNS TXT-style file of bootstrap peers
+func (p *P2SubConfig) GetBootstrapFile() string {
+	return p.cfg.GetString("node::bootstrap_file")
+}
+
+// SetBootstrapFile set DNS TXT-style file of bootstrap peers
+func (p *P2SubConfig) SetBootstrapFile(bootstrapFile string) bool {
+	return p.cfg.Set("node::bootstrap_file", bootstrapFile)
+}
+
+// GetBootstrapRetries get number of retries for each bootstrap peer
+func (p *P2SubConfig) GetBootstrapRetries() uint {
+	return p.cfg.GetUint("node::bootstrap_retries")
+}
+
+// SetBootstrapRetries set number of retries for each bootstrap peer
+func (p *P2SubConfig) SetBootstrapRetries(retries uint) bool {
+	return p.cfg.Set("node::bootstrap_retries", retries)
+}
+
+// IsNoPublicBootstrap check if public bootstrap nodes were disabled
+func (p *P2SubConfig) IsNoPublicBootstrap() bool {
+	return p.cfg.GetBool("node::no_public_bootstrap")
+}
+
+// SetNoPublicBootstrap disable or enable public bootstrap nodes
+func (p *P2SubConfig) SetNoPublicBootstrap(noPublicBootstrap bool) bool {
+	return p.cfg.Set("node::no_public_bootstrap", noPublicBootstrap)
+}
+
+// GetDiscoveryModes get enabled discovery modes, DHT is used if nothing was set
+func (p *P2SubConfig) GetDiscoveryModes() []string {
+	if modes := p.cfg.GetStrings("node::discovery"); len(modes) > 0 {
+		return modes
+	}
+	return []string{node.DiscoveryDHT}
+}
+
+// SetDiscoveryModes set enabled discovery modes
+func (p *P2SubConfig) SetDiscoveryModes(modes []string) bool {
+	return p.cfg.Set("node::discovery", modes)
+}
+
+// IsDiscoveryEnabled check if given discovery mode was enabled
+func (p *P2SubConfig) IsDiscoveryEnabled(mode string) bool {
+	for _, enabledMode := range p.GetDiscoveryModes() {
+		if enabledMode == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDiscoveryInterval get interval of discovery loop in seconds
+func (p *P2SubConfig) GetDiscoveryInterval() uint {
+	return p.cfg.GetUint("node::discovery_interval")
+}
+
+// SetDiscoveryInterval set interval of discovery loop in seconds
+func (p *P2SubConfig) SetDiscoveryInterval(interval uint) bool {
+	return p.cfg.Set("node::discovery_interval", interval)
+}
+
+// GetTargetPeers get number of peers discovery manager tries to maintain
+func (p *P2SubConfig) GetTargetPeers() uint {
+	return p.cfg.GetUint("node::target_peers")
+}
+
+// SetTargetPeers set number of peers discovery manager tries to maintain
+func (p *P2SubConfig) SetTargetPeers(targetPeers uint) bool {
+	return p.cfg.Set("node::target_peers", targetPeers)
+}
+
+// GetMdnsInterval get interval of mDNS queries in seconds
+func (p *P2SubConfig) GetMdnsInterval() uint {
+	return p.cfg.GetUint("node::mdns_interval")
+}
+
+// SetMdnsInterval set interval of mDNS queries in seconds
+func (p *P2SubConfig) SetMdnsInterval(interval uint) bool {
+	return p.cfg.Set("node::mdns_interval", interval)
+}
+
+// GetShutdownTimeout get deadline of graceful shutdown in seconds
+func (p *P2SubConfig) GetShutdownTimeout() uint {
+	return p.cfg.GetUint("node::shutdown_timeout")
+}
+
+// SetShutdownTimeout set deadline of graceful shutdown in seconds
+func (p *P2SubConfig) SetShutdownTimeout(timeout uint) bool {
+	return p.cfg.Set("node::shutdown_timeout", timeout)
+}
+
+// GetWSListen get listen address of gateway
+func (p *P2SubConfig) GetWSListen() string {
+	return p.cfg.GetString("node::ws_listen")
+}
+
+// SetWSListen set listen address of gateway
+func (p *P2SubConfig) SetWSListen(wsListen string) bool {
+	return p.cfg.Set("node::ws_listen", wsListen)
+}
+
+// GetAdminListen get listen address of admin API
+func (p *P2SubConfig) GetAdminListen() string {
+	return p.cfg.GetString("node::admin_listen")
+}
+
+// SetAdminListen set listen address of admin API
+func (p *P2SubConfig) SetAdminListen(adminListen string) bool {
+	return p.cfg.Set("node::admin_listen", adminListen)
+}
+
+// GetMetricsListen get listen address of Prometheus metrics
+func (p *P2SubConfig) GetMetricsListen() string {
+	return p.cfg.GetString("node::metrics_listen")
+}
+
+// SetMetricsListen set listen address of Prometheus metrics
+func (p *P2SubConfig) SetMetricsListen(metricsListen string) bool {
+	return p.cfg.Set("node::metrics_listen", metricsListen)
+}
+
+// GetTraceFile get file of gossipsub trace events
+func (p *P2SubConfig) GetTraceFile() string {
+	return p.cfg.GetString("node::trace_file")
+}
+
+// SetTraceFile set file of gossipsub trace events
+func (p *P2SubConfig) SetTraceFile(traceFile string) bool {
+	return p.cfg.Set("node::trace_file", traceFile)
+}
+
+// GetTraceFormat get format of trace file
+func (p *P2SubConfig) GetTraceFormat() string {
+	return p.cfg.GetString("node::trace_format")
+}
+
+// SetTraceFormat set format of trace file
+func (p *P2SubConfig) SetTraceFormat(traceFormat string) bool {
+	return p.cfg.Set("node::trace_format", traceFormat)
+}
+
+// GetRemoteTracer get multiaddr of remote tracer peer
+func (p *P2SubConfig) GetRemoteTracer() string {
+	return p.cfg.GetString("node::remote_tracer")
+}
+
+// SetRemoteTracer set multiaddr of remote tracer peer
+func (p *P2SubConfig) SetRemoteTracer(remoteTracer string) bool {
+	return p.cfg.Set("node::remote_tracer", remoteTracer)
+}
+
+// GetGossipSubPreset get preset of gossipsub parameters
+func (p *P2SubConfig) GetGossipSubPreset() string {
+	return p.cfg.GetString("node::gossipsub_preset")
+}
+
+// SetGossipSubPreset set preset of gossipsub parameters
+func (p *P2SubConfig) SetGossipSubPreset(preset string) bool {
+	return p.cfg.Set("node::gossipsub_preset", preset)
+}
+
+// GetGossipSubFile get JSON file of gossipsub and peer score parameters
+func (p *P2SubConfig) GetGossipSubFile() string {
+	return p.cfg.GetString("node::gossipsub_file")
+}
+
+// SetGossipSubFile set JSON file of gossipsub and peer score parameters
+func (p *P2SubConfig) SetGossipSubFile(gossipSubFile string) bool {
+	return p.cfg.Set("node::gossipsub_file", gossipSubFile)
+}
+
+// GetGossipSubD get desired degree of gossipsub mesh, 0 keeps preset value
+func (p *P2SubConfig) GetGossipSubD() uint {
+	return p.cfg.GetUint("node::gossipsub_d")
+}
+
+// SetGossipSubD set desired degree of gossipsub mesh
+func (p *P2SubConfig) SetGossipSubD(d uint) bool {
+	return p.cfg.Set("node::gossipsub_d", d)
+}
+
+// GetGossipSubDlo get lower bound of gossipsub mesh degree, 0 keeps preset value
+func (p *P2SubConfig) GetGossipSubDlo() uint {
+	return p.cfg.GetUint("node::gossipsub_dlo")
+}
+
+// SetGossipSubDlo set lower bound of gossipsub mesh degree
+func (p *P2SubConfig) SetGossipSubDlo(dlo uint) bool {
+	return p.cfg.Set("node::gossipsub_dlo", dlo)
+}
+
+// GetGossipSubDhi get upper bound of gossipsub mesh degree, 0 keeps preset value
+func (p *P2SubConfig) GetGossipSubDhi() uint {
+	return p.cfg.GetUint("node::gossipsub_dhi")
+}
+
+// SetGossipSubDhi set upper bound of gossipsub mesh degree
+func (p *P2SubConfig) SetGossipSubDhi(dhi uint) bool {
+	return p.cfg.Set("node::gossipsub_dhi", dhi)
+}
+
+// GetGossipSubHeartbeat get gossipsub heartbeat interval in milliseconds, 0
+// keeps preset value
+func (p *P2SubConfig) GetGossipSubHeartbeat() uint {
+	return p.cfg.GetUint("node::gossipsub_heartbeat")
+}
+
+// SetGossipSubHeartbeat set gossipsub heartbeat interval in milliseconds
+func (p *P2SubConfig) SetGossipSubHeartbeat(heartbeat uint) bool {
+	return p.cfg.Set("node::gossipsub_heartbeat", heartbeat)
+}
+
+// GetGossipSubHistoryLength get number of heartbeats messages are cached for,
+// 0 keeps preset value
+func (p *P2SubConfig) GetGossipSubHistoryLength() uint {
+	return p.cfg.GetUint("node::gossipsub_history_length")
+}
+
+// SetGossipSubHistoryLength set number of heartbeats messages are cached for
+func (p *P2SubConfig) SetGossipSubHistoryLength(historyLength uint) bool {
+	return p.cfg.Set("node::gossipsub_history_length", historyLength)
+}
+
+// GetGossipSubHistoryGossip get number of heartbeats messages are gossiped
+// for, 0 keeps preset value
+func (p *P2SubConfig) GetGossipSubHistoryGossip() uint {
+	return p.cfg.GetUint("node::gossipsub_history_gossip")
+}
+
+// SetGossipSubHistoryGossip set number of heartbeats messages are gossiped for
+func (p *P2SubConfig) SetGossipSubHistoryGossip(historyGossip uint) bool {
+	return p.cfg.Set("node::gossipsub_history_gossip", historyGossip)
+}
+
+// GetFloodPublish get flood publish as "true" or "false", empty keeps preset value
+func (p *P2SubConfig) GetFloodPublish() string {
+	return p.cfg.GetString("node::flood_publish")
+}
+
+// SetFloodPublish set flood publish
+func (p *P2SubConfig) SetFloodPublish(floodPublish string) bool {
+	return p.cfg.Set("node::flood_publish", floodPublish)
+}
+
+// GetPeerRate get rate limit of messages originated by each remote peer per second, 0 disables it
+func (p *P2SubConfig) GetPeerRate() uint {
+	return p.cfg.GetUint("node::peer_rate")
+}
+
+// SetPeerRate set rate limit of messages originated by each remote peer per second
+func (p *P2SubConfig) SetPeerRate(rate uint) bool {
+	return p.cfg.Set("node::peer_rate", rate)
+}
+
+// GetPeerBurst get burst of messages originated by each remote peer
+func (p *P2SubConfig) GetPeerBurst() uint {
+	return p.cfg.GetUint("node::peer_burst")
+}
+
+// SetPeerBurst set burst of messages originated by each remote peer
+func (p *P2SubConfig) SetPeerBurst(burst uint) bool {
+	return p.cfg.Set("node::peer_burst", burst)
+}
+
+// GetTopicRate get rate limit of messages of each topic per second, 0 disables it
+func (p *P2SubConfig) GetTopicRate() uint {
+	return p.cfg.GetUint("node::topic_rate")
+}
+
+// SetTopicRate set rate limit of messages of each topic per second
+func (p *P2SubConfig) SetTopicRate(rate uint) bool {
+	return p.cfg.Set("node::topic_rate", rate)
+}
+
+// GetTopicBurst get burst of messages of each topic
+func (p *P2SubConfig) GetTopicBurst() uint {
+	return p.cfg.GetUint("node::topic_burst")
+}
+
+// SetTopicBurst set burst of messages of each topic
+func (p *P2SubConfig) SetTopicBurst(burst uint) bool {
+	return p.cfg.Set("node::topic_burst", burst)
+}
+
+// GetWSRate get rate limit of frames received from each WebSocket client per second, 0 disables it
+func (p *P2SubConfig) GetWSRate() uint {
+	return p.cfg.GetUint("node::ws_rate")
+}
+
+// SetWSRate set rate limit of frames received from each WebSocket client per second
+func (p *P2SubConfig) SetWSRate(rate uint) bool {
+	return p.cfg.Set("node::ws_rate", rate)
+}
+
+// GetWSBurst get burst of frames received from each WebSocket client
+func (p *P2SubConfig) GetWSBurst() uint {
+	return p.cfg.GetUint("node::ws_burst")
+}
+
+// SetWSBurst set burst of frames received from each WebSocket client
+func (p *P2SubConfig) SetWSBurst(burst uint) bool {
+	return p.cfg.Set("node::ws_burst", burst)
+}
+
+// GetWSRequestLimit get number of requests and direct sends a WebSocket
+// client could have in flight, 0 is gateway default
+func (p *P2SubConfig) GetWSRequestLimit() uint {
+	return p.cfg.GetUint("node::ws_request_limit")
+}
+
+// SetWSRequestLimit set number of requests and direct sends a WebSocket client could have in flight
+func (p *P2SubConfig) SetWSRequestLimit(limit uint) bool {
+	return p.cfg.Set("node::ws_request_limit", limit)
+}
+
+// GetWSAckWindow get number of messages a WebSocket client with
+// acknowledged delivery could leave unacknowledged, 0 is gateway default
+func (p *P2SubConfig) GetWSAckWindow() uint {
+	return p.cfg.GetUint("node::ws_ack_window")
+}
+
+// SetWSAckWindow set number of messages a WebSocket client could leave unacknowledged
+func (p *P2SubConfig) SetWSAckWindow(window uint) bool {
+	return p.cfg.Set("node::ws_ack_window", window)
+}
+
+// GetWSAckTimeout get seconds before an unacknowledged message is
+// redelivered, 0 is gateway default
+func (p *P2SubConfig) GetWSAckTimeout() uint {
+	return p.cfg.GetUint("node::ws_ack_timeout")
+}
+
+// SetWSAckTimeout set seconds before an unacknowledged message is redelivered
+func (p *P2SubConfig) SetWSAckTimeout(timeout uint) bool {
+	return p.cfg.Set("node::ws_ack_timeout", timeout)
+}
+
+// GetWSSessionGrace get seconds a disconnected WebSocket client has to
+// resume its session, 0 is gateway default
+func (p *P2SubConfig) GetWSSessionGrace() uint {
+	return p.cfg.GetUint("node::ws_session_grace")
+}
+
+// SetWSSessionGrace set seconds a disconnected WebSocket client has to resume its session
+func (p *P2SubConfig) SetWSSessionGrace(grace uint) bool {
+	return p.cfg.Set("node::ws_session_grace", grace)
+}
+
+// GetWSSessionBuffer get number of messages buffered for a WebSocket
+// session while its client is away, 0 is gateway default
+func (p *P2SubConfig) GetWSSessionBuffer() uint {
+	return p.cfg.GetUint("node::ws_session_buffer")
+}
+
+// SetWSSessionBuffer set number of messages buffered for a WebSocket session
+func (p *P2SubConfig) SetWSSessionBuffer(buffer uint) bool {
+	return p.cfg.Set("node::ws_session_buffer", buffer)
+}
+
+// GetWSSessionLifetime get seconds after which a WebSocket session could not
+// be resumed anymore, 0 is gateway default
+func (p *P2SubConfig) GetWSSessionLifetime() uint {
+	return p.cfg.GetUint("node::ws_session_lifetime")
+}
+
+// SetWSSessionLifetime set seconds after which a WebSocket session could not be resumed
+func (p *P2SubConfig) SetWSSessionLifetime(lifetime uint) bool {
+	return p.cfg.Set("node::ws_session_lifetime", lifetime)
+}
+
+// GetGroupFile get JSON file of encrypted topics
+func (p *P2SubConfig) GetGroupFile() string {
+	return p.cfg.GetString("node::group_file")
+}
+
+// SetGroupFile set JSON file of encrypted topics
+func (p *P2SubConfig) SetGroupFile(groupFile string) bool {
+	return p.cfg.Set("node::group_file", groupFile)
+}
+
+// GetTopicFile get JSON file of topic parameters
+func (p *P2SubConfig) GetTopicFile() string {
+	return p.cfg.GetString("node::topic_file")
+}
+
+// SetTopicFile set JSON file of topic parameters
+func (p *P2SubConfig) SetTopicFile(topicFile string) bool {
+	return p.cfg.Set("node::topic_file", topicFile)
+}
+
+// GetClockSkew get seconds of clock difference tolerated when expiry of messages is checked
+func (p *P2SubConfig) GetClockSkew() uint {
+	return p.cfg.GetUint("node::clock_skew")
+}
+
+// SetClockSkew set seconds of clock difference tolerated when expiry of messages is checked
+func (p *P2SubConfig) SetClockSkew(clockSkew uint) bool {
+	return p.cfg.Set("node::clock_skew", clockSkew)
+}
+
+// GetReassemblyMemory get MiB of fragments of chunked messages kept for reassembly
+func (p *P2SubConfig) GetReassemblyMemory() uint {
+	return p.cfg.GetUint("node::reassembly_memory")
+}
+
+// SetReassemblyMemory set MiB of fragments of chunked messages kept for reassembly
+func (p *P2SubConfig) SetReassemblyMemory(memory uint) bool {
+	return p.cfg.Set("node::reassembly_memory", memory)
+}
+
+// GetReassemblyTimeout get seconds a chunked message waits for its missing fragments
+func (p *P2SubConfig) GetReassemblyTimeout() uint {
+	return p.cfg.GetUint("node::reassembly_timeout")
+}
+
+// SetReassemblyTimeout set seconds a chunked message waits for its missing fragments
+func (p *P2SubConfig) SetReassemblyTimeout(timeout uint) bool {
+	return p.cfg.Set("node::reassembly_timeout", timeout)
+}
+
+// GetMaxKnownTopics get number of topics announced by peers the node keeps track of
+func (p *P2SubConfig) GetMaxKnownTopics() uint {
+	return p.cfg.GetUint("node::max_known_topics")
+}
+
+// SetMaxKnownTopics set number of topics announced by peers the node keeps track of
+func (p *P2SubConfig) SetMaxKnownTopics(limit uint) bool {
+	return p.cfg.Set("node::max_known_topics", limit)
+}
+
+// GetMaxPatternTopics get number of topics a pattern subscription joins at most
+func (p *P2SubConfig) GetMaxPatternTopics() uint {
+	return p.cfg.GetUint("node::max_pattern_topics")
+}
+
+// SetMaxPatternTopics set number of topics a pattern subscription joins at most
+func (p *P2SubConfig) SetMaxPatternTopics(limit uint) bool {
+	return p.cfg.Set("node::max_pattern_topics", limit)
+}
+
+// IsCatchAllPatterns check if patterns matching every topic were allowed
+func (p *P2SubConfig) IsCatchAllPatterns() bool {
+	return p.cfg.GetBool("node::catch_all_patterns")
+}
+
+// SetCatchAllPatterns allow or refuse patterns matching every topic
+func (p *P2SubConfig) SetCatchAllPatterns(catchAll bool) bool {
+	return p.cfg.Set("node::catch_all_patterns", catchAll)
+}
+
+// GetConfigFile get JSON configuration file
+func (p *P2SubConfig) GetConfigFile() string {
+	return p.cfg.GetString("node::config_file")
+}
+
 func (f FlagConfig) valToBool() bool {
 	if v, ok := f.value.(bool); ok {
 		return v
@@ -130,6 +619,77 @@ func (f FlagConfig) valToUint() uint {
 	return 0
 }
 
+func (f FlagConfig) valToStrings() []string {
+	if v, ok := f.value.([]string); ok {
+		return v
+	}
+	return []string{}
+}
+
+// stringList repeatable flag, each value could be comma-separated
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*s = append(*s, v)
+		}
+	}
+	return nil
+}
+
+func (s *stringList) Get() interface{} {
+	return []string(*s)
+}
+
+// loadConfigFile set flags from JSON configuration file, e.g:
+//
+//	{"node": {"bind_port": 4433, "bootstrap_peers": ["/ip4/..."]}}
+//
+// Flags in skipFlags were given in command line and won't be overwritten
+func loadConfigFile(fileName string, skipFlags map[string]bool) error {
+	fileContent, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	// Keep numbers as they were written, flag parser will validate them
+	sections := make(map[string]map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(fileContent))
+	decoder.UseNumber()
+	if err := decoder.Decode(&sections); err != nil {
+		return err
+	}
+	for section, values := range sections {
+		for key, value := range values {
+			// Separator in a name would make nameToFlag panic
+			if strings.Contains(section, "::") || strings.Contains(key, "::") {
+				return fmt.Errorf("invalid configuration name %s::%s", section, key)
+			}
+			flagName := nameToFlag(section + "::" + key)
+			if skipFlags[flagName] {
+				continue
+			}
+			if flag.Lookup(flagName) == nil {
+				return fmt.Errorf("unknown configuration %s::%s", section, key)
+			}
+			rawValues := []interface{}{value}
+			if list, ok := value.([]interface{}); ok {
+				rawValues = list
+			}
+			for _, rawValue := range rawValues {
+				if err := flag.Set(flagName, fmt.Sprint(rawValue)); err != nil {
+					return fmt.Errorf("invalid value of %s::%s: %v", section, key, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func nameToFlag(name string) string {
 	parts := strings.Split(name, "::")
 	if len(parts) == 2 {
@@ -146,6 +706,12 @@ func Init() {
 
 	// All flags configuration
 	flagConfigs := []FlagConfig{
+		{
+			name:        "node::config_file",
+			dataType:    "string",
+			value:       "",
+			description: "JSON configuration file, flags given in command line take precedence",
+		},
 		{
 			name:        "node::key_file",
 			dataType:    "string",
@@ -162,9 +728,279 @@ func Init() {
 		{
 			name:        "node::domain",
 			dataType:    "string",
-			value:       "P2Sub::alpha::0.0.1",
+			value:       node.DefaultDomain,
 			description: "Rendezvous string used to discover same node",
 		},
+		{
+			name:        "node::psk_file",
+			dataType:    "string",
+			value:       "",
+			description: "Pre-shared key file of private network, it must exist, generate it with p2sub-psk",
+		},
+		{
+			name:        "node::bootstrap_peers",
+			dataType:    "list",
+			value:       []string{},
+			description: "Multiaddr of bootstrap node, repeatable or comma-separated, replace public bootstrap nodes",
+		},
+		{
+			name:        "node::bootstrap_file",
+			dataType:    "string",
+			value:       "",
+			description: "DNS TXT-style file of bootstrap nodes, one dnsaddr=<multiaddr> per line",
+		},
+		{
+			name:        "node::bootstrap_retries",
+			dataType:    "uint",
+			value:       uint(5),
+			description: "Number of retries with exponential backoff for each bootstrap node",
+		},
+		{
+			name:        "node::no_public_bootstrap",
+			dataType:    "bool",
+			value:       false,
+			description: "Never dial public bootstrap nodes even if no bootstrap node was given",
+		},
+		{
+			name:        "node::discovery",
+			dataType:    "list",
+			value:       []string{},
+			description: "Discovery modes of nodes in the same domain: dht, mdns, repeatable or comma-separated (default dht)",
+		},
+		{
+			name:        "node::discovery_interval",
+			dataType:    "uint",
+			value:       uint(30),
+			description: "Interval of discovery loop in seconds, it re-queries the rendezvous and reconnects lost peers",
+		},
+		{
+			name:        "node::target_peers",
+			dataType:    "uint",
+			value:       uint(8),
+			description: "Number of connected peers discovery manager tries to reach, connections above it are not pruned",
+		},
+		{
+			name:        "node::mdns_interval",
+			dataType:    "uint",
+			value:       uint(10),
+			description: "Interval of mDNS queries in seconds",
+		},
+		{
+			name:        "node::shutdown_timeout",
+			dataType:    "uint",
+			value:       uint(10),
+			description: "Deadline of draining clients at shutdown in seconds, process exits with code 3 if node was not closed 3 seconds later",
+		},
+		{
+			name:        "node::ws_listen",
+			dataType:    "string",
+			value:       "",
+			description: "Listen address of gateway, WebSocket is served on /ws and REST on /topics/, empty disables it",
+		},
+		{
+			name:        "node::admin_listen",
+			dataType:    "string",
+			value:       admin.DefaultListen,
+			description: "Listen address of HTTP admin API, empty disables it",
+		},
+		{
+			name:        "node::metrics_listen",
+			dataType:    "string",
+			value:       "",
+			description: "Listen address of Prometheus metrics served on /metrics, they are served by admin API if it's empty",
+		},
+		{
+			name:        "node::trace_file",
+			dataType:    "string",
+			value:       "",
+			description: "Write gossipsub trace events to this file",
+		},
+		{
+			name:        "node::trace_format",
+			dataType:    "string",
+			value:       node.TraceJSON,
+			description: "Format of trace file: json, pb",
+		},
+		{
+			name:        "node::remote_tracer",
+			dataType:    "string",
+			value:       "",
+			description: "Multiaddr of a remote tracer peer, e.g: traced of go-libp2p-pubsub-tracer",
+		},
+		{
+			name:        "node::gossipsub_preset",
+			dataType:    "string",
+			value:       node.PresetDefault,
+			description: "Preset of gossipsub parameters: default, trusted (small trusted cluster), open (open network with peer scoring)",
+		},
+		{
+			name:        "node::gossipsub_file",
+			dataType:    "string",
+			value:       "",
+			description: "JSON file of gossipsub and peer score parameters, its fields overwrite the preset",
+		},
+		{
+			name:        "node::gossipsub_d",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Desired degree of gossipsub mesh, 0 keeps preset value",
+		},
+		{
+			name:        "node::gossipsub_dlo",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Lower bound of gossipsub mesh degree, 0 keeps preset value",
+		},
+		{
+			name:        "node::gossipsub_dhi",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Upper bound of gossipsub mesh degree, 0 keeps preset value",
+		},
+		{
+			name:        "node::gossipsub_heartbeat",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Gossipsub heartbeat interval in milliseconds, 0 keeps preset value",
+		},
+		{
+			name:        "node::gossipsub_history_length",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Number of heartbeats messages are cached for, 0 keeps preset value",
+		},
+		{
+			name:        "node::gossipsub_history_gossip",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Number of heartbeats messages are gossiped for, 0 keeps preset value",
+		},
+		{
+			name:        "node::flood_publish",
+			dataType:    "string",
+			value:       "",
+			description: "Publish to all peers with enough score instead of mesh peers only: true, false, empty keeps preset value",
+		},
+		{
+			name:        "node::peer_rate",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Rate limit of messages originated by each remote peer per second, 0 disables it",
+		},
+		{
+			name:        "node::peer_burst",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Burst of messages originated by each remote peer over rate limit, 0 is the same as rate",
+		},
+		{
+			name:        "node::topic_rate",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Rate limit of messages of each topic per second, 0 disables it",
+		},
+		{
+			name:        "node::topic_burst",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Burst of messages of each topic over rate limit, 0 is the same as rate",
+		},
+		{
+			name:        "node::ws_rate",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Rate limit of frames received from each WebSocket client per second, 0 disables it",
+		},
+		{
+			name:        "node::ws_burst",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Burst of frames received from each WebSocket client over rate limit, 0 is the same as rate",
+		},
+		{
+			name:        "node::ws_request_limit",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Number of requests and direct sends a WebSocket client could have in flight, 0 is 16",
+		},
+		{
+			name:        "node::ws_ack_window",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Number of messages a WebSocket client with acknowledged delivery could leave unacknowledged, 0 is 64",
+		},
+		{
+			name:        "node::ws_ack_timeout",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Seconds before an unacknowledged message is redelivered to a WebSocket client, 0 is 10",
+		},
+		{
+			name:        "node::ws_session_grace",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Seconds a disconnected WebSocket client has to resume its session, its subscriptions are kept meanwhile, 0 is 60",
+		},
+		{
+			name:        "node::ws_session_buffer",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Number of messages buffered for a WebSocket session while its client is away, 0 is 256",
+		},
+		{
+			name:        "node::ws_session_lifetime",
+			dataType:    "uint",
+			value:       uint(0),
+			description: "Seconds after which a WebSocket session could not be resumed anymore, 0 is 3600",
+		},
+		{
+			name:        "node::group_file",
+			dataType:    "string",
+			value:       "",
+			description: "JSON file of encrypted topics with their owner and members, members are reloaded on SIGHUP",
+		},
+		{
+			name:        "node::topic_file",
+			dataType:    "string",
+			value:       "",
+			description: "JSON file of topic parameters by topic or pattern e.g: ordered delivery",
+		},
+		{
+			name:        "node::clock_skew",
+			dataType:    "uint",
+			value:       uint(node.DefaultClockSkew / time.Second),
+			description: "Seconds of clock difference between nodes tolerated when expiry of messages is checked",
+		},
+		{
+			name:        "node::reassembly_memory",
+			dataType:    "uint",
+			value:       uint(node.DefaultReassemblyMemory >> 20),
+			description: "MiB of fragments of chunked messages kept for reassembly",
+		},
+		{
+			name:        "node::reassembly_timeout",
+			dataType:    "uint",
+			value:       uint(node.DefaultReassemblyTimeout / time.Second),
+			description: "Seconds a chunked message waits for its missing fragments",
+		},
+		{
+			name:        "node::max_known_topics",
+			dataType:    "uint",
+			value:       uint(node.DefaultMaxKnownTopics),
+			description: "Topics announced by peers the node keeps track of, the oldest are forgotten",
+		},
+		{
+			name:        "node::max_pattern_topics",
+			dataType:    "uint",
+			value:       uint(node.DefaultMaxPatternTopics),
+			description: "Topics a pattern subscription joins at most",
+		},
+		{
+			name:        "node::catch_all_patterns",
+			dataType:    "bool",
+			value:       false,
+			description: "Allow patterns matching every topic e.g: #, they join any topic a peer announces",
+		},
 		{
 			name:        "node::bind_port",
 			dataType:    "uint",
@@ -196,6 +1032,10 @@ func Init() {
 		case "int":
 			flag.Int(nameToFlag(flagConf.name), flagConf.valToInt(), flagConf.description)
 			break
+		case "list":
+			list := stringList(flagConf.valToStrings())
+			flag.Var(&list, nameToFlag(flagConf.name), flagConf.description)
+			break
 		}
 	}
 
@@ -208,6 +1048,17 @@ func Init() {
 		isFlagOn[f.Name] = true
 	})
 
+	// Fill flags which were not given in command line from configuration file
+	if configFile := flag.Lookup(nameToFlag("node::config_file")).Value.String(); configFile != "" {
+		sugar.Infof("Load configuration file: %s", configFile)
+		if err := loadConfigFile(configFile, isFlagOn); err != nil {
+			sugar.Fatalf("Unable to load configuration file: %v", err)
+		}
+		flag.Visit(func(f *flag.Flag) {
+			isFlagOn[f.Name] = true
+		})
+	}
+
 	//Save configuration
 	for _, flagConf := range flagConfigs {
 		if flagConf.required && !isFlagOn[nameToFlag(flagConf.name)] {
@@ -0,0 +1,62 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/p2sub/p2sub/node"
+)
+
+// getGossipSubParams get gossipsub parameters of preset, they are overwritten
+// by fields of gossipsub file then by single flags which were set
+func getGossipSubParams() (node.GossipSubParams, error) {
+	params, err := node.Preset(conf.GetGossipSubPreset())
+	if err != nil {
+		return params, err
+	}
+	if gossipSubFile := conf.GetGossipSubFile(); gossipSubFile != "" {
+		fileContent, err := ioutil.ReadFile(gossipSubFile)
+		if err != nil {
+			return params, err
+		}
+		if err := json.Unmarshal(fileContent, &params); err != nil {
+			return params, fmt.Errorf("invalid gossipsub file %s: %v", gossipSubFile, err)
+		}
+	}
+	overwrite := func(target *int, value uint) {
+		if value > 0 {
+			*target = int(value)
+		}
+	}
+	overwrite(&params.D, conf.GetGossipSubD())
+	overwrite(&params.Dlo, conf.GetGossipSubDlo())
+	overwrite(&params.Dhi, conf.GetGossipSubDhi())
+	overwrite(&params.HistoryLength, conf.GetGossipSubHistoryLength())
+	overwrite(&params.HistoryGossip, conf.GetGossipSubHistoryGossip())
+	if heartbeat := conf.GetGossipSubHeartbeat(); heartbeat > 0 {
+		params.HeartbeatInterval = node.Duration(time.Duration(heartbeat) * time.Millisecond)
+	}
+	if floodPublish := conf.GetFloodPublish(); floodPublish != "" {
+		if params.FloodPublish, err = strconv.ParseBool(floodPublish); err != nil {
+			return params, fmt.Errorf("invalid value of flood publish: %v", err)
+		}
+	}
+	return params, nil
+}
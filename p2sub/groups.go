@@ -0,0 +1,130 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/p2sub/p2sub/node"
+)
+
+// groupConfig encrypted topic of group file
+type groupConfig struct {
+	Owner   string   `json:"owner"`
+	Members []string `json:"members"`
+}
+
+// readGroupFile read encrypted topics from a JSON file, e.g:
+//
+//	{"secret": {"owner": "<peer ID>", "members": ["<peer ID>", "<peer ID>"]}}
+func readGroupFile(fileName string) (map[string]groupConfig, error) {
+	fileContent, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string]groupConfig)
+	if err := json.Unmarshal(fileContent, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// decodePeers decode peer IDs of members
+func decodePeers(members []string) ([]peer.ID, error) {
+	peers := make([]peer.ID, 0, len(members))
+	for _, member := range members {
+		peerID, err := peer.Decode(member)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, peerID)
+	}
+	return peers, nil
+}
+
+// startGroups create encrypted topics owned by current node and join the
+// others, members of owned topics are reloaded from group file on SIGHUP
+func startGroups(ctx context.Context, p2subNode *node.Node, fileName string) error {
+	groups, err := readGroupFile(fileName)
+	if err != nil {
+		return err
+	}
+	owned := make(map[string]*node.Group)
+	for topic, config := range groups {
+		owner, err := peer.Decode(config.Owner)
+		if err != nil {
+			return err
+		}
+		if owner != p2subNode.ID() {
+			sugar.Infof("Join encrypted topic %s of %s", topic, owner)
+			if err := p2subNode.JoinGroup(topic, owner); err != nil {
+				return err
+			}
+			continue
+		}
+		members, err := decodePeers(config.Members)
+		if err != nil {
+			return err
+		}
+		sugar.Infof("Create encrypted topic %s with %d members", topic, len(members))
+		group, err := p2subNode.CreateGroup(topic, members...)
+		if err != nil {
+			return err
+		}
+		owned[topic] = group
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sigChan)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigChan:
+				reloadGroups(owned, fileName)
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadGroups update members of owned encrypted topics, group keys are
+// rotated if membership changed
+func reloadGroups(owned map[string]*node.Group, fileName string) {
+	groups, err := readGroupFile(fileName)
+	if err != nil {
+		sugar.Warnf("Unable to reload group file: %v", err)
+		return
+	}
+	for topic, group := range owned {
+		members, err := decodePeers(groups[topic].Members)
+		if err != nil {
+			sugar.Warnf("Invalid members of encrypted topic %s: %v", topic, err)
+			continue
+		}
+		sugar.Infof("Reload members of encrypted topic %s", topic)
+		if err := group.SetMembers(members...); err != nil {
+			sugar.Warnf("Unable to update members of %s: %v", topic, err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Exit codes of node process
+const (
+	ExitOK              = 0
+	ExitFailure         = 1
+	ExitShutdownTimeout = 3
+)
+
+// shutdownMargin time given to the node to close after services were
+// drained, process deadline is shutdown timeout plus margin
+const shutdownMargin = 3 * time.Second
+
+// lifecycle root context of the process
+type lifecycle struct {
+	// ctx root context, it's canceled as soon as shutdown starts
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newLifecycle create root context of the process
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifecycle{ctx: ctx, cancel: cancel}
+}
+
+// handleSignals cancel root context on SIGINT/SIGTERM, the second signal
+// terminates the process immediately
+func (l *lifecycle) handleSignals() {
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigChan
+		sugar.Infof("Received signal: %v, shutting down...", sig)
+		l.cancel()
+		sig = <-sigChan
+		sugar.Warnf("Received signal: %v again, terminate immediately", sig)
+		os.Exit(ExitFailure)
+	}()
+}
+
+// shutdown cancel root context and run close within timeout, it returns
+// exit code of shutdown process
+func (l *lifecycle) shutdown(timeout time.Duration, close func() error) int {
+	l.cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- close()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			sugar.Warn(err)
+			return ExitFailure
+		}
+		sugar.Info("Shutdown completed")
+		return ExitOK
+	case <-time.After(timeout):
+		sugar.Errorf("Shutdown did not complete within %v", timeout)
+		return ExitShutdownTimeout
+	}
+}
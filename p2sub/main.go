@@ -17,28 +17,59 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 	"math/rand"
 	"os"
-	"sync"
 	"time"
 
-	"github.com/libp2p/go-libp2p"
-	"github.com/libp2p/go-libp2p-core/peer"
-	discovery "github.com/libp2p/go-libp2p-discovery"
-	dht "github.com/libp2p/go-libp2p-kad-dht"
-	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p-core/pnet"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/p2sub/p2sub/keypair"
+	"github.com/p2sub/p2sub/logger"
+	"github.com/p2sub/p2sub/metrics"
+	"github.com/p2sub/p2sub/node"
 )
 
 func main() {
 	// Init and parse configurations
 	Init()
 
-	// Main context
-	ctx := context.Background()
+	// Root context is canceled on SIGINT/SIGTERM
+	process := newLifecycle()
+	process.handleSignals()
 
+	exitCode := ExitOK
+	nodeServices := &services{}
+	nodeMetrics := metrics.New()
+	p2subNode, err := newNode(nodeMetrics)
+	if err == nil {
+		err = run(process, p2subNode, nodeServices, nodeMetrics)
+	}
+	if err != nil {
+		sugar.Errorf("Node stopped with error: %v", err)
+		exitCode = ExitFailure
+	}
+
+	if p2subNode != nil {
+		shutdownTimeout := time.Duration(conf.GetShutdownTimeout()) * time.Second
+		closeAll := func() error {
+			// Clients are drained before the node stops delivering messages
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := nodeServices.close(ctx); err != nil {
+				sugar.Warn(err)
+			}
+			return p2subNode.Close()
+		}
+		if shutdownCode := process.shutdown(shutdownTimeout+shutdownMargin, closeAll); shutdownCode != ExitOK && exitCode != ExitFailure {
+			exitCode = shutdownCode
+		}
+	}
+	logger.Sync()
+	os.Exit(exitCode)
+}
+
+// newNode create a node from configurations, its events are collected by nodeMetrics
+func newNode(nodeMetrics *metrics.Metrics) (*node.Node, error) {
 	// Create multiaddress from given string
 	bindPort := conf.GetBindPort()
 	bindHost := conf.GetBindHost()
@@ -46,7 +77,7 @@ func main() {
 	sugar.Debugf("Bind address: %s", bindStr)
 	sourceMultiAddr, err := multiaddr.NewMultiaddr(bindStr)
 	if err != nil {
-		sugar.Panic(err)
+		return nil, err
 	}
 
 	// Generate or load existing key pair
@@ -56,145 +87,158 @@ func main() {
 		// Create a new key pair
 		nodeKey, err = keypair.New()
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		sugar.Debugf("Save key to file: %s", nodeConfigFile)
-		nodeKey.SaveToFile(nodeConfigFile)
+		if _, err := nodeKey.SaveToFile(nodeConfigFile); err != nil {
+			return nil, err
+		}
 	} else {
 		// Load key from json file if existed
 		nodeKey, err = keypair.LoadFromFile(nodeConfigFile)
 		sugar.Debugf("Load key from file: %s", nodeConfigFile)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 	}
 
 	//Setup host with key
 	nodeID, _ := nodeKey.GetID()
 	sugar.Debugf("Setup host with given private key, node ID: %s", nodeID)
-	prvKey := nodeKey.GetPrivateKey()
-	host, err := libp2p.New(
-		ctx,
-		libp2p.ListenAddrs(sourceMultiAddr),
-		libp2p.Identity(prvKey),
-	)
-	if err != nil {
-		panic(err)
+	options := []node.Option{
+		node.ListenAddrs(sourceMultiAddr),
+		node.Identity(nodeKey.GetPrivateKey()),
+		node.Domain(conf.GetDomain()),
+		node.Discovery(conf.GetDiscoveryModes()...),
+		node.DiscoveryInterval(time.Duration(conf.GetDiscoveryInterval()) * time.Second),
+		node.TargetPeers(int(conf.GetTargetPeers())),
+		node.MdnsInterval(time.Duration(conf.GetMdnsInterval()) * time.Second),
+		node.BootstrapRetries(conf.GetBootstrapRetries()),
+		node.PeerRateLimit(float64(conf.GetPeerRate()), int(conf.GetPeerBurst())),
+		node.TopicRateLimit(float64(conf.GetTopicRate()), int(conf.GetTopicBurst())),
+		node.ClockSkew(time.Duration(conf.GetClockSkew()) * time.Second),
+		node.Reassembly(int(conf.GetReassemblyMemory())<<20, time.Duration(conf.GetReassemblyTimeout())*time.Second),
+		node.TopicLimits(int(conf.GetMaxKnownTopics()), int(conf.GetMaxPatternTopics())),
+		node.EventTracer(nodeMetrics),
+		node.Observe(nodeMetrics),
+		node.Logger(sugar),
 	}
 
-	// Start new gossip pub sub
-	myPubsub, err := pubsub.NewGossipSub(
-		ctx,
-		host,
-		pubsub.WithPeerExchange(true),
-	)
-
-	// Start direct connect if direct connect was set
-	directConnection := conf.GetDirectConnect()
-	if directConnection != "" {
-		sugar.Infof("Boot node is: %s", directConnection)
-		// Turn the destination into a multiaddr.
-		mAddr, err := multiaddr.NewMultiaddr(directConnection)
+	// Only peers with the same pre-shared key are able to handshake with
+	// current node if private network was set
+	if conf.IsPrivateNetwork() {
+		pskFile := conf.GetPSKFile()
+		psk, err := loadPSK(pskFile)
 		if err != nil {
-			log.Fatalln(err)
+			return nil, err
 		}
+		sugar.Infof("Private network mode, pre-shared key file: %s", pskFile)
+		options = append(options, node.PrivateNetwork(psk))
+	}
 
-		// Extract the peer ID from the multiaddr.
-		info, err := peer.AddrInfoFromP2pAddr(mAddr)
-		if err != nil {
-			log.Fatalln(err)
-		}
+	// Bootstrap peers of current node
+	bootstrapPeers, err := getBootstrapPeers()
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, node.BootstrapPeers(bootstrapPeers...))
+	if conf.IsNoPublicBootstrap() {
+		options = append(options, node.NoPublicBootstrap())
+	}
+	if conf.IsCatchAllPatterns() {
+		options = append(options, node.CatchAllPatterns())
+	}
 
-		// Connect to node
-		host.Connect(ctx, *info)
+	gossipSubParams, err := getGossipSubParams()
+	if err != nil {
+		return nil, err
 	}
+	options = append(options, node.GossipSub(gossipSubParams))
 
-	// Detect other nodes by domain
-	domain := conf.GetDomain()
-	if domain != "" {
-		// Start a DHT, for use in peer discovery. We can't just make a new DHT
-		// client because we want each peer to maintain its own local copy of the
-		// DHT, so that the bootstrapping node of the DHT can go down without
-		// inhibiting future peer discovery.
-		kademliaDHT, err := dht.New(ctx, host)
+	// Parameters of topics e.g: ordered delivery
+	if topicFile := conf.GetTopicFile(); topicFile != "" {
+		topicOptions, err := readTopicFile(topicFile)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
+		options = append(options, topicOptions...)
+	}
 
-		// Bootstrap the DHT. In the default configuration, this spawns a Background
-		// thread that will refresh the peer table every five minutes.
-		sugar.Debug("Bootstrapping the DHT")
-		if err = kademliaDHT.Bootstrap(ctx); err != nil {
-			panic(err)
+	// Gossipsub trace events are written to a file or sent to a remote tracer
+	if traceFile := conf.GetTraceFile(); traceFile != "" {
+		options = append(options, node.TraceFile(traceFile, conf.GetTraceFormat()))
+	}
+	if remoteTracer := conf.GetRemoteTracer(); remoteTracer != "" {
+		tracerPeers, err := node.ParsePeers([]string{remoteTracer})
+		if err != nil {
+			return nil, err
 		}
+		options = append(options, node.RemoteTracer(tracerPeers[0]))
+	}
 
-		// Let's connect to the bootstrap nodes first. They will tell us about the
-		// other nodes in the network.
-		var wg sync.WaitGroup
-		for _, peerAddr := range dht.DefaultBootstrapPeers {
-			peerinfo, _ := peer.AddrInfoFromP2pAddr(peerAddr)
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				if err := host.Connect(ctx, *peerinfo); err != nil {
-					sugar.Warn(err)
-				} else {
-					sugar.Infof("Connection established with bootstrap node: %v", *peerinfo)
-				}
-			}()
-		}
-		wg.Wait()
-
-		// We use a rendezvous point `domain` to announce our location.
-		// This is like telling your friends to meet you at the Eiffel Tower.
-		domain := conf.GetDomain()
-		sugar.Info("Announcing ourselves...")
-		routingDiscovery := discovery.NewRoutingDiscovery(kademliaDHT)
-		discovery.Advertise(ctx, routingDiscovery, domain)
-		sugar.Debug("Successfully announced!")
-
-		// Now, look for others who have announced
-		// This is like your friend telling you the location to meet you.
-		sugar.Debug("Searching for other peers...")
-		peerChan, err := routingDiscovery.FindPeers(ctx, domain)
+	// Start direct connect if direct connect was set
+	if directConnection := conf.GetDirectConnect(); directConnection != "" {
+		directPeers, err := node.ParsePeers([]string{directConnection})
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
+		options = append(options, node.DirectConnect(directPeers...))
+	}
 
-		for curPeer := range peerChan {
-			if curPeer.ID == host.ID() {
-				continue
-			}
-
-			sugar.Debugf("Connecting to: %s", curPeer.ID.Pretty())
-			err := host.Connect(ctx, curPeer)
-
-			if err != nil {
-				//sugar.Warnf("Connection failed: %v", err)
-				continue
-			}
+	return node.New(options...)
+}
 
-			sugar.Infof("Connected to: %s", curPeer.ID.Pretty())
+// run start the node and its services then block until root context was canceled
+func run(process *lifecycle, p2subNode *node.Node, nodeServices *services, nodeMetrics *metrics.Metrics) error {
+	ctx := process.ctx
+	if err := p2subNode.Start(ctx); err != nil {
+		return err
+	}
+	if err := nodeServices.start(p2subNode, nodeMetrics); err != nil {
+		return err
+	}
+	if groupFile := conf.GetGroupFile(); groupFile != "" {
+		if err := startGroups(ctx, p2subNode, groupFile); err != nil {
+			return err
 		}
 	}
 
-	myPubsub.GetTopics()
-
-	topic, _ := myPubsub.Join("hello")
-	helloWorld, err := topic.Subscribe()
+	helloWorld, err := p2subNode.Subscribe("hello")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
+	nodeConfigFile := conf.GetKeyFile()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(rand.Intn(10)) * time.Second):
+				p2subNode.Publish(ctx, helloWorld.Topic(), []byte(nodeConfigFile))
+			}
+		}
+	}()
+
 	for {
-		time.AfterFunc(time.Duration(rand.Intn(10))*time.Second, func() {
-			topic.Publish(ctx, []byte(nodeConfigFile))
-		})
 		msg, err := helloWorld.Next(ctx)
 		if err != nil {
-			panic(err)
+			if ctx.Err() != nil {
+				// Root context was canceled, it's a graceful shutdown
+				return nil
+			}
+			return err
 		}
-		sugar.Debugf("Topic: %s from: %s data: %s", topic.String(), msg.GetFrom().String(), string(msg.GetData()))
+		sugar.Debugf("Topic: %s from: %s data: %s", msg.Topic, msg.From.String(), string(msg.Data))
 	}
+}
 
+// loadPSK load pre-shared key from file, a missing file is an error since a
+// generated key would silently form a network of its own
+func loadPSK(pskFile string) (pnet.PSK, error) {
+	if _, err := os.Stat(pskFile); err != nil {
+		return nil, fmt.Errorf("pre-shared key file %s: %w, generate it with p2sub-psk", pskFile, err)
+	}
+	sugar.Debugf("Load pre-shared key from file: %s", pskFile)
+	return keypair.LoadPSKFromFile(pskFile)
 }
@@ -0,0 +1,136 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/p2sub/p2sub/admin"
+	"github.com/p2sub/p2sub/gateway"
+	"github.com/p2sub/p2sub/metrics"
+	"github.com/p2sub/p2sub/node"
+	"github.com/p2sub/p2sub/ratelimit"
+	"github.com/p2sub/p2sub/wss"
+)
+
+// metricsPath path of Prometheus metrics
+const metricsPath = "/metrics"
+
+// services HTTP services running next to the node
+type services struct {
+	servers   []*http.Server
+	websocket *wss.WebsocketServer
+	// stopGateway stop gateway after all WebSocket clients were drained
+	stopGateway context.CancelFunc
+}
+
+// start start gateway, admin API and metrics if their listen addresses were set
+func (s *services) start(p2subNode *node.Node, nodeMetrics *metrics.Metrics) error {
+	nodeMetrics.WatchNetwork(p2subNode.Host().Network())
+	nodeMetrics.WatchNode(p2subNode)
+	var sessions admin.SessionSource
+	if wsListen := conf.GetWSListen(); wsListen != "" {
+		s.websocket = wss.New()
+		s.websocket.SetRateLimit(ratelimit.New(float64(conf.GetWSRate()), int(conf.GetWSBurst())))
+		sessions = s.websocket
+		nodeMetrics.WatchWebsocket(s.websocket)
+		ctx, cancel := context.WithCancel(context.Background())
+		s.stopGateway = cancel
+		wsGateway := gateway.New(p2subNode, s.websocket, sugar)
+		wsGateway.SetDelivery(
+			int(conf.GetWSAckWindow()),
+			time.Duration(conf.GetWSAckTimeout())*time.Second,
+			time.Duration(conf.GetWSSessionGrace())*time.Second,
+		)
+		wsGateway.SetSessionLimits(
+			int(conf.GetWSSessionBuffer()),
+			time.Duration(conf.GetWSSessionLifetime())*time.Second,
+		)
+		wsGateway.SetRequestLimit(int(conf.GetWSRequestLimit()))
+		nodeMetrics.WatchGateway(wsGateway)
+		go wsGateway.Run(ctx)
+		// Event streams are closed as soon as shutdown starts
+		restCtx, stopStreams := context.WithCancel(context.Background())
+		mux := http.NewServeMux()
+		mux.HandleFunc("/ws", s.websocket.UpgradeConnection)
+		mux.Handle(gateway.TopicsPath, gateway.NewREST(restCtx, p2subNode, sugar))
+		server, err := s.listen("Gateway", wsListen, mux)
+		if err != nil {
+			stopStreams()
+			return err
+		}
+		server.RegisterOnShutdown(stopStreams)
+	}
+	if adminListen := conf.GetAdminListen(); adminListen != "" {
+		adminServer := admin.New(p2subNode, sessions, conf.cfg, sugar)
+		// Metrics are served by admin API unless they have their own listener
+		if conf.GetMetricsListen() == "" {
+			adminServer.Handle(metricsPath, nodeMetrics.Handler())
+		}
+		if _, err := s.listen("Admin API", adminListen, adminServer); err != nil {
+			return err
+		}
+	}
+	if metricsListen := conf.GetMetricsListen(); metricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle(metricsPath, nodeMetrics.Handler())
+		if _, err := s.listen("Metrics", metricsListen, mux); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listen serve handler on given address in background
+func (s *services) listen(name string, addr string, handler http.Handler) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start %s: %v", name, err)
+	}
+	server := &http.Server{Handler: handler}
+	s.servers = append(s.servers, server)
+	sugar.Infof("%s is listening on: %s", name, listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			sugar.Errorf("%s stopped: %v", name, err)
+		}
+	}()
+	return server, nil
+}
+
+// close stop HTTP servers then drain WebSocket clients
+func (s *services) close(ctx context.Context) error {
+	errs := make([]string, 0)
+	for _, server := range s.servers {
+		if err := server.Shutdown(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if s.websocket != nil {
+		if err := s.websocket.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("WebSocket clients: %v", err))
+		}
+		s.stopGateway()
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to close services: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
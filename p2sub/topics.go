@@ -0,0 +1,41 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/p2sub/p2sub/node"
+)
+
+// readTopicFile read parameters of topics from a JSON file, it maps topics
+// or patterns to their parameters e.g: {"orders/#": {"ordered": true}}
+func readTopicFile(topicFile string) ([]node.Option, error) {
+	fileContent, err := ioutil.ReadFile(topicFile)
+	if err != nil {
+		return nil, err
+	}
+	topics := make(map[string]node.TopicParams)
+	if err := json.Unmarshal(fileContent, &topics); err != nil {
+		return nil, fmt.Errorf("invalid topic file %s: %v", topicFile, err)
+	}
+	options := make([]node.Option, 0, len(topics))
+	for pattern, params := range topics {
+		options = append(options, node.ConfigureTopic(pattern, params))
+	}
+	return options, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ratelimit token bucket rate limiter, each key e.g: a peer, a
+// client or a topic has its own bucket
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval interval of removing idle buckets
+const sweepInterval = time.Minute
+
+// bucket tokens of a key at a moment
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter token bucket limiter, a nil limiter allows everything
+type Limiter struct {
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	mutex     sync.Mutex
+}
+
+// New create a limiter which refills rate tokens per second up to burst
+// tokens, burst is rate if it's less than 1. It returns nil if rate is
+// not positive
+func New(rate float64, burst int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &Limiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow take a token of key, it returns false if bucket of key is empty
+func (l *Limiter) Allow(key string) bool {
+	if l == nil {
+		return true
+	}
+	return l.allow(key, time.Now())
+}
+
+// allow take a token of key at a given time
+func (l *Limiter) allow(key string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Forget remove bucket of key e.g: when a client was disconnected
+func (l *Limiter) Forget(key string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	delete(l.buckets, key)
+	l.mutex.Unlock()
+}
+
+// sweep remove buckets which were refilled, they are the same as new buckets
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
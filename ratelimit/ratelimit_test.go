@@ -0,0 +1,99 @@
+// Copyright 2019 P2Sub Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// take take tokens of key until bucket is empty, at most limit tokens
+func take(l *Limiter, key string, now time.Time, limit int) int {
+	taken := 0
+	for taken < limit && l.allow(key, now) {
+		taken++
+	}
+	return taken
+}
+
+func TestBurstAndRefill(t *testing.T) {
+	l := New(2, 5)
+	now := time.Now()
+	if taken := take(l, "a", now, 10); taken != 5 {
+		t.Fatalf("took %d tokens of a full bucket, expected burst 5", taken)
+	}
+	// 2 tokens per second are refilled
+	if taken := take(l, "a", now.Add(time.Second), 10); taken != 2 {
+		t.Fatalf("took %d tokens after a second, expected 2", taken)
+	}
+	if l.allow("a", now.Add(time.Second+100*time.Millisecond)) {
+		t.Fatal("token was taken before it was refilled")
+	}
+	// Buckets don't hold more than burst
+	if taken := take(l, "a", now.Add(time.Hour), 10); taken != 5 {
+		t.Fatalf("took %d tokens after an hour, expected burst 5", taken)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	l := New(1, 1)
+	now := time.Now()
+	if !l.allow("a", now) || l.allow("a", now) {
+		t.Fatal("bucket of a doesn't hold one token")
+	}
+	// Each key has its own bucket
+	if !l.allow("b", now) {
+		t.Fatal("b was limited by bucket of a")
+	}
+	// A forgotten key starts with a full bucket
+	l.Forget("a")
+	if !l.allow("a", now) {
+		t.Fatal("forgotten key was limited")
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	var l *Limiter
+	if l = New(0, 10); l != nil {
+		t.Fatal("limiter without rate was created")
+	}
+	for i := 0; i < 100; i++ {
+		if !l.Allow("a") {
+			t.Fatal("nil limiter limited a key")
+		}
+	}
+	l.Forget("a")
+	if l = New(3, 0); l.burst != 3 {
+		t.Fatalf("burst is %v, expected rate 3", l.burst)
+	}
+	if l = New(0.5, 0); l.burst != 1 {
+		t.Fatalf("burst is %v, expected 1", l.burst)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l := New(1, 2)
+	now := time.Now()
+	l.allow("idle", now)
+	// Buckets which were refilled are removed once per sweep interval
+	take(l, "busy", now.Add(sweepInterval), 2)
+	take(l, "busy", now.Add(sweepInterval+time.Second), 2)
+	if _, ok := l.buckets["idle"]; ok {
+		t.Fatal("refilled bucket was not removed")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Fatal("empty bucket was removed")
+	}
+}
@@ -6,14 +6,14 @@ cd $CUR_DIR/../
 
 tmux new-session -s chiro -d
 
-tmux send "/usr/bin/go run ./p2sub --key-file ./json/node1.json --bind-port 4433 --bind-host 0.0.0.0" C-m
+tmux send "/usr/bin/go run ./p2sub --key-file ./json/node1.json --bind-port 4433 --bind-host 0.0.0.0 --admin-listen 127.0.0.1:4400" C-m
 tmux rename-window "Program 1"
 sleep 5
 tmux split-window
-tmux send "/usr/bin/go run ./p2sub --key-file ./json/node2.json --bind-port 4434 --bind-host 0.0.0.0" C-m
+tmux send "/usr/bin/go run ./p2sub --key-file ./json/node2.json --bind-port 4434 --bind-host 0.0.0.0 --admin-listen 127.0.0.1:4401" C-m
 tmux rename-window "Program 2"
 sleep 5
 tmux split-window
-tmux send "/usr/bin/go run ./p2sub --key-file ./json/node3.json --bind-port 4435 --bind-host 0.0.0.0" C-m
+tmux send "/usr/bin/go run ./p2sub --key-file ./json/node3.json --bind-port 4435 --bind-host 0.0.0.0 --admin-listen 127.0.0.1:4402" C-m
 tmux rename-window "Program 3"
 tmux attach
\ No newline at end of file
@@ -1,13 +1,18 @@
-package main
+// Package wss websocket server, each client connection is a channel
+// identified by a unique ID
+package wss
 
 import (
-	"flag"
-	"html/template"
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/p2sub/p2sub/ratelimit"
 )
 
 // Operator alias of boolean
@@ -19,35 +24,103 @@ const (
 	Read           = false
 )
 
+// DefaultQueueSize number of outbound frames queued for each channel
+const DefaultQueueSize = 256
+
+// writeTimeout deadline of writing a frame to client
+const writeTimeout = 10 * time.Second
+
+// Errors of websocket server
+var (
+	ErrUnknownChannel = errors.New("unknown channel")
+	ErrQueueFull      = errors.New("channel queue is full")
+)
+
 // ChannelIO structure
 type ChannelIO struct {
 	ID       uint64
 	Operator Operator
 	Data     []byte
+	// Throttled frame exceeded rate limit of channel, it's received so
+	// client could be told why it was rejected
+	Throttled bool
+}
+
+// SessionInfo information of a connected channel
+type SessionInfo struct {
+	ID          uint64    `json:"id"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Received    uint64    `json:"received"`
+	Sent        uint64    `json:"sent"`
+	Throttled   uint64    `json:"throttled"`
+	Queued      int       `json:"queued"`
+}
+
+// Stats traffic of websocket server since it was started
+type Stats struct {
+	Sessions int
+	Queued   int
+	Received uint64
+	Sent     uint64
+	// Dropped frames which were not queued because queue of channel was full
+	Dropped uint64
+	// Throttled frames which exceeded rate limit of their channel
+	Throttled uint64
+}
+
+// channel a client connection with its outbound queue
+type channel struct {
+	connection *websocket.Conn
+	queue      chan []byte
+	done       chan struct{}
+	info       SessionInfo
 }
 
 // WebsocketServer websocket server struct
 type WebsocketServer struct {
-	receiver    chan ChannelIO
-	sender      chan ChannelIO
-	writer      chan ChannelIO
-	connections map[uint64]*websocket.Conn
-	uniqueID    uint64
-	syncMux     sync.Mutex
+	receiver     chan ChannelIO
+	connected    chan uint64
+	disconnected chan uint64
+	connections  map[uint64]*channel
+	uniqueID     uint64
+	queueSize    int
+	received     uint64
+	sent         uint64
+	dropped      uint64
+	throttled    uint64
+	limiter      *ratelimit.Limiter
+	syncMux      sync.Mutex
+	handlers     sync.WaitGroup
+	closing      bool
+	// done closed once server was shut down, events which were not consumed
+	// by then are dropped so handlers don't block forever
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // New instance of websocket server
 func New() *WebsocketServer {
 	return &WebsocketServer{
-		connections: make(map[uint64]*websocket.Conn),
-		uniqueID:    0,
-		receiver:    make(chan ChannelIO),
-		sender:      make(chan ChannelIO),
-		writer:      make(chan ChannelIO),
-		syncMux:     sync.Mutex{},
+		connections:  make(map[uint64]*channel),
+		uniqueID:     0,
+		queueSize:    DefaultQueueSize,
+		receiver:     make(chan ChannelIO, DefaultQueueSize),
+		connected:    make(chan uint64, DefaultQueueSize),
+		disconnected: make(chan uint64, DefaultQueueSize),
+		syncMux:      sync.Mutex{},
+		done:         make(chan struct{}),
 	}
 }
 
+// SetRateLimit limit frames received from each channel, frames over limit
+// are marked as throttled. It must be set before clients are connected
+func (wss *WebsocketServer) SetRateLimit(limiter *ratelimit.Limiter) {
+	wss.syncMux.Lock()
+	wss.limiter = limiter
+	wss.syncMux.Unlock()
+}
+
 // GetUniqueID for connect
 func (wss *WebsocketServer) GetUniqueID() uint64 {
 	wss.syncMux.Lock()
@@ -63,33 +136,149 @@ func (wss *WebsocketServer) UpgradeConnection(res http.ResponseWriter, req *http
 		WriteBufferSize: 4096,
 	}
 	connection, err := upgrader.Upgrade(res, req, nil)
-	if err == nil {
-		channelID := wss.GetUniqueID()
-		wss.connections[channelID] = connection
-		// Wipe our ass after we leave
-		defer func() {
-			log.Println("Clean and close")
-			delete(wss.connections, channelID)
-			connection.Close()
-		}()
-		for {
-			messageType, message, err := connection.ReadMessage()
-			if err == nil {
-				wss.receiver <- ChannelIO{ID: channelID, Operator: Read, Data: message}
-			} else {
-				log.Println("New error:", err)
-				break
-			}
-			select {
-			case n := <-wss.writer:
-				wss.sender <- n
-				connection.WriteMessage(messageType, n.Data)
+	if err != nil {
+		log.Println("Upgrade error:", err)
+		return
+	}
+	channelID := wss.GetUniqueID()
+	ch := &channel{
+		connection: connection,
+		queue:      make(chan []byte, wss.queueSize),
+		done:       make(chan struct{}),
+		info: SessionInfo{
+			ID:          channelID,
+			RemoteAddr:  req.RemoteAddr,
+			ConnectedAt: time.Now(),
+		},
+	}
+	if !wss.addConnection(channelID, ch) {
+		// Server is shutting down, refuse new client
+		connection.WriteControl(websocket.CloseMessage, shutdownMessage, time.Now().Add(time.Second))
+		connection.Close()
+		return
+	}
+	// Wipe our ass after we leave
+	defer func() {
+		log.Println("Clean and close")
+		close(ch.done)
+		wss.removeConnection(channelID)
+		wss.limiter.Forget(strconv.FormatUint(channelID, 10))
+		connection.Close()
+		wss.notify(wss.disconnected, channelID)
+		wss.handlers.Done()
+	}()
+	go wss.writeLoop(ch)
+	wss.notify(wss.connected, channelID)
+	for {
+		_, message, err := connection.ReadMessage()
+		if err != nil {
+			log.Println("New error:", err)
+			break
+		}
+		throttled := !wss.limiter.Allow(strconv.FormatUint(channelID, 10))
+		wss.syncMux.Lock()
+		ch.info.Received++
+		wss.received++
+		if throttled {
+			ch.info.Throttled++
+			wss.throttled++
+		}
+		wss.syncMux.Unlock()
+		select {
+		case wss.receiver <- ChannelIO{ID: channelID, Operator: Read, Data: message, Throttled: throttled}:
+		case <-wss.done:
+			return
+		}
+	}
+}
+
+// notify send a connection event, it's dropped once server was shut down
+func (wss *WebsocketServer) notify(events chan<- uint64, channelID uint64) {
+	select {
+	case events <- channelID:
+	case <-wss.done:
+	}
+}
+
+// writeLoop write queued frames to client until connection was closed
+func (wss *WebsocketServer) writeLoop(ch *channel) {
+	for {
+		select {
+		case <-ch.done:
+			return
+		case data := <-ch.queue:
+			ch.connection.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := ch.connection.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Println("Write error:", err)
+				// Reader will notice closed connection and clean up
+				ch.connection.Close()
+				return
 			}
+			wss.syncMux.Lock()
+			ch.info.Sent++
+			wss.sent++
+			wss.syncMux.Unlock()
 		}
-	} else {
-		defer connection.Close()
 	}
+}
+
+// addConnection register a new connection, it returns false if server is shutting down
+func (wss *WebsocketServer) addConnection(channelID uint64, ch *channel) bool {
+	wss.syncMux.Lock()
+	defer wss.syncMux.Unlock()
+	if wss.closing {
+		return false
+	}
+	wss.connections[channelID] = ch
+	wss.handlers.Add(1)
+	return true
+}
 
+// removeConnection unregister a connection
+func (wss *WebsocketServer) removeConnection(channelID uint64) {
+	wss.syncMux.Lock()
+	defer wss.syncMux.Unlock()
+	delete(wss.connections, channelID)
+}
+
+// shutdownMessage close frame sent to clients when server is shutting down
+var shutdownMessage = websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+
+// Shutdown drain all clients, each client receives a close frame and has
+// until ctx is done to close its connection before it's closed by server.
+// Events of handlers which are still running are dropped after it returned
+func (wss *WebsocketServer) Shutdown(ctx context.Context) error {
+	defer wss.closeOnce.Do(func() {
+		close(wss.done)
+	})
+	wss.syncMux.Lock()
+	wss.closing = true
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second)
+	}
+	for _, ch := range wss.connections {
+		ch.connection.WriteControl(websocket.CloseMessage, shutdownMessage, deadline)
+	}
+	wss.syncMux.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		wss.handlers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		// Force closing, blocked readers will return and clean up
+		wss.syncMux.Lock()
+		for _, ch := range wss.connections {
+			ch.connection.Close()
+		}
+		wss.syncMux.Unlock()
+		return ctx.Err()
+	}
 }
 
 // Receiving data from channel
@@ -97,139 +286,61 @@ func (wss *WebsocketServer) Receiving() <-chan ChannelIO {
 	return wss.receiver
 }
 
-// Sending data from channel
-func (wss *WebsocketServer) Sending() <-chan ChannelIO {
-	return wss.sender
+// Connected IDs of channels which were opened
+func (wss *WebsocketServer) Connected() <-chan uint64 {
+	return wss.connected
 }
 
-// Send message to channel
-func (wss *WebsocketServer) Send(channelID uint64, data []byte) {
-	wss.writer <- ChannelIO{ID: channelID, Operator: Write, Data: data}
+// Disconnected IDs of channels which were closed
+func (wss *WebsocketServer) Disconnected() <-chan uint64 {
+	return wss.disconnected
 }
 
-func home(w http.ResponseWriter, r *http.Request) {
-	homeTemplate.Execute(w, "ws://"+r.Host+"/echo")
+// Send message to channel, it doesn't block if queue of channel is full
+func (wss *WebsocketServer) Send(channelID uint64, data []byte) error {
+	wss.syncMux.Lock()
+	ch, ok := wss.connections[channelID]
+	wss.syncMux.Unlock()
+	if !ok {
+		return ErrUnknownChannel
+	}
+	select {
+	case ch.queue <- data:
+		return nil
+	default:
+		wss.syncMux.Lock()
+		wss.dropped++
+		wss.syncMux.Unlock()
+		return ErrQueueFull
+	}
 }
 
-func main() {
-	websocketServer := New()
-	flag.Parse()
-	log.SetFlags(0)
-	http.HandleFunc("/echo", websocketServer.UpgradeConnection)
-	go func(websocketServer *WebsocketServer) {
-		for {
-			select {
-			case n := <-websocketServer.Sending():
-				log.Println("Sent", n)
-			case n := <-websocketServer.Receiving():
-				log.Println("Received:", n)
-				websocketServer.Send(n.ID, n.Data)
-			}
-		}
-	}(websocketServer)
-	http.HandleFunc("/", home)
-	log.Fatal(http.ListenAndServe("localhost:3000", nil))
-}
-
-var homeTemplate = template.Must(template.New("").Parse(`
-<!DOCTYPE html>
-<html>
-<head>
-<meta charset="utf-8">
-<script>  
-var ws;
-window.addEventListener("load", function(evt) {
-
-    var output = document.getElementById("output");
-    var input = document.getElementById("input");
-    
-
-    var print = function(message) {
-        var d = document.createElement("div");
-        d.textContent = message;
-        output.appendChild(d);
-    };
-
-    document.getElementById("open").onclick = function(evt) {
-        if (ws) {
-            return false;
-        }
-        ws = new WebSocket("{{.}}");
-        ws.onopen = function(evt) {
-            print("OPEN");
-        }
-        ws.onclose = function(evt) {
-            print("CLOSE");
-            ws = null;
-        }
-        ws.onmessage = function(evt) {
-            console.log(evt);
-            print("RESPONSE: " + evt.data);
-        }
-        ws.onerror = function(evt) {
-            print("ERROR: " + evt.data);
-        }
-        return false;
-    };
-
-    (function(evt) {
-        if (ws) {
-            return false;
-        }
-        ws = new WebSocket("{{.}}");
-        ws.onopen = function(evt) {
-            print("OPEN");
-        }
-        ws.onclose = function(evt) {
-            print("CLOSE");
-            ws = null;
-        }
-        ws.onmessage = function(evt) {
-            console.log(evt);
-            print("RESPONSE: " + evt.data);
-        }
-        ws.onerror = function(evt) {
-            print("ERROR: " + evt.data);
-        }
-        return false;
-    })();
-
-    document.getElementById("send").onclick = function(evt) {
-        if (!ws) {
-            return false;
-        }
-        print("SEND: " + input.value);
-        ws.send(input.value);
-        return false;
-    };
-
-    document.getElementById("close").onclick = function(evt) {
-        if (!ws) {
-            return false;
-        }
-        ws.close();
-        return false;
-    };
-
-});
-</script>
-</head>
-<body>
-<table>
-<tr><td valign="top" width="50%">
-<p>Click "Open" to create a connection to the server, 
-"Send" to send a message to the server and "Close" to close the connection. 
-You can change the message and send multiple times.
-<p>
-<form>
-<button id="open">Open</button>
-<button id="close">Close</button>
-<p><input id="input" type="text" value="Hello world!">
-<button id="send">Send</button>
-</form>
-</td><td valign="top" width="50%">
-<div id="output"></div>
-</td></tr></table>
-</body>
-</html>
-`))
+// Stats get traffic of websocket server
+func (wss *WebsocketServer) Stats() Stats {
+	wss.syncMux.Lock()
+	defer wss.syncMux.Unlock()
+	stats := Stats{
+		Sessions:  len(wss.connections),
+		Received:  wss.received,
+		Sent:      wss.sent,
+		Dropped:   wss.dropped,
+		Throttled: wss.throttled,
+	}
+	for _, ch := range wss.connections {
+		stats.Queued += len(ch.queue)
+	}
+	return stats
+}
+
+// Sessions get information of connected channels
+func (wss *WebsocketServer) Sessions() []SessionInfo {
+	wss.syncMux.Lock()
+	defer wss.syncMux.Unlock()
+	sessions := make([]SessionInfo, 0, len(wss.connections))
+	for _, ch := range wss.connections {
+		info := ch.info
+		info.Queued = len(ch.queue)
+		sessions = append(sessions, info)
+	}
+	return sessions
+}